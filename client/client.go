@@ -22,6 +22,7 @@ import (
 
 	"github.com/gomodule/redigo/redis"
 	"github.com/maarek/aves"
+	"github.com/oklog/ulid/v2"
 )
 
 const ok = "OK"
@@ -35,16 +36,52 @@ type Context struct {
 type CommandClient interface {
 	// stream
 	Delete(stream string) (bool, error)
+	HardDelete(stream string) (bool, error)
+	Undelete(stream string) (bool, error)
 	Exists(stream string) (bool, error)
+	ExistsCount(streams ...string) (int, error)
+	StreamStates(streams ...string) ([]StreamState, error)
 	SList() ([]Stream, error)
+	SListPage(cursor string, match string, count int) (string, []Stream, error)
+	SListIterator(match string, count int) *StreamIterator
+	SMetaSet(stream string, metadata string) (bool, error)
+	SMetaGet(stream string) (string, error)
 
 	// events
 	EList(stream string, offset string, index string) ([]SimpleEvent, error)
+	EListBackward(stream string, from string, count string) ([]SimpleEvent, error)
+	ELast(stream string) (*SimpleEvent, error)
+	ERange(from time.Time, to time.Time, stream string, count int) ([]FullEvent, error)
 
 	// pubsub
-	Publish(stream string, version string, event string) (bool, error)
+	Publish(stream string, expected string, event string) (bool, error)
+	PublishEvent(stream string, expected string, data string, envelope Envelope) (bool, error)
+	PublishBatch(stream string, expected string, events ...string) (bool, error)
+	PublishEventBatch(stream string, expected string, events ...NewEvent) (bool, error)
 	Subscribe(inc chan<- FullEvent, errc chan<- error, stream string, offset string)
-	SubscribeAll(inc chan<- FullEvent, errc chan<- error, offset string)
+	SubscribeAll(inc chan<- FullEvent, errc chan<- error, position string)
+	SubscribeFrom(inc chan<- FullEvent, errc chan<- error, stream string, checkpoint string)
+	SubscribeAllFrom(inc chan<- FullEvent, errc chan<- error, checkpoint string)
+
+	// checkpoints
+	CheckpointSet(name string, position string) (bool, error)
+	CheckpointGet(name string) (string, error)
+
+	// snapshots
+	SnapshotSave(stream string, version int, state string) (bool, error)
+	SnapshotLoad(stream string) (*Snapshot, error)
+
+	// consumer groups
+	GroupCreate(group string, stream string, position string) (bool, error)
+	GroupRead(group string, consumer string, count int, visibility time.Duration) ([]GroupEvent, error)
+	Ack(group string, positions ...string) (int, error)
+	Nack(group string, positions ...string) (int, error)
+
+	// projections
+	ProjectionCreate(name string, source string) (bool, error)
+	ProjectionGet(name string, partition string) (string, error)
+	ProjectionDelete(name string) (bool, error)
+	ProjectionList() ([]Projection, error)
 }
 
 // NewClient - generate a new client connection
@@ -59,21 +96,64 @@ func NewClient(addr string) (*Context, error) {
 	}, nil
 }
 
-// Delete - delete a stream
+// Close - closes the client connection
+func (c *Context) Close() error {
+	return c.client.Close()
+}
+
+// Delete - soft delete a stream, its events are hidden until it is restored
 func (c *Context) Delete(stream string) (bool, error) {
-	v, err := redis.String(c.client.Do(string(aves.StreamDelete), stream))
+	v, err := redis.String(c.client.Do(string(aves.StreamDelete), stream, "SOFT"))
+	if v == ok {
+		return true, nil
+	}
+	return false, err
+}
+
+// HardDelete - permanently delete a stream, it can not be appended to afterwards
+func (c *Context) HardDelete(stream string) (bool, error) {
+	v, err := redis.String(c.client.Do(string(aves.StreamDelete), stream, "HARD"))
 	if v == ok {
 		return true, nil
 	}
 	return false, err
 }
 
+// Undelete - restore a soft deleted stream, false when it was not deleted
+func (c *Context) Undelete(stream string) (bool, error) {
+	return redis.Bool(c.client.Do(string(aves.StreamUndelete), stream))
+}
+
 // Exists - determine if a stream exists
 func (c *Context) Exists(stream string) (bool, error) {
 	exists, err := redis.Bool(c.client.Do(string(aves.StreamExists), stream))
 	return exists, err
 }
 
+// ExistsCount - the number of the streams that exist, a stream given twice is counted twice
+func (c *Context) ExistsCount(streams ...string) (int, error) {
+	args := make([]interface{}, len(streams))
+	for i, stream := range streams {
+		args[i] = stream
+	}
+	return redis.Int(c.client.Do(string(aves.StreamExists), args...))
+}
+
+// StreamStates - whether each stream exists along with its head version and deletion state
+func (c *Context) StreamStates(streams ...string) ([]StreamState, error) {
+	args := make([]interface{}, 0, len(streams)+1)
+	args = append(args, "WITHSTATE")
+	for _, stream := range streams {
+		args = append(args, stream)
+	}
+
+	resp, err := redis.Values(c.client.Do(string(aves.StreamExists), args...))
+	if err != nil {
+		return nil, err
+	}
+	return parseStreamStateResp(streams, resp)
+}
+
 // SList - list all streams
 func (c *Context) SList() ([]Stream, error) {
 	resp, err := redis.Values(c.client.Do(string(aves.StreamList)))
@@ -83,6 +163,94 @@ func (c *Context) SList() ([]Stream, error) {
 	return parseSListResp(resp)
 }
 
+// SListPage - lists a page of the streams matching the glob pattern starting at the cursor,
+// looking at about count streams. The first page is at cursor 0 and the cursor of the next
+// page is returned, 0 after the last page.
+func (c *Context) SListPage(cursor, match string, count int) (string, []Stream, error) {
+	args := []interface{}{"CURSOR", cursor}
+	if match != "" {
+		args = append(args, "MATCH", match)
+	}
+	if count > 0 {
+		args = append(args, "COUNT", count)
+	}
+
+	resp, err := redis.Values(c.client.Do(string(aves.StreamList), args...))
+	if err != nil {
+		return "", nil, err
+	}
+
+	var next string
+	var page []interface{}
+	if _, err := redis.Scan(resp, &next, &page); err != nil {
+		return "", nil, fmt.Errorf("error parsing streams")
+	}
+
+	streams, err := parseSListResp(page)
+	return next, streams, err
+}
+
+// SListIterator - iterates over the streams matching the glob pattern a page at a time
+func (c *Context) SListIterator(match string, count int) *StreamIterator {
+	return &StreamIterator{c: c, match: match, count: count, cursor: "0"}
+}
+
+// StreamIterator - iterates over the streams listed by pages of SLIST, a stream written to
+// while iterating may or may not be returned
+type StreamIterator struct {
+	c      *Context
+	match  string
+	count  int
+	cursor string
+	done   bool
+
+	page   []Stream
+	stream Stream
+	err    error
+}
+
+// Next - advances to the next stream, false once every stream was returned or a page failed
+func (it *StreamIterator) Next() bool {
+	for len(it.page) == 0 {
+		if it.done || it.err != nil {
+			return false
+		}
+		it.cursor, it.page, it.err = it.c.SListPage(it.cursor, it.match, it.count)
+		it.done = it.cursor == "0"
+	}
+
+	it.stream, it.page = it.page[0], it.page[1:]
+	return true
+}
+
+// Stream - the stream Next advanced to
+func (it *StreamIterator) Stream() Stream {
+	return it.stream
+}
+
+// Err - the error that stopped the iteration, nil when every stream was returned
+func (it *StreamIterator) Err() error {
+	return it.err
+}
+
+// SMetaSet - replaces the metadata of a stream given as a JSON object
+func (c *Context) SMetaSet(stream, metadata string) (bool, error) {
+	v, err := redis.String(c.client.Do(string(aves.StreamMeta), "SET", stream, metadata))
+	if v == ok {
+		return true, nil
+	}
+	return false, err
+}
+
+// SMetaGet - fetches the metadata of a stream as a JSON object, empty when it has none
+func (c *Context) SMetaGet(stream string) (string, error) {
+	v, err := redis.String(c.client.Do(string(aves.StreamMeta), "GET", stream))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return v, err
+}
+
 // EList - list all events in a stream
 func (c *Context) EList(stream, offset, index string) ([]SimpleEvent, error) {
 	resp, err := redis.Values(c.client.Do(string(aves.EventList), stream, offset, index))
@@ -92,51 +260,276 @@ func (c *Context) EList(stream, offset, index string) ([]SimpleEvent, error) {
 	return parseSimpleEventListResp(resp)
 }
 
-// Publish - publish an event to a stream
-func (c *Context) Publish(stream, version, event string) (bool, error) {
-	v, err := redis.String(c.client.Do(string(aves.EventPublish), stream, version, event))
+// EListBackward - list the events of a stream from the version given, or from the head when
+// it is empty, down to the first event
+func (c *Context) EListBackward(stream, from, count string) ([]SimpleEvent, error) {
+	resp, err := redis.Values(c.client.Do(string(aves.EventList), stream, "BACKWARD", from, count))
+	if err != nil {
+		return nil, err
+	}
+	return parseSimpleEventListResp(resp)
+}
+
+// ELast - fetch the head event of a stream, nil when the stream has no events
+func (c *Context) ELast(stream string) (*SimpleEvent, error) {
+	resp, err := redis.Values(c.client.Do(string(aves.EventLast), stream))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	events, err := parseSimpleEventListResp(resp)
+	if err != nil {
+		return nil, err
+	}
+	return &events[0], nil
+}
+
+// ERange - fetch up to count events committed from one time up to but not including another
+// to the streams starting with the prefix given, every event when count is 0
+func (c *Context) ERange(from, to time.Time, stream string, count int) ([]FullEvent, error) {
+	args := []interface{}{ulid.Timestamp(from), ulid.Timestamp(to)}
+	if stream != "" {
+		args = append(args, "STREAM", stream)
+	}
+	if count > 0 {
+		args = append(args, "COUNT", count)
+	}
+
+	resp, err := redis.Values(c.client.Do(string(aves.EventTimeRange), args...))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseFullEventListResp(resp)
+}
+
+// Publish - publish an event to a stream if its head matches the expected version.
+// The expected version is an integer or one of ANY, NO_STREAM and STREAM_EXISTS.
+func (c *Context) Publish(stream, expected, event string) (bool, error) {
+	v, err := redis.String(c.client.Do(string(aves.EventPublish), stream, expected, event))
+	if v == ok {
+		return true, nil
+	}
+	return false, parseWrongExpectedVersion(err)
+}
+
+// PublishEvent - publish an event along with its type and metadata to a stream if its head
+// matches the expected version, an empty expected version publishes to any head
+func (c *Context) PublishEvent(stream, expected, data string, envelope Envelope) (bool, error) {
+	if expected == "" {
+		expected = "ANY"
+	}
+
+	args := []interface{}{stream, expected}
+	args = append(args, envelope.args()...)
+	args = append(args, data)
+
+	v, err := redis.String(c.client.Do(string(aves.EventPublish), args...))
+	if v == ok {
+		return true, nil
+	}
+	return false, parseWrongExpectedVersion(err)
+}
+
+// PublishBatch - atomically publish several events to a stream if its head matches the expected version
+func (c *Context) PublishBatch(stream, expected string, events ...string) (bool, error) {
+	args := make([]interface{}, 0, len(events)+2)
+	args = append(args, stream, expected)
+	for _, event := range events {
+		args = append(args, event)
+	}
+
+	v, err := redis.String(c.client.Do(string(aves.EventPublishBatch), args...))
+	if v == ok {
+		return true, nil
+	}
+	return false, parseWrongExpectedVersion(err)
+}
+
+// PublishEventBatch - atomically publish several events along with their type and metadata to a
+// stream if its head matches the expected version
+func (c *Context) PublishEventBatch(stream, expected string, events ...NewEvent) (bool, error) {
+	args := []interface{}{stream, expected}
+	for _, event := range events {
+		args = append(args, event.Envelope.args()...)
+		args = append(args, event.Data)
+	}
+
+	v, err := redis.String(c.client.Do(string(aves.EventPublishBatch), args...))
+	if v == ok {
+		return true, nil
+	}
+	return false, parseWrongExpectedVersion(err)
+}
+
+// GroupCreate - creates a consumer group reading a stream, or the streams matching a pattern,
+// after the position or from the first event when it is empty
+func (c *Context) GroupCreate(group, stream, position string) (bool, error) {
+	v, err := redis.String(c.client.Do(string(aves.GroupCreate), group, stream, position))
 	if v == ok {
 		return true, nil
 	}
 	return false, err
 }
 
-// Subscribe - subscribes to a stream to stream events from that stream
-func (c *Context) Subscribe(inc chan<- FullEvent, errc chan<- error, stream, offset string) {
-	err := c.client.Send(string(aves.StreamSubscribe), stream, offset)
+// GroupRead - reads up to count events of the group that no other consumer holds, the events
+// are handed out again when they are not acknowledged within the visibility timeout
+func (c *Context) GroupRead(group, consumer string, count int, visibility time.Duration) ([]GroupEvent, error) {
+	args := []interface{}{group, consumer, count}
+	if visibility > 0 {
+		args = append(args, visibility.Milliseconds())
+	}
+
+	resp, err := redis.Values(c.client.Do(string(aves.GroupRead), args...))
 	if err != nil {
-		errc <- err
-		return
+		return nil, err
 	}
+	return parseGroupEventListResp(resp)
+}
 
-	err = c.client.Flush()
+// Ack - acknowledges events read from the group by their positions, a position alone
+// acknowledges every event read at it
+func (c *Context) Ack(group string, positions ...string) (int, error) {
+	return redis.Int(c.client.Do(string(aves.GroupAck), groupArgs(group, positions)...))
+}
+
+// Nack - hands events read from the group back to be read again right away
+func (c *Context) Nack(group string, positions ...string) (int, error) {
+	return redis.Int(c.client.Do(string(aves.GroupNack), groupArgs(group, positions)...))
+}
+
+func groupArgs(group string, positions []string) []interface{} {
+	args := make([]interface{}, 0, len(positions)+1)
+	args = append(args, group)
+	for _, position := range positions {
+		args = append(args, position)
+	}
+	return args
+}
+
+// CheckpointSet - saves the position of a subscriber under the name, the position is the
+// global position of an event or the version of a stream
+func (c *Context) CheckpointSet(name, position string) (bool, error) {
+	v, err := redis.String(c.client.Do(string(aves.Checkpoint), "SET", name, position))
+	if v == ok {
+		return true, nil
+	}
+	return false, err
+}
+
+// CheckpointGet - fetches the position saved under the name, empty when it was never saved
+func (c *Context) CheckpointGet(name string) (string, error) {
+	v, err := redis.String(c.client.Do(string(aves.Checkpoint), "GET", name))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return v, err
+}
+
+// SnapshotSave - saves the state of a stream as of the version, a snapshot at a later version
+// is kept rather than replaced
+func (c *Context) SnapshotSave(stream string, version int, state string) (bool, error) {
+	v, err := redis.String(c.client.Do(string(aves.Snapshot), "SAVE", stream, version, state))
+	if v == ok {
+		return true, nil
+	}
+	return false, err
+}
+
+// SnapshotLoad - fetches the latest snapshot of a stream, nil when there is none. The events
+// after its version are read with EList.
+func (c *Context) SnapshotLoad(stream string) (*Snapshot, error) {
+	resp, err := redis.Values(c.client.Do(string(aves.Snapshot), "LOAD", stream))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
 	if err != nil {
-		errc <- err
-		return
+		return nil, err
 	}
 
-	for {
-		resp, err := redis.Values(c.client.Receive())
-		if err != nil {
-			errc <- err
-			return
-		}
-		// process pushed message
-		parsed, err := parseFullEventListResp(resp)
-		if err != nil {
-			errc <- err
-			return
-		}
+	var s Snapshot
+	if _, err := redis.Scan(resp, &s.Version, &s.State); err != nil {
+		return nil, fmt.Errorf("error parsing snapshot")
+	}
+	return &s, nil
+}
 
-		for _, event := range parsed {
-			inc <- event
-		}
+// ProjectionCreate - creates a projection from its source, it runs over every event stored so far
+// and then over every event published
+func (c *Context) ProjectionCreate(name, source string) (bool, error) {
+	v, err := redis.String(c.client.Do(string(aves.Projection), "CREATE", name, source))
+	if v == ok {
+		return true, nil
+	}
+	return false, err
+}
+
+// ProjectionGet - fetches the state of a partition of the projection as a JSON object, empty
+// when no event was applied to it yet. Projections without partitions use the empty partition.
+func (c *Context) ProjectionGet(name, partition string) (string, error) {
+	v, err := redis.String(c.client.Do(string(aves.Projection), "GET", name, partition))
+	if err == redis.ErrNil {
+		return "", nil
 	}
+	return v, err
 }
 
-// SubscribeAll - subscribes to all streams to get all events that occur
-func (c *Context) SubscribeAll(inc chan<- FullEvent, errc chan<- error, offset string) {
-	err := c.client.Send(string(aves.SubscribeAll), offset)
+// ProjectionDelete - stops the projection and removes its state
+func (c *Context) ProjectionDelete(name string) (bool, error) {
+	v, err := redis.String(c.client.Do(string(aves.Projection), "DELETE", name))
+	if v == ok {
+		return true, nil
+	}
+	return false, err
+}
+
+// ProjectionList - lists the projections and how far each has got
+func (c *Context) ProjectionList() ([]Projection, error) {
+	resp, err := redis.Values(c.client.Do(string(aves.Projection), "LIST"))
+	if err != nil {
+		return nil, err
+	}
+	return parseProjectionListResp(resp)
+}
+
+// Subscribe - subscribes to a stream to stream events from that stream, a stream ending
+// with * subscribes to every stream starting with it and its offset is a global position
+func (c *Context) Subscribe(inc chan<- FullEvent, errc chan<- error, stream, offset string) {
+	c.receive(inc, nil, errc, aves.StreamSubscribe, stream, offset)
+}
+
+// SubscribeAll - subscribes to all streams to get all events that occur after the
+// global position, or every event when the position is empty
+func (c *Context) SubscribeAll(inc chan<- FullEvent, errc chan<- error, position string) {
+	c.receive(inc, nil, errc, aves.SubscribeAll, position)
+}
+
+// SubscribeAllFiltered - subscribes to the events of all streams after the global position that
+// pass the filter, the positions of the events skipped by the filter are sent to pings every
+// so often so that a checkpoint can be advanced
+func (c *Context) SubscribeAllFiltered(inc chan<- FullEvent, pings chan<- string, errc chan<- error, position string, filter Filter) {
+	c.receive(inc, pings, errc, aves.SubscribeAll, append([]interface{}{position}, filter.args()...)...)
+}
+
+// SubscribeFrom - subscribes to a stream after the position saved in the checkpoint
+func (c *Context) SubscribeFrom(inc chan<- FullEvent, errc chan<- error, stream, checkpoint string) {
+	c.receive(inc, nil, errc, aves.StreamSubscribe, stream, "FROM", "CHECKPOINT", checkpoint)
+}
+
+// SubscribeAllFrom - subscribes to all streams after the position saved in the checkpoint
+func (c *Context) SubscribeAllFrom(inc chan<- FullEvent, errc chan<- error, checkpoint string) {
+	c.receive(inc, nil, errc, aves.SubscribeAll, "FROM", "CHECKPOINT", checkpoint)
+}
+
+// receive - sends a subscribe command and streams the events pushed by the server,
+// checkpoint pings are sent to pings unless it is nil
+func (c *Context) receive(inc chan<- FullEvent, pings chan<- string, errc chan<- error, cmd aves.Command, args ...interface{}) {
+	err := c.client.Send(string(cmd), args...)
 	if err != nil {
 		errc <- err
 		return
@@ -154,6 +547,13 @@ func (c *Context) SubscribeAll(inc chan<- FullEvent, errc chan<- error, offset s
 			errc <- err
 			return
 		}
+		if position, ok := parseCheckpointPing(resp); ok {
+			if pings != nil {
+				pings <- position
+			}
+			continue
+		}
+
 		// process pushed message
 		parsed, err := parseFullEventListResp(resp)
 		if err != nil {
@@ -18,14 +18,22 @@ package client
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/gomodule/redigo/redis"
+	"github.com/maarek/aves/commands/pubsub"
 )
 
 // Stream - defines the aggregate stream response
 type Stream struct {
 	StreamID   string
 	EventCount int
+	Head       int
+	// Size - the size in bytes of the events stored
+	Size int64
+	// Created, Updated - the unix times in milliseconds of the first and last event written
+	Created int64
+	Updated int64
 }
 
 func parseSListResp(resp []interface{}) ([]Stream, error) {
@@ -37,10 +45,69 @@ func parseSListResp(resp []interface{}) ([]Stream, error) {
 	return streams, nil
 }
 
-// SimpleEvent - defines an event on a stream without metadata
+// StreamState - defines whether a stream exists, it exists while it has events to read
+type StreamState struct {
+	StreamID string
+	Exists   bool
+	Head     int
+	// State - one of none, active, deleted and tombstoned
+	State string
+}
+
+func parseStreamStateResp(streams []string, resp []interface{}) ([]StreamState, error) {
+	states := make([]StreamState, len(streams))
+	for i := range states {
+		states[i].StreamID = streams[i]
+		var err error
+		if resp, err = redis.Scan(resp, &states[i].Exists, &states[i].Head, &states[i].State); err != nil {
+			return nil, fmt.Errorf("error parsing stream states")
+		}
+	}
+
+	return states, nil
+}
+
+// Envelope - defines the fields published along with the data of an event
+type Envelope struct {
+	Type          string
+	ContentType   string
+	CorrelationID string
+	CausationID   string
+	// Metadata - free form values of the event
+	Metadata string
+}
+
+// args - the PUBLISH arguments of the fields that are set
+func (e Envelope) args() []interface{} {
+	var args []interface{}
+	for _, f := range []struct {
+		name  string
+		value string
+	}{
+		{"TYPE", e.Type},
+		{"CONTENTTYPE", e.ContentType},
+		{"CORRELATION", e.CorrelationID},
+		{"CAUSATION", e.CausationID},
+		{"METADATA", e.Metadata},
+	} {
+		if f.value != "" {
+			args = append(args, f.name, f.value)
+		}
+	}
+	return args
+}
+
+// NewEvent - defines an event to publish in a batch
+type NewEvent struct {
+	Data string
+	Envelope
+}
+
+// SimpleEvent - defines an event on a stream without its position
 type SimpleEvent struct {
 	Version int
 	Data    string
+	Envelope
 }
 
 func parseSimpleEventListResp(resp []interface{}) ([]SimpleEvent, error) {
@@ -52,12 +119,47 @@ func parseSimpleEventListResp(resp []interface{}) ([]SimpleEvent, error) {
 	return events, nil
 }
 
-// FullEvent - defines an event on a stream with metadata
+// FullEvent - defines an event on a stream with its position
 type FullEvent struct {
 	StreamID string
-	EventID  string
-	Version  int
-	Data     string
+	// EventID - the global position of the event
+	EventID string
+	Version int
+	Data    string
+	Envelope
+}
+
+// GroupEvent - defines an event read from a consumer group
+type GroupEvent struct {
+	FullEvent
+	// Deliveries - the number of times the event has been read from the group
+	Deliveries int
+	// Source - the stream the event was read from, the link stream when read through a link
+	Source string
+}
+
+// Position - the position of the event to acknowledge it alone, links share the position
+// of the event they link to
+func (e GroupEvent) Position() string {
+	return e.EventID + ":" + e.Source
+}
+
+func parseGroupEventListResp(resp []interface{}) ([]GroupEvent, error) {
+	events := make([]GroupEvent, len(resp))
+	for i, item := range resp {
+		values, err := redis.Values(item, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing events")
+		}
+		e := &events[i]
+		_, err = redis.Scan(values, &e.StreamID, &e.EventID, &e.Version, &e.Data,
+			&e.Type, &e.ContentType, &e.CorrelationID, &e.CausationID, &e.Metadata, &e.Deliveries, &e.Source)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing events")
+		}
+	}
+
+	return events, nil
 }
 
 func parseFullEventListResp(resp []interface{}) ([]FullEvent, error) {
@@ -68,3 +170,97 @@ func parseFullEventListResp(resp []interface{}) ([]FullEvent, error) {
 
 	return events, nil
 }
+
+// Snapshot - defines the state of a stream as of a version
+type Snapshot struct {
+	Version int
+	State   string
+}
+
+// Projection - defines the progress of a projection
+type Projection struct {
+	Name       string
+	Checkpoint string
+	// Error - the reason the projection stopped, empty while it runs
+	Error string
+}
+
+func parseProjectionListResp(resp []interface{}) ([]Projection, error) {
+	var projections []Projection
+	if err := redis.ScanSlice(resp, &projections); err != nil {
+		return nil, fmt.Errorf("error parsing projections")
+	}
+
+	return projections, nil
+}
+
+// Filter - selects the events of a filtered subscription to all streams, an event must
+// match every field set
+type Filter struct {
+	// Prefix - the prefix of the streams of the events
+	Prefix string
+	// Regex - a regular expression matching the streams of the events
+	Regex string
+	// Types - the types of the events
+	Types []string
+	// PingEvery - the number of events skipped before a checkpoint ping, the server default when 0
+	PingEvery int
+}
+
+// args - the SUBSCRIBEALL arguments of the fields that are set
+func (f Filter) args() []interface{} {
+	var args []interface{}
+	if f.Prefix != "" {
+		args = append(args, "PREFIX", f.Prefix)
+	}
+	if f.Regex != "" {
+		args = append(args, "REGEX", f.Regex)
+	}
+	if len(f.Types) > 0 {
+		args = append(args, "TYPES", strings.Join(f.Types, ","))
+	}
+	if f.PingEvery > 0 {
+		args = append(args, "PINGEVERY", f.PingEvery)
+	}
+	return args
+}
+
+// parseCheckpointPing - the position of a checkpoint ping pushed in place of skipped events
+func parseCheckpointPing(resp []interface{}) (string, bool) {
+	if len(resp) != 2 {
+		return "", false
+	}
+	kind, err := redis.String(resp[0], nil)
+	if err != nil || kind != pubsub.CheckpointPing {
+		return "", false
+	}
+	position, err := redis.String(resp[1], nil)
+	if err != nil {
+		return "", false
+	}
+	return position, true
+}
+
+// WrongExpectedVersionError - the stream head did not match the expected version of a publish
+type WrongExpectedVersionError struct {
+	Expected string
+	Actual   int
+}
+
+func (e *WrongExpectedVersionError) Error() string {
+	return fmt.Sprintf("wrong expected version: expected %s actual %d", e.Expected, e.Actual)
+}
+
+func parseWrongExpectedVersion(err error) error {
+	rerr, ok := err.(redis.Error)
+	if !ok || !strings.HasPrefix(string(rerr), "WRONGEXPECTEDVERSION") {
+		return err
+	}
+
+	wev := &WrongExpectedVersionError{}
+	if _, serr := fmt.Sscanf(string(rerr), "WRONGEXPECTEDVERSION expected %s actual %d", &wev.Expected, &wev.Actual); serr != nil {
+		return err
+	}
+
+	return wev
+}
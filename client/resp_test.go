@@ -0,0 +1,53 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+func TestParseWrongExpectedVersion(t *testing.T) {
+	for _, tt := range []struct {
+		reply    string
+		expected string
+		actual   int
+	}{
+		{"WRONGEXPECTEDVERSION expected NO_STREAM actual 3", "NO_STREAM", 3},
+		{"WRONGEXPECTEDVERSION expected STREAM_EXISTS actual 0", "STREAM_EXISTS", 0},
+		{"WRONGEXPECTEDVERSION expected 7 actual 9", "7", 9},
+	} {
+		err := parseWrongExpectedVersion(redis.Error(tt.reply))
+		var wev *WrongExpectedVersionError
+		if !errors.As(err, &wev) || wev.Expected != tt.expected || wev.Actual != tt.actual {
+			t.Fatalf("expected %q to parse as %s %d, got %#v", tt.reply, tt.expected, tt.actual, err)
+		}
+	}
+
+	for _, err := range []error{
+		nil,
+		errors.New("WRONGEXPECTEDVERSION expected NO_STREAM actual 3"),
+		redis.Error("ERR invalid expected version \"x\""),
+		redis.Error("WRONGEXPECTEDVERSION something else"),
+	} {
+		if got := parseWrongExpectedVersion(err); got != err {
+			t.Fatalf("expected %v to be returned as is, got %#v", err, got)
+		}
+	}
+}
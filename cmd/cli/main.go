@@ -20,8 +20,11 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/maarek/aves"
 	"github.com/maarek/aves/client"
@@ -32,23 +35,27 @@ func streamDelete(c *client.Context, args []string) error {
 	if len(args) > 2 {
 		stream = args[2]
 	}
-	if ok, err := c.Delete(stream); !ok || err != nil {
+	del := c.HardDelete
+	if len(args) > 3 && strings.EqualFold(args[3], "soft") {
+		del = c.Delete
+	}
+	if ok, err := del(stream); !ok || err != nil {
 		return err
 	}
 	fmt.Println("success")
 	return nil
 }
 
-func streamExists(c *client.Context, args []string) error {
+func streamUndelete(c *client.Context, args []string) error {
 	var stream string
 	if len(args) > 2 {
 		stream = args[2]
 	}
-	exists, err := c.Exists(stream)
+	restored, err := c.Undelete(stream)
 	if err != nil {
 		return err
 	}
-	if exists {
+	if restored {
 		fmt.Println("true")
 	} else {
 		fmt.Println("false")
@@ -56,18 +63,95 @@ func streamExists(c *client.Context, args []string) error {
 	return nil
 }
 
-func streamList(c *client.Context) error {
-	streams, err := c.SList()
+func streamExists(c *client.Context, args []string) error {
+	var streams []string
+	if len(args) > 2 {
+		streams = args[2:]
+	}
+	if len(streams) < 2 {
+		var stream string
+		if len(streams) == 1 {
+			stream = streams[0]
+		}
+		exists, err := c.Exists(stream)
+		if err != nil {
+			return err
+		}
+		if exists {
+			fmt.Println("true")
+		} else {
+			fmt.Println("false")
+		}
+		return nil
+	}
+	states, err := c.StreamStates(streams...)
 	if err != nil {
 		return err
 	}
-	for _, stream := range streams {
+	for _, s := range states {
+		fmt.Printf("%s: %t %d %s\n", s.StreamID, s.Exists, s.Head, s.State)
+	}
+	return nil
+}
+
+func streamList(c *client.Context, args []string) error {
+	var match string
+	count := 0
+	if len(args) > 2 {
+		match = args[2]
+	}
+	if len(args) > 3 {
+		n, err := strconv.Atoi(args[3])
+		if err != nil {
+			return err
+		}
+		count = n
+	}
+	it := c.SListIterator(match, count)
+	for it.Next() {
+		stream := it.Stream()
 		fmt.Printf("%s: %d\n", stream.StreamID, stream.EventCount)
 	}
+	return it.Err()
+}
+
+func streamMeta(c *client.Context, args []string) error {
+	var sub, stream, metadata string
+	if len(args) > 2 {
+		sub = args[2]
+	}
+	if len(args) > 3 {
+		stream = args[3]
+	}
+	if len(args) > 4 {
+		metadata = args[4]
+	}
+	switch strings.ToLower(sub) {
+	case "set":
+		if ok, err := c.SMetaSet(stream, metadata); !ok || err != nil {
+			return err
+		}
+		fmt.Println("success")
+	case "get":
+		metadata, err := c.SMetaGet(stream)
+		if err != nil {
+			return err
+		}
+		fmt.Println(metadata)
+	default:
+		return errors.New("unknown smeta command")
+	}
 	return nil
 }
 
 func eventList(c *client.Context, args []string) error {
+	// elist <stream> backward [<from>] [<count>]
+	list := c.EList
+	if len(args) > 3 && strings.ToLower(args[3]) == "backward" {
+		list = c.EListBackward
+		args = append(args[:3], args[4:]...)
+	}
+
 	var offset, limit string
 	if len(args) > 3 {
 		offset = args[3]
@@ -75,7 +159,7 @@ func eventList(c *client.Context, args []string) error {
 	if len(args) > 4 {
 		limit = args[4]
 	}
-	events, err := c.EList(args[2], offset, limit)
+	events, err := list(args[2], offset, limit)
 	if err != nil {
 		return err
 	}
@@ -85,18 +169,86 @@ func eventList(c *client.Context, args []string) error {
 	return nil
 }
 
+func eventLast(c *client.Context, args []string) error {
+	event, err := c.ELast(args[2])
+	if err != nil {
+		return err
+	}
+	if event != nil {
+		fmt.Printf("%d: %s\n", event.Version, event.Data)
+	}
+	return nil
+}
+
+func eventRange(c *client.Context, args []string) error {
+	var from, to time.Time
+	var stream string
+	count := 0
+	for i, t := range []*time.Time{&from, &to} {
+		if len(args) <= i+2 {
+			return errors.New("from and to times are required")
+		}
+		parsed, err := time.Parse(time.RFC3339Nano, args[i+2])
+		if err != nil {
+			return err
+		}
+		*t = parsed
+	}
+	if len(args) > 4 {
+		stream = args[4]
+	}
+	if len(args) > 5 {
+		n, err := strconv.Atoi(args[5])
+		if err != nil {
+			return err
+		}
+		count = n
+	}
+	events, err := c.ERange(from, to, stream, count)
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		fmt.Printf("%s:%s:%d: %s\n", event.StreamID, event.EventID, event.Version, event.Data)
+	}
+	return nil
+}
+
 func eventPublish(c *client.Context, args []string) error {
-	var stream, version, data string
+	var stream, expected, data string
+	var envelope client.Envelope
 	if len(args) > 2 {
 		stream = args[2]
 	}
 	if len(args) > 3 {
-		version = args[3]
+		expected = args[3]
 	}
 	if len(args) > 4 {
-		version = args[4]
+		data = args[4]
+	}
+	if len(args) > 5 {
+		envelope.Type = args[5]
 	}
-	if ok, err := c.Publish(stream, version, data); !ok || err != nil {
+	if ok, err := c.PublishEvent(stream, expected, data, envelope); !ok || err != nil {
+		return err
+	}
+	fmt.Println("success")
+	return nil
+}
+
+func eventPublishBatch(c *client.Context, args []string) error {
+	var stream, expected string
+	var data []string
+	if len(args) > 2 {
+		stream = args[2]
+	}
+	if len(args) > 3 {
+		expected = args[3]
+	}
+	if len(args) > 4 {
+		data = args[4:]
+	}
+	if ok, err := c.PublishBatch(stream, expected, data...); !ok || err != nil {
 		return err
 	}
 	fmt.Println("success")
@@ -125,23 +277,209 @@ func streamSubscribe(c *client.Context, args []string) error {
 }
 
 func subscribeAll(c *client.Context, args []string) error {
-	var offset string
+	var position string
+	var filter client.Filter
 	if len(args) > 2 {
-		offset = args[2]
+		position = args[2]
+	}
+	if len(args) > 3 {
+		filter.Types = strings.Split(args[3], ",")
 	}
 	inc := make(chan client.FullEvent, 10)
+	pings := make(chan string)
 	errc := make(chan error)
-	go c.SubscribeAll(inc, errc, offset)
+	go c.SubscribeAllFiltered(inc, pings, errc, position, filter)
 	for {
 		select {
 		case err := <-errc:
 			return err
 		case event := <-inc:
 			fmt.Printf("%s:%s:%d: %s\n", event.StreamID, event.EventID, event.Version, event.Data)
+		case position := <-pings:
+			fmt.Printf("checkpoint:%s\n", position)
 		}
 	}
 }
 
+func checkpoint(c *client.Context, args []string) error {
+	var sub, name, position string
+	if len(args) > 2 {
+		sub = args[2]
+	}
+	if len(args) > 3 {
+		name = args[3]
+	}
+	if len(args) > 4 {
+		position = args[4]
+	}
+	switch strings.ToLower(sub) {
+	case "set":
+		if ok, err := c.CheckpointSet(name, position); !ok || err != nil {
+			return err
+		}
+		fmt.Println("success")
+	case "get":
+		position, err := c.CheckpointGet(name)
+		if err != nil {
+			return err
+		}
+		fmt.Println(position)
+	default:
+		return errors.New("unknown checkpoint command")
+	}
+	return nil
+}
+
+func snapshot(c *client.Context, args []string) error {
+	var sub, stream, version, state string
+	if len(args) > 2 {
+		sub = args[2]
+	}
+	if len(args) > 3 {
+		stream = args[3]
+	}
+	if len(args) > 4 {
+		version = args[4]
+	}
+	if len(args) > 5 {
+		state = args[5]
+	}
+	switch strings.ToLower(sub) {
+	case "save":
+		v, err := strconv.Atoi(version)
+		if err != nil {
+			return errors.New("version must be an integer")
+		}
+		if ok, err := c.SnapshotSave(stream, v, state); !ok || err != nil {
+			return err
+		}
+		fmt.Println("success")
+	case "load":
+		s, err := c.SnapshotLoad(stream)
+		if err != nil {
+			return err
+		}
+		if s != nil {
+			fmt.Printf("%d: %s\n", s.Version, s.State)
+		}
+	default:
+		return errors.New("unknown snapshot command")
+	}
+	return nil
+}
+
+func projection(c *client.Context, args []string) error {
+	var sub, name, arg string
+	if len(args) > 2 {
+		sub = args[2]
+	}
+	if len(args) > 3 {
+		name = args[3]
+	}
+	if len(args) > 4 {
+		arg = args[4]
+	}
+	switch strings.ToLower(sub) {
+	case "create":
+		// the source is read from the file given
+		source, err := ioutil.ReadFile(arg)
+		if err != nil {
+			return err
+		}
+		if ok, err := c.ProjectionCreate(name, string(source)); !ok || err != nil {
+			return err
+		}
+		fmt.Println("success")
+	case "get":
+		state, err := c.ProjectionGet(name, arg)
+		if err != nil {
+			return err
+		}
+		fmt.Println(state)
+	case "delete":
+		if ok, err := c.ProjectionDelete(name); !ok || err != nil {
+			return err
+		}
+		fmt.Println("success")
+	case "list":
+		projections, err := c.ProjectionList()
+		if err != nil {
+			return err
+		}
+		for _, p := range projections {
+			if p.Error != "" {
+				fmt.Printf("%s %s faulted: %s\n", p.Name, p.Checkpoint, p.Error)
+				continue
+			}
+			fmt.Printf("%s %s\n", p.Name, p.Checkpoint)
+		}
+	default:
+		return errors.New("unknown projection command")
+	}
+	return nil
+}
+
+func groupCreate(c *client.Context, args []string) error {
+	var group, stream, position string
+	if len(args) > 2 {
+		group = args[2]
+	}
+	if len(args) > 3 {
+		stream = args[3]
+	}
+	if len(args) > 4 {
+		position = args[4]
+	}
+	if ok, err := c.GroupCreate(group, stream, position); !ok || err != nil {
+		return err
+	}
+	fmt.Println("success")
+	return nil
+}
+
+func groupRead(c *client.Context, args []string) error {
+	var group, consumer string
+	count := 1
+	if len(args) > 2 {
+		group = args[2]
+	}
+	if len(args) > 3 {
+		consumer = args[3]
+	}
+	if len(args) > 4 {
+		n, err := strconv.Atoi(args[4])
+		if err != nil {
+			return err
+		}
+		count = n
+	}
+	events, err := c.GroupRead(group, consumer, count, 0)
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		fmt.Printf("%s:%s:%d: %s (%d)\n", event.StreamID, event.EventID, event.Version, event.Data, event.Deliveries)
+	}
+	return nil
+}
+
+func groupAck(c *client.Context, args []string, ack func(group string, positions ...string) (int, error)) error {
+	var group string
+	var positions []string
+	if len(args) > 2 {
+		group = args[2]
+	}
+	if len(args) > 3 {
+		positions = args[3:]
+	}
+	n, err := ack(group, positions...)
+	if err != nil {
+		return err
+	}
+	fmt.Println(n)
+	return nil
+}
+
 func main() {
 	addr := flag.String("addr", ":6379", "host:port for resp api server")
 	flag.Parse()
@@ -164,20 +502,48 @@ func main() {
 	// stream
 	case aves.StreamDelete:
 		err = streamDelete(c, os.Args)
+	case aves.StreamUndelete:
+		err = streamUndelete(c, os.Args)
 	case aves.StreamExists:
 		err = streamExists(c, os.Args)
 	case aves.StreamList:
-		err = streamList(c)
+		err = streamList(c, os.Args)
+	case aves.StreamMeta:
+		err = streamMeta(c, os.Args)
 	// events
 	case aves.EventList:
 		err = eventList(c, os.Args)
+	case aves.EventLast:
+		err = eventLast(c, os.Args)
+	case aves.EventTimeRange:
+		err = eventRange(c, os.Args)
 	// pubsub
 	case aves.EventPublish:
 		err = eventPublish(c, os.Args)
+	case aves.EventPublishBatch:
+		err = eventPublishBatch(c, os.Args)
 	case aves.StreamSubscribe:
 		err = streamSubscribe(c, os.Args)
 	case aves.SubscribeAll:
 		err = subscribeAll(c, os.Args)
+	// consumer groups
+	case aves.GroupCreate:
+		err = groupCreate(c, os.Args)
+	case aves.GroupRead:
+		err = groupRead(c, os.Args)
+	case aves.GroupAck:
+		err = groupAck(c, os.Args, c.Ack)
+	case aves.GroupNack:
+		err = groupAck(c, os.Args, c.Nack)
+	// checkpoints
+	case aves.Checkpoint:
+		err = checkpoint(c, os.Args)
+	// snapshots
+	case aves.Snapshot:
+		err = snapshot(c, os.Args)
+	// projections
+	case aves.Projection:
+		err = projection(c, os.Args)
 	default:
 		err = errors.New("unknown command")
 	}
@@ -0,0 +1,132 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/dgraph-io/badger/v2"
+)
+
+// legacyDB - raw access to a database written with an older key layout
+type legacyDB interface {
+	// scan - iterates over all raw keys and values starting with the prefix
+	scan(prefix []byte, fn func(k, v []byte) error) error
+	// has - determines if the raw key exists
+	has(k []byte) (bool, error)
+	close()
+}
+
+func openLegacy(dbType, path string) (legacyDB, error) {
+	switch dbType {
+	case "badger":
+		// aves does not always close the database cleanly so it is opened
+		// writable to allow the value log to be replayed
+		bdb, err := badger.Open(badger.DefaultOptions(path).WithTruncate(true))
+		if err != nil {
+			return nil, err
+		}
+		return &legacyBadger{bdb}, nil
+	case "pebble":
+		c := *pebble.DefaultComparer
+		c.Name = "leveldb.BytewiseComparator"
+		c.Split = func(a []byte) int {
+			return len(a)
+		}
+
+		pdb, err := pebble.Open(path, &pebble.Options{Comparer: &c})
+		if err != nil {
+			return nil, err
+		}
+		return &legacyPebble{pdb}, nil
+	}
+	return nil, fmt.Errorf("unsupported database type %s", dbType)
+}
+
+type legacyBadger struct {
+	db *badger.DB
+}
+
+func (l *legacyBadger) scan(prefix []byte, fn func(k, v []byte) error) error {
+	return l.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			v, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if err := fn(item.KeyCopy(nil), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (l *legacyBadger) has(k []byte) (bool, error) {
+	err := l.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(k)
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (l *legacyBadger) close() {
+	l.db.Close()
+}
+
+type legacyPebble struct {
+	db *pebble.DB
+}
+
+func (l *legacyPebble) scan(prefix []byte, fn func(k, v []byte) error) error {
+	it := l.db.NewIter(&pebble.IterOptions{})
+	defer it.Close()
+
+	for it.SeekGE(prefix); it.Valid() && bytes.HasPrefix(it.Key(), prefix); it.Next() {
+		k := append([]byte{}, it.Key()...)
+		v := append([]byte{}, it.Value()...)
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *legacyPebble) has(k []byte) (bool, error) {
+	_, closer, err := l.db.Get(k)
+	if err == pebble.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	closer.Close()
+	return true, nil
+}
+
+func (l *legacyPebble) close() {
+	l.db.Close()
+}
@@ -0,0 +1,195 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/alash3al/go-color"
+	"github.com/maarek/aves/store"
+	"github.com/maarek/aves/store/badger"
+	"github.com/maarek/aves/store/pebble"
+	"github.com/oklog/ulid/v2"
+)
+
+// parseIndexV1 - parses t:<ulid>:<stream>:<version> where the version is an ascii integer,
+// returning the stream key the index entry points at
+func parseIndexV1(k []byte) (store.Key, []byte, error) {
+	if len(k) < 22 || k[18] != ':' {
+		return store.Key{}, nil, fmt.Errorf("unable to parse index key %v", k)
+	}
+
+	rest := k[19:]
+	split := bytes.LastIndexByte(rest, ':')
+	if split < 1 {
+		return store.Key{}, nil, fmt.Errorf("unable to parse index key %v", k)
+	}
+
+	// the first releases published the first event of a stream as version 0
+	version, err := strconv.ParseUint(string(rest[split+1:]), 10, 64)
+	if err != nil {
+		return store.Key{}, nil, fmt.Errorf("unsupported version %q in key %v", rest[split+1:], k)
+	}
+
+	var id ulid.ULID
+	copy(id[:], k[2:18])
+
+	key := store.Key{
+		ID:      id,
+		Stream:  store.StreamID(append([]byte{}, rest[:split]...)),
+		Version: version,
+	}
+
+	return key, append([]byte{'s', ':'}, rest...), nil
+}
+
+// zeroBased - finds the streams holding an event at version 0, which versions start at 1 now
+func zeroBased(src legacyDB) (map[string]bool, error) {
+	streams := make(map[string]bool)
+
+	err := src.scan([]byte{'t', ':'}, func(k, _ []byte) error {
+		key, _, err := parseIndexV1(k)
+		if err != nil {
+			return err
+		}
+		if key.Version == 0 {
+			streams[string(key.Stream)] = true
+		}
+		return nil
+	})
+
+	return streams, err
+}
+
+// migrate - copies every event that still exists in the legacy database into the new one,
+// in time index order and keeping the original event ids, and writes the links of each event
+// given by the linker as an append would. The versions of the streams starting at version 0
+// are shifted up by one, the number of those streams is returned along with the number of
+// events migrated.
+func migrate(src legacyDB, dst store.DB, linker store.Linker) (int, int, error) {
+	shifted, err := zeroBased(src)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	migrated := 0
+	links := store.NewLinks(linker, dst.Head)
+
+	err = src.scan([]byte{'t', ':'}, func(k, v []byte) error {
+		key, streamKey, err := parseIndexV1(k)
+		if err != nil {
+			return err
+		}
+
+		// index entries of deleted streams are left behind by older versions
+		exists, err := src.has(streamKey)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return nil
+		}
+
+		if shifted[string(key.Stream)] {
+			key.Version++
+		}
+
+		// legacy values hold the data of the event alone
+		value := store.EncodeEvent(store.Event{Data: string(v)})
+		if err := dst.Set(key, value); err != nil {
+			return err
+		}
+
+		linked, err := links.Next(key, value)
+		if err != nil {
+			return err
+		}
+		for _, link := range linked {
+			if err := dst.Set(link, store.EncodeLink(key)); err != nil {
+				return err
+			}
+		}
+
+		migrated++
+		return nil
+	})
+
+	return migrated, len(shifted), err
+}
+
+func openDB(dbType, path string) (store.DB, error) {
+	switch dbType {
+	case "badger":
+		return badger.OpenDB(path)
+	case "pebble":
+		return pebble.OpenDB(path)
+	}
+	return nil, fmt.Errorf("unsupported database type %s", dbType)
+}
+
+func run(dbType, in, out string, systemLinks bool) error {
+	src, err := openLegacy(dbType, in)
+	if err != nil {
+		return err
+	}
+	defer src.close()
+
+	dst, err := openDB(dbType, out)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	var linker store.Linker
+	if systemLinks {
+		linker = store.SystemLinks
+	}
+
+	migrated, shifted, err := migrate(src, dst, linker)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("migrated %d events from %s to %s\n", migrated, in, out)
+	if shifted > 0 {
+		fmt.Printf("shifted the versions of %d streams starting at version 0 up by one\n", shifted)
+	}
+	return nil
+}
+
+func main() {
+	dbType := flag.String("type", "badger", "type of datastore (badger,pebble)")
+	in := flag.String("in", "", "location of the database files to migrate")
+	out := flag.String("out", "", "location of the migrated database files")
+	systemLinks := flag.Bool("system-links", true, "link the migrated events to the $ce-<category> streams")
+
+	flag.Parse()
+
+	if *in == "" || *out == "" {
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if err := run(*dbType, *in, *out, *systemLinks); err != nil {
+		color.Red(err.Error())
+		os.Exit(1)
+	}
+}
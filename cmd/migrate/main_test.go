@@ -0,0 +1,182 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maarek/aves/store"
+	"github.com/oklog/ulid/v2"
+)
+
+// legacyEvent - an event in the layout of the releases storing versions as text
+type legacyEvent struct {
+	stream  string
+	version int
+	data    string
+	deleted bool
+}
+
+// writeLegacy - writes the index and stream keys of the events in the order given
+func writeLegacy(t *testing.T, dbType, path string, events []legacyEvent) []ulid.ULID {
+	t.Helper()
+
+	src, err := openLegacy(dbType, path)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	defer src.close()
+
+	var set func(k, v []byte) error
+	switch l := src.(type) {
+	case *legacyBadger:
+		set = func(k, v []byte) error {
+			txn := l.db.NewTransaction(true)
+			defer txn.Discard()
+			if err := txn.Set(k, v); err != nil {
+				return err
+			}
+			return txn.Commit()
+		}
+	case *legacyPebble:
+		set = func(k, v []byte) error {
+			return l.db.Set(k, v, nil)
+		}
+	}
+
+	ids := make([]ulid.ULID, len(events))
+	for i, e := range events {
+		ids[i] = store.GenUlid()
+		rest := fmt.Sprintf("%s:%d", e.stream, e.version)
+
+		index := append([]byte{'t', ':'}, ids[i][:]...)
+		index = append(append(index, ':'), rest...)
+		if err := set(index, []byte(e.data)); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		if e.deleted {
+			continue
+		}
+		if err := set([]byte("s:"+rest), []byte(e.data)); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	return ids
+}
+
+func TestMigrate(t *testing.T) {
+	for _, dbType := range []string{"badger", "pebble"} {
+		t.Run(dbType, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "avmigrate")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			in, out := filepath.Join(dir, "in"), filepath.Join(dir, "out")
+			ids := writeLegacy(t, dbType, in, []legacyEvent{
+				{stream: "order-1", version: 0, data: "placed"},
+				{stream: "order-2", version: 1, data: "placed"},
+				{stream: "cart-1", version: 1, data: "gone", deleted: true},
+				{stream: "order-1", version: 1, data: "shipped"},
+				{stream: "single", version: 1, data: "alone"},
+			})
+
+			if err := run(dbType, in, out, true); err != nil {
+				t.Fatalf("migrate failed: %v", err)
+			}
+
+			dst, err := openDB(dbType, out)
+			if err != nil {
+				t.Fatalf("open failed: %v", err)
+			}
+			defer dst.Close()
+
+			for _, tt := range []struct {
+				key  store.Key
+				data string
+			}{
+				{store.Key{Stream: store.StreamID("order-1"), Version: 1}, "placed"},
+				{store.Key{Stream: store.StreamID("order-1"), Version: 2}, "shipped"},
+				{store.Key{Stream: store.StreamID("order-2"), Version: 1}, "placed"},
+				{store.Key{Stream: store.StreamID("single"), Version: 1}, "alone"},
+			} {
+				v, err := dst.Get(tt.key)
+				if err != nil {
+					t.Fatalf("expected %s:%d to be migrated, got %v", tt.key.Stream, tt.key.Version, err)
+				}
+				if e, err := store.DecodeEvent(v); err != nil || e.Data != tt.data {
+					t.Fatalf("expected %s:%d to hold %s, got %+v %v", tt.key.Stream, tt.key.Version, tt.data, e, err)
+				}
+			}
+			if head, err := dst.Head(store.StreamID("cart-1")); err != nil || head != 0 {
+				t.Fatalf("expected the deleted stream not to be migrated, got head %d %v", head, err)
+			}
+
+			// the category stream links the events in the order they were published
+			var linked []string
+			err = dst.Scan(store.ScannerOptions{
+				Prefix:        []byte("$ce-order"),
+				IncludeOffset: true,
+				FetchValues:   true,
+				Handler: func(k store.Key, v string) bool {
+					e, _ := store.DecodeEvent(v)
+					target, _, err := store.ResolveLink(dst, k, e)
+					if err != nil {
+						t.Fatalf("unable to resolve link %d: %v", k.Version, err)
+					}
+					linked = append(linked, fmt.Sprintf("%d:%d@%s", k.Version, target.Version, target.Stream))
+					return true
+				},
+			})
+			if err != nil {
+				t.Fatalf("scan failed: %v", err)
+			}
+			if got := fmt.Sprint(linked); got != "[1:1@order-1 2:1@order-2 3:2@order-1]" {
+				t.Fatalf("unexpected links %s", got)
+			}
+
+			info, err := store.LoadStreamInfo(dst, store.StreamID("$ce-order"))
+			if err != nil || info.Count != 3 || info.Head != 3 {
+				t.Fatalf("unexpected catalog entry %+v %v", info, err)
+			}
+
+			// the links share the global position of their event
+			var positions []ulid.ULID
+			err = dst.Scan(store.ScannerOptions{
+				Index:         true,
+				IncludeOffset: true,
+				Handler: func(k store.Key, _ string) bool {
+					if string(k.Stream) == "$ce-order" {
+						positions = append(positions, k.ID)
+					}
+					return true
+				},
+			})
+			if err != nil {
+				t.Fatalf("scan failed: %v", err)
+			}
+			if len(positions) != 3 || positions[0] != ids[0] || positions[1] != ids[1] || positions[2] != ids[3] {
+				t.Fatalf("unexpected link positions %v", positions)
+			}
+		})
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"runtime"
 
 	"github.com/alash3al/go-color"
+	"github.com/maarek/aves/oplog"
 	su "github.com/maarek/aves/server"
 	_ "go.uber.org/automaxprocs/maxprocs"
 )
@@ -36,20 +37,32 @@ func Ballast(size int) func() {
 func main() {
 	port := flag.Int("port", 6379, "port for resp api server")
 
-	dbType := flag.String("type", "badger", "type of datastore (badger,bolt,pebble)")
-	out := flag.String("out", "", "location of the database files")
+	dbType := flag.String("type", "badger", "type of datastore (badger,bolt,memory,pebble)")
+	out := flag.String("out", "", "location of the database files, unused by memory")
 
 	verbose := flag.Bool("verbose", false, "log level verbose")
 
+	buffer := flag.Int("buffer", oplog.DefaultOptions.Buffer, "events buffered for each subscriber")
+	slow := flag.String("slow", oplog.DefaultOptions.Policy.String(), "policy for subscribers with a full buffer (catchup,disconnect,block)")
+
+	scavenge := flag.Duration("scavenge", su.DefaultScavengeInterval, "how often events hidden by stream metadata are deleted, 0 to disable")
+	systemLinks := flag.Bool("system-links", true, "link events to the $ce-<category> and $et-<type> streams")
+
 	ballast := flag.Int("ballast", 2560, "ballast in MBs")
 
 	flag.Parse()
 
-	if *out == "" {
+	if *out == "" && *dbType != "memory" {
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
+	policy, perr := oplog.ParsePolicy(*slow)
+	if perr != nil {
+		color.Red(perr.Error())
+		os.Exit(1)
+	}
+
 	// Create a large heap allocation of nGiB
 	// https://blog.twitch.tv/go-memory-ballast-how-i-learnt-to-stop-worrying-and-love-the-heap-26c2462549a2
 	defer Ballast(*ballast << 20)()
@@ -62,7 +75,11 @@ func main() {
 	err := make(chan error)
 
 	go (func() {
-		err <- su.NewRespServer(fmt.Sprintf(":%d", *port), *dbType, *out, *verbose).Start()
+		err <- su.NewRespServer(fmt.Sprintf(":%d", *port), *dbType, *out, *verbose).
+			WithOplog(oplog.Options{Buffer: *buffer, Policy: policy}).
+			WithScavenger(*scavenge).
+			WithSystemLinks(*systemLinks).
+			Start()
 	})()
 
 	go func() {
@@ -18,8 +18,12 @@ package aves
 
 import (
 	cmds "github.com/maarek/aves/commands"
+	"github.com/maarek/aves/commands/checkpoint"
 	"github.com/maarek/aves/commands/events"
+	"github.com/maarek/aves/commands/group"
+	"github.com/maarek/aves/commands/projection"
 	"github.com/maarek/aves/commands/pubsub"
+	"github.com/maarek/aves/commands/snapshot"
 	"github.com/maarek/aves/commands/stream"
 )
 
@@ -29,36 +33,84 @@ type Command string
 const (
 	// StreamDelete - redis delete command
 	StreamDelete Command = "delete"
+	// StreamUndelete - restores a soft deleted stream command
+	StreamUndelete Command = "undelete"
 	// StreamExists - redis exists command
 	StreamExists Command = "exists"
 	// StreamList - redis list command
 	StreamList Command = "slist"
+	// StreamMeta - stream metadata command
+	StreamMeta Command = "smeta"
 
 	// EventList - redis event list command
 	EventList Command = "elist"
+	// EventLast - head event of a stream command
+	EventLast Command = "elast"
+	// EventTimeRange - events committed within a time range command
+	EventTimeRange Command = "erange"
 
 	// EventPublish - redis event publish command
 	EventPublish Command = "publish"
+	// EventPublishBatch - redis event batch publish command
+	EventPublishBatch Command = "publishbatch"
 	// StreamSubscribe - redis stream subscription command
 	StreamSubscribe Command = "subscribe"
 	// SubscribeAll - redis all event subscription command
 	SubscribeAll Command = "subscribeall"
+
+	// GroupCreate - consumer group create command
+	GroupCreate Command = "groupcreate"
+	// GroupRead - consumer group read command
+	GroupRead Command = "groupread"
+	// GroupAck - consumer group acknowledge command
+	GroupAck Command = "ack"
+	// GroupNack - consumer group negative acknowledge command
+	GroupNack Command = "nack"
+
+	// Checkpoint - saved subscriber position command
+	Checkpoint Command = "checkpoint"
+
+	// Snapshot - aggregate snapshot command
+	Snapshot Command = "snapshot"
+
+	// Projection - user defined projection command
+	Projection Command = "projection"
 )
 
 var (
 	// Commands - server receive handlers
 	Commands = map[Command]cmds.ReceiveHandler{
 		// stream
-		StreamDelete: stream.DeleteCommand,
-		StreamExists: stream.ExistsCommand,
-		StreamList:   stream.ListCommand,
+		StreamDelete:   stream.DeleteCommand,
+		StreamUndelete: stream.UndeleteCommand,
+		StreamExists:   stream.ExistsCommand,
+		StreamList:     stream.ListCommand,
+		StreamMeta:     stream.MetaCommand,
 
 		// events
-		EventList: events.RangeCommand,
+		EventList:      events.RangeCommand,
+		EventLast:      events.LastCommand,
+		EventTimeRange: events.TimeRangeCommand,
 
 		// pubsub
-		EventPublish:    pubsub.PublishCommand,
-		StreamSubscribe: pubsub.SubscribeCommand,
-		SubscribeAll:    pubsub.SubscribeAllCommand,
+		EventPublish:      pubsub.PublishCommand,
+		EventPublishBatch: pubsub.PublishBatchCommand,
+		StreamSubscribe:   pubsub.SubscribeCommand,
+		SubscribeAll:      pubsub.SubscribeAllCommand,
+
+		// consumer groups
+		GroupCreate: group.CreateCommand,
+		GroupRead:   group.ReadCommand,
+		GroupAck:    group.AckCommand,
+		GroupNack:   group.NackCommand,
+
+		// checkpoints
+		Checkpoint: checkpoint.CheckpointCommand,
+
+		// snapshots
+		Snapshot: snapshot.SnapshotCommand,
+
+		// projections
+		Projection: projection.ProjectionCommand,
 	}
 )
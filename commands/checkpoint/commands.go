@@ -0,0 +1,94 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package checkpoint
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	cmds "github.com/maarek/aves/commands"
+	"github.com/maarek/aves/store"
+	"github.com/oklog/ulid/v2"
+)
+
+// CheckpointCommand - CHECKPOINT SET <name> <position> | CHECKPOINT GET <name>
+func CheckpointCommand(c *cmds.Context) {
+	if len(c.Args) < 2 {
+		c.WriteError("CHECKPOINT command must have at least 2 arguments: CHECKPOINT SET <name> <position> | CHECKPOINT GET <name>")
+		return
+	}
+
+	name := string(c.Args[1])
+
+	switch strings.ToUpper(string(c.Args[0])) {
+	case "SET":
+		if len(c.Args) != 3 {
+			c.WriteError("CHECKPOINT SET must have 2 arguments: CHECKPOINT SET <name> <position>")
+			return
+		}
+
+		position := string(c.Args[2])
+		if !valid(position) {
+			c.WriteError("CHECKPOINT position must be the ulid of an event or a version")
+			return
+		}
+
+		if err := c.DB.SetMeta(store.CheckpointNamespace, name, position); err != nil {
+			c.WriteError(err.Error())
+			return
+		}
+
+		c.WriteString("OK")
+	case "GET":
+		position, err := Load(c.DB, name)
+		if err != nil {
+			c.WriteError(err.Error())
+			return
+		}
+		if position == nil {
+			c.WriteNull()
+			return
+		}
+
+		c.WriteBulk(position)
+	default:
+		c.WriteError("CHECKPOINT subcommand must be one of SET, GET")
+	}
+}
+
+// Load - loads the position saved as the checkpoint, nil when it was never saved
+func Load(db store.DB, name string) ([]byte, error) {
+	position, err := db.GetMeta(store.CheckpointNamespace, name)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(position), nil
+}
+
+// valid - a checkpoint is either the global position of an event or the version of a stream
+func valid(position string) bool {
+	if _, err := ulid.ParseStrict(position); err == nil {
+		return true
+	}
+	_, err := strconv.ParseUint(position, 10, 64)
+	return err == nil
+}
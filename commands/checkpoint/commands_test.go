@@ -0,0 +1,138 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package checkpoint_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/maarek/aves/client"
+	"github.com/maarek/aves/server/servertest"
+	"github.com/maarek/aves/store"
+)
+
+func TestCheckpoint(t *testing.T) {
+	c := servertest.Client(t)
+	name := servertest.Name()
+
+	if position, err := c.CheckpointGet(name); err != nil || position != "" {
+		t.Fatalf("expected no checkpoint, got %q %v", position, err)
+	}
+
+	id := store.GenUlid().String()
+	for _, position := range []string{"12", id} {
+		if ok, err := c.CheckpointSet(name, position); !ok || err != nil {
+			t.Fatalf("expected %s to be saved, got %v", position, err)
+		}
+		if got, err := c.CheckpointGet(name); err != nil || got != position {
+			t.Fatalf("expected %s, got %q %v", position, got, err)
+		}
+	}
+
+	for _, bad := range []string{"", "-1", "x", strings.ToLower(id) + "0"} {
+		if ok, err := c.CheckpointSet(name, bad); ok || err == nil {
+			t.Fatalf("expected %q to be rejected", bad)
+		}
+	}
+	if got, err := c.CheckpointGet(name); err != nil || got != id {
+		t.Fatalf("expected the checkpoint to be kept, got %q %v", got, err)
+	}
+
+	conn := servertest.Dial(t)
+	for _, args := range [][]interface{}{
+		{"SET", name},
+		{"SET", name, "1", "2"},
+		{"GET"},
+		{"DEL", name},
+	} {
+		if _, err := conn.Do("CHECKPOINT", args...); err == nil {
+			t.Fatalf("expected CHECKPOINT %v to be rejected", args)
+		}
+	}
+}
+
+// next - the next event pushed to the subscriber
+func next(t *testing.T, inc <-chan client.FullEvent, errc <-chan error) client.FullEvent {
+	t.Helper()
+
+	select {
+	case e := <-inc:
+		return e
+	case err := <-errc:
+		t.Fatalf("subscription failed: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected an event")
+	}
+	return client.FullEvent{}
+}
+
+func TestSubscribeFromCheckpoint(t *testing.T) {
+	c := servertest.Client(t)
+	stream := servertest.Name()
+
+	for _, data := range []string{"1", "2", "3"} {
+		if _, err := c.Publish(stream, "ANY", data); err != nil {
+			t.Fatalf("publish failed: %v", err)
+		}
+	}
+	events, err := c.EList(stream, "0", "")
+	if err != nil || len(events) != 3 {
+		t.Fatalf("expected 3 events, got %d %v", len(events), err)
+	}
+
+	// a stream subscription resumes after the version saved
+	if _, err := c.CheckpointSet(stream+"-version", "2"); err != nil {
+		t.Fatalf("checkpoint failed: %v", err)
+	}
+	inc, errc := make(chan client.FullEvent, 8), make(chan error, 1)
+	go servertest.Client(t).SubscribeFrom(inc, errc, stream, stream+"-version")
+	if e := next(t, inc, errc); e.Version != 3 {
+		t.Fatalf("expected version 3, got %d", e.Version)
+	}
+
+	// a checkpoint never saved subscribes from the first event
+	inc, errc = make(chan client.FullEvent, 8), make(chan error, 1)
+	go servertest.Client(t).SubscribeFrom(inc, errc, stream, stream+"-unknown")
+	if e := next(t, inc, errc); e.Version != 1 {
+		t.Fatalf("expected version 1, got %d", e.Version)
+	}
+
+	// a subscription to every stream resumes after the position saved
+	inc, errc = make(chan client.FullEvent, 8), make(chan error, 1)
+	go servertest.Client(t).SubscribeAll(inc, errc, "")
+	var position string
+	for position == "" {
+		if e := next(t, inc, errc); e.StreamID == stream && e.Version == 2 {
+			position = e.EventID
+		}
+	}
+	if _, err := c.CheckpointSet(stream+"-position", position); err != nil {
+		t.Fatalf("checkpoint failed: %v", err)
+	}
+
+	inc, errc = make(chan client.FullEvent, 8), make(chan error, 1)
+	go servertest.Client(t).SubscribeAllFrom(inc, errc, stream+"-position")
+	if e := next(t, inc, errc); e.StreamID != stream || e.Version != 3 {
+		t.Fatalf("expected version 3 of %s, got %d of %s", stream, e.Version, e.StreamID)
+	}
+
+	if _, err := redis.Values(servertest.Dial(t).Do("SUBSCRIBE", stream, "FROM", "CHECKPOINT")); err == nil {
+		t.Fatal("expected SUBSCRIBE FROM CHECKPOINT without a name to be rejected")
+	}
+}
@@ -17,7 +17,9 @@
 package commands
 
 import (
+	"github.com/maarek/aves/consumer"
 	"github.com/maarek/aves/oplog"
+	"github.com/maarek/aves/projection"
 	"github.com/maarek/aves/store"
 	"github.com/tidwall/redcon"
 )
@@ -31,5 +33,10 @@ type Context struct {
 	DB     store.DB
 	Action string
 	Args   [][]byte
-	OpLog  oplog.Broadcaster
+	OpLog  *oplog.Topics
+	Groups *consumer.Registry
+	// Links - the link streams published events are linked to, none when nil
+	Links store.Linker
+	// Projections - the user defined projections of the db
+	Projections *projection.Registry
 }
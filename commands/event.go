@@ -0,0 +1,45 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package commands
+
+import (
+	"github.com/maarek/aves/store"
+	"github.com/tidwall/redcon"
+)
+
+// EnvelopeFields - the number of envelope fields following the data of an event in replies:
+// type, content type, correlation id, causation id and metadata
+const EnvelopeFields = 5
+
+// WriteEnvelope - writes the envelope fields of the event
+func WriteEnvelope(conn redcon.Conn, e store.Event) {
+	conn.WriteBulkString(e.Type)
+	conn.WriteBulkString(e.ContentType)
+	conn.WriteBulkString(e.CorrelationID)
+	conn.WriteBulkString(e.CausationID)
+	conn.WriteBulkString(e.Metadata)
+}
+
+// AppendEnvelope - appends the envelope fields of the event
+func AppendEnvelope(d []byte, e store.Event) []byte {
+	d = redcon.AppendBulkString(d, e.Type)
+	d = redcon.AppendBulkString(d, e.ContentType)
+	d = redcon.AppendBulkString(d, e.CorrelationID)
+	d = redcon.AppendBulkString(d, e.CausationID)
+	d = redcon.AppendBulkString(d, e.Metadata)
+	return d
+}
@@ -17,53 +17,231 @@
 package events
 
 import (
+	"errors"
 	"strconv"
+	"strings"
+	"time"
 
 	cmds "github.com/maarek/aves/commands"
 	"github.com/maarek/aves/store"
+	"github.com/maarek/aves/streammeta"
+	"github.com/oklog/ulid/v2"
 )
 
-// RangeCommand - ELIST <stream> [<offset> <size>]
+// RangeCommand - ELIST <stream> [<offset> <size>] | ELIST <stream> BACKWARD [<from>] [<count>]
 func RangeCommand(c *cmds.Context) {
 	var offset []byte
 	var limit int
 
 	if len(c.Args) < 1 {
-		c.WriteError("ELIST must has at least 1 argument, ELIST <STREAM> [<offset> <size>]")
+		c.WriteError("ELIST must has at least 1 argument, ELIST <STREAM> [<offset> <size>] | ELIST <STREAM> BACKWARD [<from>] [<count>]")
 		return
 	}
 
 	prefix := c.Args[0]
+	args := c.Args[1:]
 
-	if len(c.Args) > 1 {
-		offset = c.Args[1]
+	// backward reads start at the version given, or at the head, and go down to the first event
+	backward := len(args) > 0 && strings.ToUpper(string(args[0])) == "BACKWARD"
+	if backward {
+		args = args[1:]
 	}
-	if len(c.Args) > 2 {
-		limit, _ = strconv.Atoi(string(c.Args[2])) // TODO: Optimize?
+
+	if len(args) > 0 && len(args[0]) > 0 {
+		version, err := strconv.ParseUint(string(args[0]), 10, 64)
+		if err != nil {
+			c.WriteError("ELIST offset must be an integer version")
+			return
+		}
+		offset = store.EncodeVersion(version)
+	}
+	if len(args) > 1 {
+		limit, _ = strconv.Atoi(string(args[1])) // TODO: Optimize?
 	}
 
 	includeOffsetVals := false
-	if len(offset) == 0 {
+	if len(offset) == 0 || backward {
 		includeOffsetVals = true
 	}
 
-	data := []string{}
-	loaded := 0
-	err := c.DB.Scan(store.ScannerOptions{
+	data, err := read(c, store.ScannerOptions{
 		IncludeOffset: includeOffsetVals,
 		Offset:        offset,
 		Prefix:        prefix,
+		Reverse:       backward,
+	}, limit)
+	if err != nil {
+		c.WriteError(err.Error())
+		return
+	}
+
+	if len(data) == 0 {
+		c.WriteNull()
+		return
+	}
+
+	// the version and data of each event followed by its envelope
+	c.WriteArray(len(data) * (2 + cmds.EnvelopeFields))
+	for _, e := range data {
+		writeEvent(c, e)
+	}
+}
+
+// LastCommand - ELAST <stream>
+func LastCommand(c *cmds.Context) {
+	if len(c.Args) != 1 {
+		c.WriteError("ELAST must have 1 argument, ELAST <STREAM>")
+		return
+	}
+
+	// the head is the first event of a backward read that is not hidden
+	data, err := read(c, store.ScannerOptions{
+		IncludeOffset: true,
+		Prefix:        c.Args[0],
+		Reverse:       true,
+	}, 1)
+	if err != nil {
+		c.WriteError(err.Error())
+		return
+	}
+
+	if len(data) == 0 {
+		c.WriteNull()
+		return
+	}
+
+	c.WriteArray(2 + cmds.EnvelopeFields)
+	writeEvent(c, data[0])
+}
+
+// TimeRangeCommand - ERANGE <from-time> <to-time> [STREAM <prefix>] [COUNT <count>]
+// Replies with the events committed from the first time up to but not including the second,
+// in the order they were committed. The times are unix times in milliseconds or RFC 3339.
+func TimeRangeCommand(c *cmds.Context) {
+	if len(c.Args) < 2 {
+		c.WriteError("ERANGE must have at least 2 arguments, ERANGE <from-time> <to-time> [STREAM <prefix>] [COUNT <count>]")
+		return
+	}
+
+	from, err := parseTime(string(c.Args[0]))
+	if err != nil {
+		c.WriteError("ERANGE from-time " + err.Error())
+		return
+	}
+	to, err := parseTime(string(c.Args[1]))
+	if err != nil {
+		c.WriteError("ERANGE to-time " + err.Error())
+		return
+	}
+	if to < from {
+		c.WriteError("ERANGE to-time must not be before from-time")
+		return
+	}
+
+	var prefix string
+	var limit int
+	args := c.Args[2:]
+	for i := 0; i < len(args); i += 2 {
+		option := strings.ToUpper(string(args[i]))
+		if i+1 == len(args) {
+			c.WriteError("ERANGE option " + option + " must have a value")
+			return
+		}
+
+		switch option {
+		case "STREAM":
+			prefix = string(args[i+1])
+		case "COUNT":
+			n, err := strconv.Atoi(string(args[i+1]))
+			if err != nil || n <= 0 {
+				c.WriteError("ERANGE COUNT must be a positive integer")
+				return
+			}
+			limit = n
+		default:
+			c.WriteError("ERANGE option must be one of STREAM, COUNT")
+			return
+		}
+	}
+
+	// the lowest position of the first millisecond, every position committed in it sorts after
+	var start ulid.ULID
+	if err := start.SetTime(from); err != nil {
+		c.WriteError("ERANGE from-time " + err.Error())
+		return
+	}
+
+	filter := streammeta.NewFilter(c.DB)
+
+	// the events read through links at the current position, an event linked to from
+	// several link streams is read once
+	var position ulid.ULID
+	resolved := make(map[string]bool)
+
+	var handlerErr error
+	data := []indexEvent{}
+	err = c.DB.Scan(store.ScannerOptions{
+		Offset:        start[:],
+		IncludeOffset: true,
 		FetchValues:   true,
+		Index:         true,
 		Handler: func(k store.Key, v string) bool {
-			if limit > 0 && (loaded >= limit) {
+			if k.ID.Time() >= to || (limit > 0 && len(data) >= limit) {
+				return false
+			}
+			if !strings.HasPrefix(string(k.Stream), prefix) {
+				return true
+			}
+			visible, err := filter.Visible(k)
+			if err != nil {
+				handlerErr = err
 				return false
 			}
-			data = append(data, string(k.Version), v)
-			loaded++
+			if !visible {
+				return true
+			}
+			e, err := store.DecodeEvent(v)
+			if err != nil {
+				handlerErr = err
+				return false
+			}
+			// a link is committed along with the event it links to, which is read instead
+			// when its stream starts with the prefix as well
+			if e.Type == store.LinkEventType {
+				target, err := store.ParseLink(e.Data)
+				if err != nil {
+					handlerErr = err
+					return false
+				}
+				if strings.HasPrefix(string(target.Stream), prefix) {
+					return true
+				}
+
+				if k.ID != position {
+					position = k.ID
+					resolved = make(map[string]bool)
+				}
+				if resolved[string(target.Stream)] {
+					return true
+				}
+				resolved[string(target.Stream)] = true
+
+				var ok bool
+				if k, e, ok, err = filter.Resolve(k, e); err != nil {
+					handlerErr = err
+					return false
+				}
+				if !ok {
+					return true
+				}
+			}
+			data = append(data, indexEvent{key: k, event: e})
 			return true
 		},
 	})
-
+	if err == nil {
+		err = handlerErr
+	}
 	if err != nil {
 		c.WriteError(err.Error())
 		return
@@ -74,16 +252,90 @@ func RangeCommand(c *cmds.Context) {
 		return
 	}
 
-	c.WriteArray(len(data))
-	for k, v := range data {
-		if k%2 == 0 {
-			ver, err := strconv.Atoi(v)
-			if err != nil {
-				c.WriteNull()
-			}
-			c.WriteInt(ver)
-		} else {
-			c.WriteBulkString(v)
+	// the stream, position, version and data of each event followed by its envelope
+	c.WriteArray(len(data) * (4 + cmds.EnvelopeFields))
+	for _, e := range data {
+		c.WriteBulk(e.key.Stream)
+		c.WriteBulkString(e.key.ID.String())
+		c.WriteInt64(int64(e.key.Version))
+		c.WriteBulkString(e.event.Data)
+		cmds.WriteEnvelope(c, e.event)
+	}
+}
+
+// parseTime - parses a unix time in milliseconds or an RFC 3339 time into unix milliseconds
+func parseTime(arg string) (uint64, error) {
+	if ms, err := strconv.ParseUint(arg, 10, 64); err == nil {
+		return ms, nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, arg)
+	if err != nil || t.Before(time.Unix(0, 0)) {
+		return 0, errors.New("must be a unix time in milliseconds or an RFC 3339 time")
+	}
+	return ulid.Timestamp(t), nil
+}
+
+// read - reads up to limit events of a stream, every event when the limit is 0. The events
+// outside of the bounds of the stream metadata are skipped and links are resolved.
+func read(c *cmds.Context, opts store.ScannerOptions, limit int) ([]event, error) {
+	filter := streammeta.NewFilter(c.DB)
+
+	var handlerErr error
+	data := []event{}
+	opts.FetchValues = true
+	opts.Handler = func(k store.Key, v string) bool {
+		if limit > 0 && (len(data) >= limit) {
+			return false
+		}
+		visible, err := filter.Visible(k)
+		if err != nil {
+			handlerErr = err
+			return false
+		}
+		if !visible {
+			return true
+		}
+		e, err := store.DecodeEvent(v)
+		if err != nil {
+			handlerErr = err
+			return false
 		}
+		// the events of link streams are read as the events they link to
+		_, e, visible, err = filter.Resolve(k, e)
+		if err != nil {
+			handlerErr = err
+			return false
+		}
+		if visible {
+			data = append(data, event{version: k.Version, event: e})
+		}
+		return true
+	}
+
+	err := c.DB.Scan(opts)
+	if err == nil {
+		err = handlerErr
 	}
+
+	return data, err
+}
+
+// writeEvent - writes the version and data of an event followed by its envelope
+func writeEvent(c *cmds.Context, e event) {
+	c.WriteInt64(int64(e.version))
+	c.WriteBulkString(e.event.Data)
+	cmds.WriteEnvelope(c, e.event)
+}
+
+// event - an event read from a stream
+type event struct {
+	version uint64
+	event   store.Event
+}
+
+// indexEvent - an event read from the time series index
+type indexEvent struct {
+	key   store.Key
+	event store.Event
 }
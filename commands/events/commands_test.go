@@ -0,0 +1,128 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package events_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/maarek/aves/client"
+	"github.com/maarek/aves/server/servertest"
+)
+
+// streams - the stream and version of each event
+func streams(events []client.FullEvent) string {
+	s := make([]string, len(events))
+	for i, e := range events {
+		s[i] = fmt.Sprintf("%s@%d", e.StreamID, e.Version)
+	}
+	return fmt.Sprint(s)
+}
+
+func TestTimeRange(t *testing.T) {
+	// the events of this server are the only ones in the window, its link streams included
+	addr := servertest.Start(t)
+	c := servertest.ClientAddr(t, addr)
+	a, b := "order-a", "order-b"
+
+	from := time.Now()
+	for _, e := range []struct{ stream, typ string }{{a, "Placed"}, {b, "Placed"}, {a, "Shipped"}} {
+		if _, err := c.PublishEvent(e.stream, "ANY", "{}", client.Envelope{Type: e.typ}); err != nil {
+			t.Fatalf("publish failed: %v", err)
+		}
+	}
+	to := time.Now().Add(time.Millisecond)
+
+	for _, tc := range []struct {
+		prefix string
+		count  int
+		want   string
+	}{
+		// every event once, whether read from its stream or through the links to it
+		{"", 0, "[order-a@1 order-b@1 order-a@2]"},
+		{"order-a", 0, "[order-a@1 order-a@2]"},
+		// a prefix matching only a link stream reads the events it links to
+		{"$ce-order", 0, "[order-a@1 order-b@1 order-a@2]"},
+		{"$et-Shipped", 0, "[order-a@2]"},
+		// an event reached through several link streams is read once
+		{"$", 0, "[order-a@1 order-b@1 order-a@2]"},
+		{"", 2, "[order-a@1 order-b@1]"},
+		{"$", 1, "[order-a@1]"},
+		{"invoice", 0, "[]"},
+	} {
+		events, err := c.ERange(from, to, tc.prefix, tc.count)
+		if err != nil || streams(events) != tc.want {
+			t.Fatalf("expected %q COUNT %d to read %s, got %s %v", tc.prefix, tc.count, tc.want, streams(events), err)
+		}
+	}
+
+	// a link to an event soft deleted is skipped
+	if ok, err := c.Delete(a); !ok || err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if events, err := c.ERange(from, to, "$ce-order", 0); err != nil || streams(events) != "[order-b@1]" {
+		t.Fatalf("expected only order-b@1, got %s %v", streams(events), err)
+	}
+
+	// the window ends before the second time
+	if events, err := c.ERange(from.Add(-time.Hour), from.Add(-time.Minute), "", 0); err != nil || len(events) != 0 {
+		t.Fatalf("expected no event before the window, got %s %v", streams(events), err)
+	}
+}
+
+func TestTimeRangeFormats(t *testing.T) {
+	c := servertest.Client(t)
+	stream := servertest.Name()
+
+	from := time.Now()
+	if _, err := c.Publish(stream, "ANY", "{}"); err != nil {
+		t.Fatalf("publish failed: %v", err)
+	}
+	to := time.Now().Add(time.Millisecond)
+
+	conn := servertest.Dial(t)
+	for _, window := range [][]interface{}{
+		{from.UnixNano() / int64(time.Millisecond), to.UnixNano() / int64(time.Millisecond)},
+		{from.UTC().Format(time.RFC3339Nano), to.UTC().Format(time.RFC3339Nano)},
+		{from.Format(time.RFC3339Nano), to.UnixNano() / int64(time.Millisecond)},
+		// a window in whole seconds
+		{from.Truncate(time.Second).Format(time.RFC3339), to.Add(time.Second).Format(time.RFC3339)},
+	} {
+		v, err := conn.Do("ERANGE", append(window, "STREAM", stream)...)
+		values, ok := v.([]interface{})
+		if err != nil || !ok || len(values) == 0 || fmt.Sprintf("%s", values[0]) != stream {
+			t.Fatalf("expected ERANGE %v to read the event of %s, got %v %v", window, stream, v, err)
+		}
+	}
+
+	for _, args := range [][]interface{}{
+		{"1"},
+		{"x", "2"},
+		{"1", "2020-04-04"},
+		{"1969-12-31T00:00:00Z", "2"},
+		{"2", "1"},
+		{"1", "2", "STREAM"},
+		{"1", "2", "COUNT", "0"},
+		{"1", "2", "COUNT", "x"},
+		{"1", "2", "LIMIT", "1"},
+	} {
+		if _, err := conn.Do("ERANGE", args...); err == nil {
+			t.Fatalf("expected ERANGE %v to be rejected", args)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package group
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	cmds "github.com/maarek/aves/commands"
+	"github.com/maarek/aves/consumer"
+	"github.com/maarek/aves/store"
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	// defaultCount - events handed out by a read unless a count is given
+	defaultCount = 1
+	// defaultVisibility - how long a member holds the events it read unless a timeout is given
+	defaultVisibility = 30 * time.Second
+)
+
+// CreateCommand - GROUPCREATE <group> <stream> [<position>]
+func CreateCommand(c *cmds.Context) {
+	if len(c.Args) < 2 {
+		c.WriteError("GROUPCREATE command must have at least 2 arguments: GROUPCREATE <group> <stream> [<position>]")
+		return
+	}
+
+	var position ulid.ULID
+	if len(c.Args) > 2 && len(c.Args[2]) > 0 {
+		var err error
+		position, err = ulid.ParseStrict(string(c.Args[2]))
+		if err != nil {
+			c.WriteError("GROUPCREATE position must be the ulid of an event")
+			return
+		}
+	}
+
+	err := c.Groups.Create(string(c.Args[0]), string(c.Args[1]), position)
+	if errors.Is(err, consumer.ErrGroupExists) {
+		c.WriteError("BUSYGROUP consumer group already exists")
+		return
+	}
+	if err != nil {
+		c.WriteError(err.Error())
+		return
+	}
+
+	c.WriteString("OK")
+}
+
+// ReadCommand - GROUPREAD <group> <consumer> [<count>] [<visibility-timeout-ms>]
+func ReadCommand(c *cmds.Context) {
+	if len(c.Args) < 2 {
+		c.WriteError("GROUPREAD command must have at least 2 arguments: GROUPREAD <group> <consumer> [<count>] [<visibility-timeout-ms>]")
+		return
+	}
+
+	count := defaultCount
+	if len(c.Args) > 2 {
+		n, err := strconv.Atoi(string(c.Args[2]))
+		if err != nil || n < 1 {
+			c.WriteError("GROUPREAD count must be a positive integer")
+			return
+		}
+		count = n
+	}
+
+	visibility := defaultVisibility
+	if len(c.Args) > 3 {
+		ms, err := strconv.ParseInt(string(c.Args[3]), 10, 64)
+		if err != nil || ms < 1 {
+			c.WriteError("GROUPREAD visibility timeout must be a positive number of milliseconds")
+			return
+		}
+		visibility = time.Duration(ms) * time.Millisecond
+	}
+
+	g, ok := group(c)
+	if !ok {
+		return
+	}
+
+	events, err := g.Read(string(c.Args[1]), count, visibility)
+	if err != nil {
+		c.WriteError(err.Error())
+		return
+	}
+
+	// links are read as the events they link to, a link shares the position of its event
+	// so the stream of the link is written last to acknowledge it apart from the event.
+	// Links to events that are gone are read as is.
+	keys := make([]store.Key, len(events))
+	decoded := make([]store.Event, len(events))
+	for i, e := range events {
+		if decoded[i], err = store.DecodeEvent(e.Value); err != nil {
+			c.WriteError(err.Error())
+			return
+		}
+		keys[i], decoded[i], err = store.ResolveLink(c.DB, e.Key, decoded[i])
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			c.WriteError(err.Error())
+			return
+		}
+	}
+
+	// the stream, position, version and data of each event, its envelope, deliveries and
+	// the stream it was read from
+	FIELDS := 6 + cmds.EnvelopeFields
+	c.WriteArray(len(events))
+	for i, e := range events {
+		c.WriteArray(FIELDS)
+		c.WriteBulkString(string(keys[i].Stream))
+		c.WriteBulkString(keys[i].ID.String())
+		c.WriteBulkString(strconv.FormatUint(keys[i].Version, 10))
+		c.WriteBulkString(decoded[i].Data)
+		cmds.WriteEnvelope(c, decoded[i])
+		c.WriteInt(e.Deliveries)
+		c.WriteBulkString(string(e.Key.Stream))
+	}
+}
+
+// AckCommand - ACK <group> <position>[:<stream>] [<position>[:<stream>] ...]
+func AckCommand(c *cmds.Context) {
+	if len(c.Args) < 2 {
+		c.WriteError("ACK command must have at least 2 arguments: ACK <group> <position>[:<stream>] [<position>[:<stream>] ...]")
+		return
+	}
+
+	positions, ok := parsePositions(c)
+	if !ok {
+		return
+	}
+
+	g, ok := group(c)
+	if !ok {
+		return
+	}
+
+	acked, err := g.Ack(positions...)
+	if err != nil {
+		c.WriteError(err.Error())
+		return
+	}
+
+	c.WriteInt(acked)
+}
+
+// NackCommand - NACK <group> <position>[:<stream>] [<position>[:<stream>] ...]
+func NackCommand(c *cmds.Context) {
+	if len(c.Args) < 2 {
+		c.WriteError("NACK command must have at least 2 arguments: NACK <group> <position>[:<stream>] [<position>[:<stream>] ...]")
+		return
+	}
+
+	positions, ok := parsePositions(c)
+	if !ok {
+		return
+	}
+
+	g, ok := group(c)
+	if !ok {
+		return
+	}
+
+	c.WriteInt(g.Nack(positions...))
+}
+
+// group - fetches the group named by the first argument, writing the error when it can't
+func group(c *cmds.Context) (*consumer.Group, bool) {
+	g, err := c.Groups.Get(string(c.Args[0]))
+	if errors.Is(err, consumer.ErrNoGroup) {
+		c.WriteError("NOGROUP consumer group does not exist")
+		return nil, false
+	}
+	if err != nil {
+		c.WriteError(err.Error())
+		return nil, false
+	}
+	return g, true
+}
+
+// parsePositions - parses the positions following the group, writing the error when it can't.
+// A position followed by the stream an event was read from stands for that event alone.
+func parsePositions(c *cmds.Context) ([]consumer.Position, bool) {
+	positions := make([]consumer.Position, len(c.Args)-1)
+	for i, arg := range c.Args[1:] {
+		var stream string
+		if len(arg) > ulid.EncodedSize && arg[ulid.EncodedSize] == ':' {
+			arg, stream = arg[:ulid.EncodedSize], string(arg[ulid.EncodedSize+1:])
+		}
+		id, err := ulid.ParseStrict(string(arg))
+		if err != nil {
+			c.WriteError(strings.ToUpper(c.Action) + " positions must be the ulids of events")
+			return nil, false
+		}
+		positions[i] = consumer.Position{ID: id, Stream: store.StreamID(stream)}
+	}
+	return positions, true
+}
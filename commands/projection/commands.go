@@ -0,0 +1,111 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package projection
+
+import (
+	"errors"
+	"strings"
+
+	cmds "github.com/maarek/aves/commands"
+	proj "github.com/maarek/aves/projection"
+)
+
+// ProjectionCommand - PROJECTION CREATE <name> <source> | PROJECTION GET <name> [<partition>] |
+// PROJECTION DELETE <name> | PROJECTION LIST
+func ProjectionCommand(c *cmds.Context) {
+	if len(c.Args) < 1 {
+		c.WriteError("PROJECTION command must have at least 1 argument: PROJECTION CREATE <name> <source> | PROJECTION GET <name> [<partition>] | PROJECTION DELETE <name> | PROJECTION LIST")
+		return
+	}
+
+	switch strings.ToUpper(string(c.Args[0])) {
+	case "CREATE":
+		if len(c.Args) != 3 {
+			c.WriteError("PROJECTION CREATE must have 2 arguments: PROJECTION CREATE <name> <source>")
+			return
+		}
+
+		err := c.Projections.Create(string(c.Args[1]), string(c.Args[2]))
+		if errors.Is(err, proj.ErrProjectionExists) {
+			c.WriteError("BUSYPROJECTION projection already exists")
+			return
+		}
+		if err != nil {
+			c.WriteError("PROJECTION " + err.Error())
+			return
+		}
+
+		c.WriteString("OK")
+	case "GET":
+		if len(c.Args) < 2 || len(c.Args) > 3 {
+			c.WriteError("PROJECTION GET must have 1 or 2 arguments: PROJECTION GET <name> [<partition>]")
+			return
+		}
+
+		var partition string
+		if len(c.Args) == 3 {
+			partition = string(c.Args[2])
+		}
+
+		state, ok, err := c.Projections.Get(string(c.Args[1]), partition)
+		if !check(c, err) {
+			return
+		}
+		if !ok {
+			c.WriteNull()
+			return
+		}
+
+		c.WriteBulkString(state)
+	case "DELETE":
+		if len(c.Args) != 2 {
+			c.WriteError("PROJECTION DELETE must have 1 argument: PROJECTION DELETE <name>")
+			return
+		}
+
+		if !check(c, c.Projections.Delete(string(c.Args[1]))) {
+			return
+		}
+
+		c.WriteString("OK")
+	case "LIST":
+		// the name, checkpoint and error of each projection, the error is empty while it runs
+		FIELDS := 3
+		infos := c.Projections.List()
+		c.WriteArray(len(infos) * FIELDS)
+		for _, info := range infos {
+			c.WriteBulkString(info.Name)
+			c.WriteBulkString(info.Checkpoint.String())
+			c.WriteBulkString(info.Error)
+		}
+	default:
+		c.WriteError("PROJECTION subcommand must be one of CREATE, GET, DELETE, LIST")
+	}
+}
+
+// check - writes the error of a projection that could not be used, true when there is none
+func check(c *cmds.Context, err error) bool {
+	if errors.Is(err, proj.ErrNoProjection) {
+		c.WriteError("NOPROJECTION projection does not exist")
+		return false
+	}
+	if err != nil {
+		c.WriteError(err.Error())
+		return false
+	}
+	return true
+}
@@ -17,182 +17,626 @@
 package pubsub
 
 import (
+	"errors"
 	"strconv"
+	"strings"
+	"sync"
 
 	cmds "github.com/maarek/aves/commands"
+	"github.com/maarek/aves/commands/checkpoint"
 	"github.com/maarek/aves/oplog"
 	"github.com/maarek/aves/store"
+	"github.com/maarek/aves/streammeta"
+	"github.com/oklog/ulid/v2"
 	"github.com/tidwall/redcon"
 )
 
-// const defaultPubSubAllTopic = "*"
+// publishMu - serializes appends with their broadcast so the oplog is written in position order
+var publishMu sync.Mutex
 
-// PublishCommand - PUBLISH <stream> <version> <event-payload>
+// AppendEvent - appends an event to the stream and publishes it to the oplog once committed,
+// also under the topics given so that their subscribers are notified of it
+func AppendEvent(c *cmds.Context, stream store.StreamID, e store.Event, topics ...string) (store.Key, error) {
+	keys, err := appendEvents(c, stream, store.ExpectAny, []string{store.EncodeEvent(e)}, topics...)
+	if err != nil {
+		return store.Key{}, err
+	}
+	return keys[0], nil
+}
+
+// appendEvents - appends the encoded events to the stream along with their links and publishes
+// them to the oplog once committed
+func appendEvents(c *cmds.Context, stream store.StreamID, expected int64, values []string, topics ...string) ([]store.Key, error) {
+	publishMu.Lock()
+	defer publishMu.Unlock()
+
+	keys, links, err := c.DB.AppendLinked(stream, expected, values, c.Links)
+	if err != nil {
+		return nil, err
+	}
+
+	// Publish to OpLog, the links of an event follow it at its position
+	for i, key := range keys {
+		kv := KeyValue{
+			Key:   key,
+			Value: values[i],
+		}
+		c.OpLog.Write(string(stream), kv)
+		for _, topic := range topics {
+			c.OpLog.Write(topic, kv)
+		}
+
+		for len(links) > 0 && links[0].ID == key.ID {
+			c.OpLog.Write(string(links[0].Stream), KeyValue{
+				Key:   links[0],
+				Value: store.EncodeLink(key),
+			})
+			links = links[1:]
+		}
+	}
+
+	return keys, nil
+}
+
+// PublishCommand - PUBLISH <stream> [<expected-version>] [<field> <value> ...] <event-payload>
+// where the fields are TYPE, CONTENTTYPE, CORRELATION, CAUSATION and METADATA
 func PublishCommand(c *cmds.Context) {
-	if len(c.Args) < 3 {
-		c.WriteError("PUBLISH command must have at all required argument: PUBLISH <stream> <version> <event-payload>")
+	if len(c.Args) < 2 {
+		c.WriteError("PUBLISH command must have at all required argument: PUBLISH <stream> [<expected-version>] [<field> <value> ...] <event-payload>")
 		return
 	}
 
-	// TODO: Check this another way?
-	_, err := strconv.Atoi(string(c.Args[1]))
+	// the fields come in pairs so an odd number of arguments in between leads with the expected version,
+	// without an expected version the event is appended to the head of the stream
+	between := c.Args[1 : len(c.Args)-1]
+
+	expected := store.ExpectAny
+	if len(between)%2 == 1 {
+		var err error
+		expected, err = store.ParseExpectedVersion(string(between[0]))
+		if err != nil {
+			c.WriteError("PUBLISH command must have an integer expected version or one of ANY, NO_STREAM, STREAM_EXISTS")
+			return
+		}
+		between = between[1:]
+	}
+
+	e, err := parseEnvelope(between)
 	if err != nil {
-		c.WriteError("PUBLISH command must have an integer version string")
+		c.WriteError("PUBLISH " + err.Error())
 		return
 	}
+	e.Data = string(c.Args[len(c.Args)-1])
 
-	key := store.NewEventKey(c.Args[0], c.Args[1])
-	value := string(c.Args[2])
-
-	err = c.DB.Set(key, value)
+	_, err = appendEvents(c, store.StreamID(c.Args[0]), expected, []string{store.EncodeEvent(e)})
 	if err != nil {
+		var wev *store.WrongExpectedVersionError
+		if errors.As(err, &wev) {
+			c.WriteError(wev.Error())
+			return
+		}
+		if errors.Is(err, store.ErrStreamDeleted) {
+			c.WriteError(err.Error())
+			return
+		}
 		c.WriteError("PUBLISH could not write event to the data store")
 		return
 	}
 
-	// Publish to OpLog
-	c.OpLog.Write(KeyValue{
-		Key:   key,
-		Value: value,
-	})
+	c.WriteString("OK")
+}
+
+// envelopeFields - the names of the envelope fields given to PUBLISH and PUBLISHBATCH
+var envelopeFields = []string{"TYPE", "CONTENTTYPE", "CORRELATION", "CAUSATION", "METADATA"}
+
+// isEnvelopeField - determines if the argument names an envelope field
+func isEnvelopeField(arg []byte) bool {
+	for _, field := range envelopeFields {
+		if strings.EqualFold(string(arg), field) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseEnvelope - parses the envelope fields given to PUBLISH as pairs of a field and its value
+func parseEnvelope(args [][]byte) (store.Event, error) {
+	var e store.Event
+	for i := 0; i+1 < len(args); i += 2 {
+		value := string(args[i+1])
+		switch strings.ToUpper(string(args[i])) {
+		case "TYPE":
+			e.Type = value
+		case "CONTENTTYPE":
+			e.ContentType = value
+		case "CORRELATION":
+			e.CorrelationID = value
+		case "CAUSATION":
+			e.CausationID = value
+		case "METADATA":
+			e.Metadata = value
+		default:
+			return e, errors.New("field must be one of TYPE, CONTENTTYPE, CORRELATION, CAUSATION, METADATA")
+		}
+	}
+	return e, nil
+}
+
+// parseBatch - parses the events given to PUBLISHBATCH, each payload preceded by the envelope
+// fields of its event. An argument naming a field starts a pair when a value and a payload follow it.
+func parseBatch(args [][]byte) ([]store.Event, error) {
+	var events []store.Event
+	var fields [][]byte
+	for i := 0; i < len(args); i++ {
+		if isEnvelopeField(args[i]) && i+2 < len(args) {
+			fields = append(fields, args[i], args[i+1])
+			i++
+			continue
+		}
+
+		e, err := parseEnvelope(fields)
+		if err != nil {
+			return nil, err
+		}
+		e.Data = string(args[i])
+		events = append(events, e)
+		fields = nil
+	}
+	return events, nil
+}
+
+// PublishBatchCommand - PUBLISHBATCH <stream> <expected-version> [<field> <value> ...] <event-payload>
+// [[<field> <value> ...] <event-payload> ...]
+func PublishBatchCommand(c *cmds.Context) {
+	if len(c.Args) < 3 {
+		c.WriteError("PUBLISHBATCH command must have at all required argument: PUBLISHBATCH <stream> <expected-version> [<field> <value> ...] <event-payload> [[<field> <value> ...] <event-payload> ...]")
+		return
+	}
+
+	expected, err := store.ParseExpectedVersion(string(c.Args[1]))
+	if err != nil {
+		c.WriteError("PUBLISHBATCH command must have an integer expected version or one of ANY, NO_STREAM, STREAM_EXISTS")
+		return
+	}
+
+	events, err := parseBatch(c.Args[2:])
+	if err != nil {
+		c.WriteError("PUBLISHBATCH " + err.Error())
+		return
+	}
+
+	values := make([]string, len(events))
+	for i, e := range events {
+		values[i] = store.EncodeEvent(e)
+	}
+
+	_, err = appendEvents(c, store.StreamID(c.Args[0]), expected, values)
+	if err != nil {
+		var wev *store.WrongExpectedVersionError
+		if errors.As(err, &wev) {
+			c.WriteError(wev.Error())
+			return
+		}
+		if errors.Is(err, store.ErrStreamDeleted) {
+			c.WriteError(err.Error())
+			return
+		}
+		c.WriteError("PUBLISHBATCH could not write events to the data store")
+		return
+	}
 
 	c.WriteString("OK")
 }
 
-// SubscribeCommand - SUBSCRIBE <stream> [<offset>]
+// SubscribeCommand - SUBSCRIBE <stream> [<offset> | FROM CHECKPOINT <name>]
+// where the stream may be a <prefix>* pattern
 func SubscribeCommand(c *cmds.Context) {
 	if len(c.Args) < 1 {
-		c.WriteError("SUBSCRIBE must has at least 1 argument, SUBSCRIBE <stream> [<offset>]")
+		c.WriteError("SUBSCRIBE must has at least 1 argument, SUBSCRIBE <stream> [<offset> | FROM CHECKPOINT <name>]")
 		return
 	}
 
-	conn := c.Detach()
+	pattern := string(c.Args[0])
+
+	offsetArg, rest, ok := subscribeOffset(c, c.Args[1:])
+	if !ok {
+		return
+	}
+	if len(rest) > 0 {
+		c.WriteError("SUBSCRIBE must has at most 1 offset, SUBSCRIBE <stream> [<offset> | FROM CHECKPOINT <name>]")
+		return
+	}
+
+	// streams matched by a pattern and subscriptions after a global position
+	// are caught up from the time series index
+	if position, err := parsePosition(offsetArg); err == nil && (oplog.IsPattern(pattern) || len(offsetArg) > 0) {
+		conn := c.Detach()
+
+		subscribe(c, conn, pattern, store.ScannerOptions{
+			Offset: positionOffset(position),
+			Index:  true,
+		}, position, nil)
+		return
+	}
+
+	if oplog.IsPattern(pattern) {
+		c.WriteError("SUBSCRIBE offset of a pattern must be the ulid of an event")
+		return
+	}
 
 	var offset []byte
 	prefix := c.Args[0]
 
-	if len(c.Args) > 1 {
-		offset = c.Args[1]
+	if len(offsetArg) > 0 {
+		version, err := strconv.ParseUint(string(offsetArg), 10, 64)
+		if err != nil {
+			c.WriteError("SUBSCRIBE offset must be an integer version or the ulid of an event")
+			return
+		}
+		offset = store.EncodeVersion(version)
 	}
 
+	conn := c.Detach()
+
 	includeOffsetVals := false
 	if len(offset) == 0 {
 		includeOffsetVals = true
 	}
 
-	data := []KeyValue{}
-	loaded := 0
-	err := c.DB.Scan(store.ScannerOptions{
+	subscribe(c, conn, pattern, store.ScannerOptions{
 		IncludeOffset: includeOffsetVals,
 		Offset:        offset,
 		Prefix:        prefix,
-		FetchValues:   true,
-		Handler: func(k store.Key, v string) bool {
-			data = append(data, KeyValue{
-				Key:   k,
-				Value: v,
-			})
-			loaded++
-			return true
-		},
-	})
+	}, ulid.ULID{}, nil)
+}
+
+// SubscribeAllCommand - SUBSCRIBEALL [<position> | FROM CHECKPOINT <name>] [PREFIX <prefix>]
+// [REGEX <regex>] [TYPES <type>[,<type> ...]] [PINGEVERY <count>]
+// where only the events of the streams and types given by the filter are pushed
+func SubscribeAllCommand(c *cmds.Context) {
+	var positionArg []byte
+	args := c.Args
+	if len(args) > 0 && !isFilterOption(args[0]) {
+		var ok bool
+		if positionArg, args, ok = subscribeOffset(c, args); !ok {
+			return
+		}
+	}
 
+	// resume strictly after the position of the last event processed
+	position, err := parsePosition(positionArg)
 	if err != nil {
-		c.WriteError(err.Error())
+		c.WriteError("SUBSCRIBEALL position must be the ulid of an event")
 		return
 	}
 
-	for i, kv := range data {
-		var d []byte
-		if i%2 == 0 {
-			continue
+	f, err := parseFilter(args)
+	if err != nil {
+		c.WriteError("SUBSCRIBEALL " + err.Error())
+		return
+	}
+
+	conn := c.Detach()
+
+	subscribe(c, conn, oplog.Wildcard, store.ScannerOptions{
+		Offset: positionOffset(position),
+		Index:  true,
+	}, position, f)
+}
+
+// subscribeOffset - the offset given to a subscription, either directly or as the position
+// saved in a checkpoint with FROM CHECKPOINT <name>, along with the arguments following it.
+// A checkpoint that was never saved subscribes from the first event.
+func subscribeOffset(c *cmds.Context, args [][]byte) ([]byte, [][]byte, bool) {
+	if len(args) == 0 {
+		return nil, nil, true
+	}
+
+	if !strings.EqualFold(string(args[0]), "FROM") {
+		return args[0], args[1:], true
+	}
+
+	if len(args) < 3 || !strings.EqualFold(string(args[1]), "CHECKPOINT") {
+		c.WriteError(strings.ToUpper(c.Action) + " must be given FROM CHECKPOINT <name>")
+		return nil, nil, false
+	}
+
+	position, err := checkpoint.Load(c.DB, string(args[2]))
+	if err != nil {
+		c.WriteError(err.Error())
+		return nil, nil, false
+	}
+
+	return position, args[3:], true
+}
+
+// parsePosition - parses the global position of an event, empty is the position before all events
+func parsePosition(arg []byte) (ulid.ULID, error) {
+	if len(arg) == 0 {
+		return ulid.ULID{}, nil
+	}
+	return ulid.ParseStrict(string(arg))
+}
+
+// positionOffset - the offset of an index scan starting after the position
+func positionOffset(position ulid.ULID) []byte {
+	if position == (ulid.ULID{}) {
+		return nil
+	}
+	return position[:]
+}
+
+// subscriber - a detached connection following the streams matching a pattern
+type subscriber struct {
+	c       *cmds.Context
+	conn    redcon.DetachedConn
+	pattern string
+
+	// the scan catching up with the events stored before following the oplog
+	opts store.ScannerOptions
+	// the events pushed, every event when nil
+	filter *filter
+	// the number of events skipped by the filter since the last push
+	skipped int
+
+	// the last event pushed and the streams read at its position that were pushed, every
+	// stream at the position a subscription starts after when nil
+	last   store.Key
+	pushed map[string]bool
+	// the last version pushed of the stream scanned, events of other streams such as
+	// deletions may be pushed to it as well
+	version uint64
+}
+
+// subscribe - catches the subscriber up with the events of the streams matching the pattern
+// and then follows their topics in the oplog, pushing every event once and in the order of its position
+func subscribe(c *cmds.Context, conn redcon.DetachedConn, pattern string, opts store.ScannerOptions, position ulid.ULID, f *filter) {
+	s := &subscriber{
+		c:       c,
+		conn:    conn,
+		pattern: pattern,
+		opts:    opts,
+		filter:  f,
+		last:    store.Key{ID: position},
+	}
+
+	go s.run()
+}
+
+// run - catches up and follows the oplog, catching up again from the store whenever
+// the subscriber falls too far behind the oplog
+func (s *subscriber) run() {
+	defer s.conn.Close()
+
+	for {
+		// listen before catching up so no event committed during the scan is missed
+		sub := s.c.OpLog.Listen(s.pattern)
+
+		err := s.catchUp()
+		if err == nil {
+			err = s.follow(sub)
 		}
-		d = redcon.AppendArray(d, 4)
-		d = redcon.AppendBulkString(d, string(kv.Key.Stream))
-		d = redcon.AppendBulkString(d, kv.Key.ID.String())
-		d = redcon.AppendBulkString(d, string(kv.Key.Version))
-		d = redcon.AppendBulkString(d, kv.Value)
-		if _, err := conn.NetConn().Write(d); err != nil {
+		sub.Close()
+
+		if err != oplog.ErrLagged {
 			return
 		}
 	}
+}
+
+// catchUpPage - the number of events read from the store and pushed at a time while catching up
+const catchUpPage = 256
+
+// catchUp - pushes the stored events after the last event pushed, a page at a time
+func (s *subscriber) catchUp() error {
+	// events outside of the bounds of the stream metadata are skipped
+	filter := streammeta.NewFilter(s.c.DB)
+
+	for {
+		page, more, err := s.scanPage(filter)
+		if err != nil {
+			s.conn.WriteError(err.Error())
+			_ = s.conn.Flush()
+			return err
+		}
 
-	// Stream from OpLog
-	listener := c.OpLog.Listen()
-	go listen(listener, conn)
+		for _, m := range page {
+			if err := s.push(m); err != nil {
+				return err
+			}
+		}
+
+		if !more {
+			return nil
+		}
+	}
 }
 
-// SubscribeAllCommand - SUBSCRIBEALL [<index>]
-func SubscribeAllCommand(c *cmds.Context) {
-	var prefix []byte
-	conn := c.Detach()
+// scanPage - reads the next page of stored events after the last event pushed, true when
+// there are more events to read. A page of an index scan ends between positions so that the
+// next one resumes after the last position pushed.
+func (s *subscriber) scanPage(filter *streammeta.Filter) ([]message, bool, error) {
+	opts := s.opts
 
-	includeOffsetVals := true
-	if len(c.Args) > 0 {
-		prefix = c.Args[0]
-		includeOffsetVals = false
+	// resume after the last event pushed by an earlier page, catch up or the oplog, from
+	// its position when other streams at the position are still to be pushed
+	if opts.Index && s.last.ID != (ulid.ULID{}) {
+		opts.Offset = s.last.ID[:]
+		opts.IncludeOffset = s.pushed != nil
+	} else if !opts.Index && s.version > 0 {
+		opts.Offset = store.EncodeVersion(s.version)
+		opts.IncludeOffset = false
 	}
 
-	data := []KeyValue{}
-	loaded := 0
-	err := c.DB.Scan(store.ScannerOptions{
-		IncludeOffset: includeOffsetVals,
-		Prefix:        prefix,
-		Index:         true,
-		FetchValues:   true,
-		Handler: func(k store.Key, v string) bool {
-			data = append(data, KeyValue{
-				Key:   k,
-				Value: v,
-			})
-			loaded++
+	var handlerErr error
+	var more bool
+	var read ulid.ULID
+	data := make([]message, 0, catchUpPage)
+	opts.FetchValues = true
+	opts.Handler = func(k store.Key, v string) bool {
+		if len(data) >= catchUpPage && (!opts.Index || k.ID != read) {
+			more = true
+			return false
+		}
+		read = k.ID
+
+		if opts.Index && s.handled(k) {
 			return true
-		},
-	})
+		}
+		if !oplog.Match(s.pattern, string(k.Stream)) {
+			return true
+		}
+		visible, err := filter.Visible(k)
+		if err != nil {
+			handlerErr = err
+			return false
+		}
+		if !visible {
+			return true
+		}
+		m, ok, err := s.resolve(KeyValue{Key: k, Value: v}, filter)
+		if err != nil {
+			handlerErr = err
+			return false
+		}
+		if ok {
+			data = append(data, m)
+		}
+		return true
+	}
 
-	if err != nil {
-		c.WriteError(err.Error())
-		return
+	err := s.c.DB.Scan(opts)
+	if err == nil {
+		err = handlerErr
 	}
+	return data, more, err
+}
 
-	for i, kv := range data {
-		var d []byte
-		if i%2 == 0 {
+// follow - pushes the events broadcast to the oplog that were not pushed yet, the oplog is
+// written in position order so anything before the last event pushed is a duplicate
+func (s *subscriber) follow(sub *oplog.Subscription) error {
+	for {
+		m, err := sub.Read()
+		if err != nil {
+			return err
+		}
+
+		kv := m.(KeyValue)
+		if s.handled(kv.Key) {
 			continue
 		}
-		d = redcon.AppendArray(d, 4)
-		d = redcon.AppendBulkString(d, string(kv.Key.Stream))
-		d = redcon.AppendBulkString(d, kv.Key.ID.String())
-		d = redcon.AppendBulkString(d, string(kv.Key.Version))
-		d = redcon.AppendBulkString(d, kv.Value)
-		if _, err := conn.NetConn().Write(d); err != nil {
-			return
+
+		resolved, ok, err := s.resolve(kv, nil)
+		if err != nil {
+			s.conn.WriteError(err.Error())
+			_ = s.conn.Flush()
+			return err
+		}
+		if !ok {
+			continue
 		}
+
+		if err := s.push(resolved); err != nil {
+			return err
+		}
+	}
+}
+
+// handled - whether the event read was pushed already, events and links share their position
+// so a position is only done with once every stream read at it was pushed
+func (s *subscriber) handled(k store.Key) bool {
+	switch k.ID.Compare(s.last.ID) {
+	case -1:
+		return true
+	case 0:
+		return s.pushed == nil || s.pushed[string(k.Stream)]
 	}
+	return false
+}
 
-	// Stream from OpLog
-	listener := c.OpLog.Listen()
-	go listen(listener, conn)
+// message - an event read by a subscriber along with the event pushed for it,
+// which is the event linked to when the event read is a link
+type message struct {
+	read  store.Key
+	key   store.Key
+	event store.Event
 }
 
-// KeyValue - key and value
+// resolve - decodes the event read and resolves a link to the event it links to, false when
+// nothing is pushed for it. Subscribers to every stream get the events linked to anyway so
+// links are left out for them, as are links to events that are gone or hidden by the filter.
+// Events of the oplog were just written and are not filtered.
+func (s *subscriber) resolve(kv KeyValue, filter *streammeta.Filter) (message, bool, error) {
+	e, err := store.DecodeEvent(kv.Value)
+	if err != nil {
+		return message{}, false, err
+	}
+
+	m := message{read: kv.Key, key: kv.Key, event: e}
+	if e.Type != store.LinkEventType {
+		return m, true, nil
+	}
+	if s.pattern == oplog.Wildcard {
+		return m, false, nil
+	}
+
+	var ok bool
+	if filter != nil {
+		m.key, m.event, ok, err = filter.Resolve(kv.Key, e)
+		return m, ok, err
+	}
+
+	m.key, m.event, err = store.ResolveLink(s.c.DB, kv.Key, e)
+	if errors.Is(err, store.ErrNotFound) {
+		return m, false, nil
+	}
+	return m, err == nil, err
+}
+
+// push - writes the event to the subscriber, or counts it as skipped when it does not
+// pass the filter and pings the subscriber once enough events were skipped in a row
+func (s *subscriber) push(m message) error {
+	var d []byte
+	if s.filter != nil && !s.filter.match(string(m.key.Stream), m.event) {
+		s.skipped++
+		if s.skipped >= s.filter.pingEvery {
+			d = appendPing(d, m.key.ID)
+		}
+	} else {
+		d = appendEvent(d, m.key, m.event)
+	}
+
+	if len(d) > 0 {
+		if _, err := s.conn.NetConn().Write(d); err != nil {
+			return err
+		}
+		s.skipped = 0
+	}
+	if m.read.ID != s.last.ID || s.pushed == nil {
+		s.pushed = make(map[string]bool)
+	}
+	s.pushed[string(m.read.Stream)] = true
+	s.last = m.read
+	if !s.opts.Index && string(m.read.Stream) == s.pattern {
+		s.version = m.read.Version
+	}
+	return nil
+}
+
+// KeyValue - key and encoded event
 type KeyValue struct {
 	Key   store.Key
 	Value string
 }
 
-func listen(r oplog.Receiver, conn redcon.DetachedConn) {
-	for m := r.Read(); m != nil; m = r.Read() {
-		kv := m.(KeyValue)
-		var d []byte
-		d = redcon.AppendArray(d, 4)
-		d = redcon.AppendBulkString(d, string(kv.Key.Stream))
-		d = redcon.AppendBulkString(d, kv.Key.ID.String())
-		d = redcon.AppendBulkString(d, string(kv.Key.Version))
-		d = redcon.AppendBulkString(d, kv.Value)
-		if _, err := conn.NetConn().Write(d); err != nil {
-			_ = conn.Close()
-			return
-		}
-	}
+// appendEvent - appends the RESP array pushed to subscribers for an event, its stream, position,
+// version and data followed by its envelope
+func appendEvent(d []byte, k store.Key, e store.Event) []byte {
+	d = redcon.AppendArray(d, 4+cmds.EnvelopeFields)
+	d = redcon.AppendBulkString(d, string(k.Stream))
+	d = redcon.AppendBulkString(d, k.ID.String())
+	d = redcon.AppendBulkString(d, strconv.FormatUint(k.Version, 10))
+	d = redcon.AppendBulkString(d, e.Data)
+	d = cmds.AppendEnvelope(d, e)
+	return d
 }
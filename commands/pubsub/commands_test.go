@@ -0,0 +1,370 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pubsub_test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/maarek/aves/client"
+	"github.com/maarek/aves/server/servertest"
+)
+
+func TestPublishExpectedVersion(t *testing.T) {
+	conn := servertest.Dial(t)
+	stream := "order-" + servertest.Name()
+
+	for _, tt := range []struct {
+		expected string
+		err      string
+	}{
+		{"STREAM_EXISTS", "WRONGEXPECTEDVERSION expected STREAM_EXISTS actual 0"},
+		{"1", "WRONGEXPECTEDVERSION expected 1 actual 0"},
+		{"NO_STREAM", ""},
+		{"NO_STREAM", "WRONGEXPECTEDVERSION expected NO_STREAM actual 1"},
+		{"0", "WRONGEXPECTEDVERSION expected 0 actual 1"},
+		{"1", ""},
+		{"STREAM_EXISTS", ""},
+		{"ANY", ""},
+		{"3", "WRONGEXPECTEDVERSION expected 3 actual 4"},
+		{"4", ""},
+	} {
+		_, err := redis.String(conn.Do("PUBLISH", stream, tt.expected, "{}"))
+		if tt.err == "" && err != nil {
+			t.Fatalf("expected PUBLISH %s to succeed, got %v", tt.expected, err)
+		}
+		if tt.err != "" && (err == nil || err.Error() != tt.err) {
+			t.Fatalf("expected PUBLISH %s to fail with %q, got %v", tt.expected, tt.err, err)
+		}
+	}
+
+	// without an expected version the event goes to the head of the stream
+	if _, err := redis.String(conn.Do("PUBLISH", stream, "{}")); err != nil {
+		t.Fatalf("expected PUBLISH without an expected version to succeed, got %v", err)
+	}
+	if _, err := redis.String(conn.Do("PUBLISH", stream, "5", "{}")); err == nil {
+		t.Fatal("expected PUBLISH 5 to fail after the unversioned event")
+	}
+
+	for _, bad := range []string{"-1", "x", "1.5"} {
+		_, err := redis.String(conn.Do("PUBLISH", stream, bad, "{}"))
+		if err == nil || !strings.Contains(err.Error(), "expected version") {
+			t.Fatalf("expected PUBLISH %s to be rejected, got %v", bad, err)
+		}
+	}
+}
+
+func TestPublishConcurrent(t *testing.T) {
+	const writers = 8
+	stream := "order-" + servertest.Name()
+
+	clients := make([]*client.Context, writers)
+	for i := range clients {
+		clients[i] = servertest.Client(t)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, writers)
+	for i, c := range clients {
+		wg.Add(1)
+		go func(i int, c *client.Context) {
+			defer wg.Done()
+			_, errs[i] = c.Publish(stream, "NO_STREAM", "{}")
+		}(i, c)
+	}
+	wg.Wait()
+
+	var ok int
+	for _, err := range errs {
+		if err == nil {
+			ok++
+			continue
+		}
+		var wev *client.WrongExpectedVersionError
+		if !errors.As(err, &wev) || wev.Expected != "NO_STREAM" || wev.Actual != 1 {
+			t.Fatalf("expected a wrong expected version error, got %#v", err)
+		}
+	}
+	if ok != 1 {
+		t.Fatalf("expected exactly one publisher to create the stream, %d did", ok)
+	}
+
+	events, err := clients[0].EList(stream, "0", "")
+	if err != nil || len(events) != 1 {
+		t.Fatalf("expected the stream to hold one event, got %d %v", len(events), err)
+	}
+}
+
+// receive - reads count events pushed to the subscriber
+func receive(t *testing.T, inc <-chan client.FullEvent, errc <-chan error, count int) []client.FullEvent {
+	t.Helper()
+
+	events := make([]client.FullEvent, 0, count)
+	for len(events) < count {
+		select {
+		case e := <-inc:
+			events = append(events, e)
+		case err := <-errc:
+			t.Fatalf("subscription failed after %d events: %v", len(events), err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected %d events, got %d", count, len(events))
+		}
+	}
+	return events
+}
+
+// publish - publishes count events to each stream in turn from another connection
+func publish(t *testing.T, streams []string, from, count int) <-chan error {
+	conn := servertest.Dial(t)
+
+	done := make(chan error, 1)
+	go func() {
+		for i := from; i < from+count; i++ {
+			for _, stream := range streams {
+				if _, err := conn.Do("PUBLISH", stream, fmt.Sprintf("%s-%d", stream, i)); err != nil {
+					done <- err
+					return
+				}
+			}
+		}
+		done <- nil
+	}()
+	return done
+}
+
+func TestSubscribeCatchUp(t *testing.T) {
+	const stored, live = 700, 700
+
+	for _, tt := range []struct {
+		name    string
+		streams []string
+	}{
+		{"stream", []string{"order"}},
+		{"pattern", []string{"order-a", "order-b"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			category := servertest.Name()
+			streams := make([]string, len(tt.streams))
+			for i, stream := range tt.streams {
+				streams[i] = category + stream
+			}
+			subscription := streams[0]
+			if len(streams) > 1 {
+				subscription = category + "order-*"
+			}
+
+			if err := <-publish(t, streams, 1, stored); err != nil {
+				t.Fatalf("publish failed: %v", err)
+			}
+
+			// events are appended while the subscriber catches up with the stored ones
+			inc, errc := make(chan client.FullEvent, 64), make(chan error, 1)
+			go servertest.Client(t).Subscribe(inc, errc, subscription, "")
+			done := publish(t, streams, stored+1, live)
+
+			events := receive(t, inc, errc, (stored+live)*len(streams))
+			if err := <-done; err != nil {
+				t.Fatalf("publish failed: %v", err)
+			}
+
+			versions := make(map[string]int)
+			var last string
+			for _, e := range events {
+				if e.EventID <= last {
+					t.Fatalf("expected events in position order, got %s after %s", e.EventID, last)
+				}
+				last = e.EventID
+
+				versions[e.StreamID]++
+				if want := fmt.Sprintf("%s-%d", e.StreamID, versions[e.StreamID]); e.Version != versions[e.StreamID] || e.Data != want {
+					t.Fatalf("expected %s, got version %d %s", want, e.Version, e.Data)
+				}
+			}
+
+			// nothing but the next event follows
+			if err := <-publish(t, streams[:1], stored+live+1, 1); err != nil {
+				t.Fatalf("publish failed: %v", err)
+			}
+			if e := receive(t, inc, errc, 1)[0]; e.StreamID != streams[0] || e.Version != stored+live+1 {
+				t.Fatalf("expected version %d of %s, got %d of %s", stored+live+1, streams[0], e.Version, e.StreamID)
+			}
+		})
+	}
+}
+
+func TestSubscribeLinkStreams(t *testing.T) {
+	name := servertest.Name()
+	stream := name + "-1"
+
+	conn := servertest.Dial(t)
+	publish := func(from, to int) {
+		for i := from; i <= to; i++ {
+			if _, err := conn.Do("PUBLISH", stream, "TYPE", name, fmt.Sprintf("%s-%d", stream, i)); err != nil {
+				t.Fatalf("publish failed: %v", err)
+			}
+		}
+	}
+
+	// each event is linked to $ce-<name> and $et-<name> at its position
+	inc, errc := make(chan client.FullEvent, 64), make(chan error, 1)
+	ours := make(chan client.FullEvent, 64)
+	go func() {
+		for e := range inc {
+			if e.StreamID == stream {
+				ours <- e
+			}
+		}
+	}()
+
+	publish(1, 3)
+	go servertest.Client(t).Subscribe(inc, errc, "$*", "")
+	caughtUp := receive(t, ours, errc, 6)
+
+	publish(4, 5)
+	live := receive(t, ours, errc, 4)
+
+	for i, e := range append(caughtUp, live...) {
+		if want := fmt.Sprintf("%s-%d", stream, i/2+1); e.Data != want {
+			t.Fatalf("expected every event once per link stream, got %s for %s", e.Data, want)
+		}
+	}
+}
+
+func TestPublishBatchEnvelope(t *testing.T) {
+	c := servertest.Client(t)
+	category := servertest.Name()
+	stream := category + "-1"
+
+	ok, err := c.PublishEventBatch(stream, "NO_STREAM",
+		client.NewEvent{Data: `{"total":10}`, Envelope: client.Envelope{Type: "Placed", CorrelationID: "c-42"}},
+		client.NewEvent{Data: "plain"},
+		client.NewEvent{Data: "{}", Envelope: client.Envelope{Type: category, ContentType: "application/json"}},
+	)
+	if !ok || err != nil {
+		t.Fatalf("publish failed: %v", err)
+	}
+
+	events, err := c.EList(stream, "0", "")
+	if err != nil || len(events) != 3 {
+		t.Fatalf("expected 3 events, got %d %v", len(events), err)
+	}
+	for i, want := range []client.SimpleEvent{
+		{Version: 1, Data: `{"total":10}`, Envelope: client.Envelope{Type: "Placed", CorrelationID: "c-42"}},
+		{Version: 2, Data: "plain"},
+		{Version: 3, Data: "{}", Envelope: client.Envelope{Type: category, ContentType: "application/json"}},
+	} {
+		if events[i] != want {
+			t.Fatalf("expected %+v, got %+v", want, events[i])
+		}
+	}
+
+	// the events are linked to the streams of their category and type
+	linked, err := c.EList("$et-"+category, "0", "")
+	if err != nil || len(linked) != 1 || linked[0].Version != 1 || linked[0].Type != category {
+		t.Fatalf("expected the typed event to be linked, got %+v %v", linked, err)
+	}
+	if linked, err = c.EList("$ce-"+category, "0", ""); err != nil || len(linked) != 3 {
+		t.Fatalf("expected every event to be linked to its category, got %+v %v", linked, err)
+	}
+
+	// the expected version covers the whole batch
+	_, err = c.PublishEventBatch(stream, "2", client.NewEvent{Data: "late", Envelope: client.Envelope{Type: category}})
+	var wev *client.WrongExpectedVersionError
+	if !errors.As(err, &wev) || wev.Actual != 3 {
+		t.Fatalf("expected a wrong expected version, got %v", err)
+	}
+
+	// an argument naming a field is a payload when nothing follows it
+	conn := servertest.Dial(t)
+	if _, err := conn.Do("PUBLISHBATCH", stream, "3", "TYPE", "Shipped", "{}", "METADATA"); err != nil {
+		t.Fatalf("publish failed: %v", err)
+	}
+	if events, err = c.EList(stream, "3", ""); err != nil || len(events) != 2 || events[0].Type != "Shipped" || events[1].Data != "METADATA" {
+		t.Fatalf("unexpected events %+v %v", events, err)
+	}
+}
+
+func TestSubscribeAllFiltered(t *testing.T) {
+	// every event of the server is read so it has a server of its own
+	addr := servertest.Start(t)
+	conn := servertest.DialAddr(t, addr)
+	publish := func(stream, typ string) {
+		if _, err := conn.Do("PUBLISH", stream, "TYPE", typ, stream); err != nil {
+			t.Fatalf("publish failed: %v", err)
+		}
+	}
+
+	publish("order-1", "Placed")
+	publish("user-1", "Registered")
+	publish("user-2", "Registered")
+	publish("user-3", "Registered")
+	publish("order-2", "Shipped")
+
+	all, errc := make(chan client.FullEvent, 64), make(chan error, 1)
+	go servertest.ClientAddr(t, addr).SubscribeAll(all, errc, "")
+	positions := make(map[string]string)
+	for _, e := range receive(t, all, errc, 5) {
+		positions[e.StreamID] = e.EventID
+	}
+
+	inc, pings := make(chan client.FullEvent, 64), make(chan string, 64)
+	go servertest.ClientAddr(t, addr).SubscribeAllFiltered(inc, pings, errc, "", client.Filter{
+		Prefix:    "order-",
+		Types:     []string{"Placed"},
+		PingEvery: 2,
+	})
+
+	if e := receive(t, inc, errc, 1)[0]; e.StreamID != "order-1" {
+		t.Fatalf("expected order-1, got %s", e.StreamID)
+	}
+
+	// the subscriber is pinged every second event skipped in a row, with the position of the
+	// last one, while catching up and then following new events
+	publish("order-3", "Placed")
+	if e := receive(t, inc, errc, 1)[0]; e.StreamID != "order-3" {
+		t.Fatalf("expected order-3, got %s", e.StreamID)
+	}
+	for _, stream := range []string{"user-2", "order-2"} {
+		select {
+		case position := <-pings:
+			if position != positions[stream] {
+				t.Fatalf("expected a ping at %s of %s, got %s", positions[stream], stream, position)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected a ping at %s", stream)
+		}
+	}
+
+	publish("user-4", "Registered")
+	publish("user-5", "Registered")
+	select {
+	case position := <-pings:
+		if len(position) != len(positions["user-1"]) || position <= positions["order-2"] {
+			t.Fatalf("expected a ping after the events published, got %s", position)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a ping once two new events were skipped")
+	}
+	if len(pings) > 0 || len(inc) > 0 {
+		t.Fatalf("expected nothing else to be pushed, got %d pings and %d events", len(pings), len(inc))
+	}
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/maarek/aves/store"
+	"github.com/oklog/ulid/v2"
+	"github.com/tidwall/redcon"
+)
+
+// CheckpointPing - the first element of the message pushed in place of the events skipped by a filter
+const CheckpointPing = "$checkpoint"
+
+// DefaultPingEvery - the number of events skipped in a row before a filtered subscriber is pinged
+const DefaultPingEvery = 100
+
+// filter - selects the events pushed to a subscriber, an event must match every part given
+type filter struct {
+	prefix string
+	regex  *regexp.Regexp
+	types  map[string]bool
+
+	// the number of events skipped in a row before the subscriber is pinged with the
+	// position reached, so it can advance its checkpoint without receiving events
+	pingEvery int
+}
+
+// isFilterOption - determines if the argument starts the filter of a subscription
+func isFilterOption(arg []byte) bool {
+	switch strings.ToUpper(string(arg)) {
+	case "PREFIX", "REGEX", "TYPES", "PINGEVERY":
+		return true
+	}
+	return false
+}
+
+// parseFilter - parses the options PREFIX <prefix>, REGEX <regex>, TYPES <type>[,<type> ...]
+// and PINGEVERY <count>, nil when no option is given
+func parseFilter(args [][]byte) (*filter, error) {
+	if len(args) == 0 {
+		return nil, nil
+	}
+
+	f := &filter{pingEvery: DefaultPingEvery}
+	for i := 0; i < len(args); i += 2 {
+		option := strings.ToUpper(string(args[i]))
+		if !isFilterOption(args[i]) {
+			return nil, fmt.Errorf("filter option must be one of PREFIX, REGEX, TYPES, PINGEVERY, got %s", args[i])
+		}
+		if i+1 == len(args) {
+			return nil, fmt.Errorf("filter option %s must have a value", option)
+		}
+
+		value := string(args[i+1])
+		switch option {
+		case "PREFIX":
+			f.prefix = value
+		case "REGEX":
+			regex, err := regexp.Compile(value)
+			if err != nil {
+				return nil, fmt.Errorf("filter REGEX is invalid: %v", err)
+			}
+			f.regex = regex
+		case "TYPES":
+			f.types = make(map[string]bool)
+			for _, t := range strings.Split(value, ",") {
+				if t != "" {
+					f.types[t] = true
+				}
+			}
+			if len(f.types) == 0 {
+				return nil, errors.New("filter TYPES must list at least one event type")
+			}
+		case "PINGEVERY":
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return nil, errors.New("filter PINGEVERY must be a positive integer")
+			}
+			f.pingEvery = n
+		}
+	}
+
+	return f, nil
+}
+
+// match - determines if the event of the stream passes the filter
+func (f *filter) match(stream string, e store.Event) bool {
+	if !strings.HasPrefix(stream, f.prefix) {
+		return false
+	}
+	if f.regex != nil && !f.regex.MatchString(stream) {
+		return false
+	}
+	if f.types != nil && !f.types[e.Type] {
+		return false
+	}
+	return true
+}
+
+// appendPing - appends the RESP array pushed to a filtered subscriber in place of the
+// events it skipped, the position of the last event skipped
+func appendPing(d []byte, position ulid.ULID) []byte {
+	d = redcon.AppendArray(d, 2)
+	d = redcon.AppendBulkString(d, CheckpointPing)
+	d = redcon.AppendBulkString(d, position.String())
+	return d
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pubsub
+
+import (
+	"testing"
+
+	"github.com/maarek/aves/store"
+)
+
+func args(values ...string) [][]byte {
+	b := make([][]byte, len(values))
+	for i, v := range values {
+		b[i] = []byte(v)
+	}
+	return b
+}
+
+func TestParseFilter(t *testing.T) {
+	if f, err := parseFilter(nil); f != nil || err != nil {
+		t.Fatalf("expected no filter, got %+v %v", f, err)
+	}
+
+	f, err := parseFilter(args("prefix", "order-", "REGEX", "-[0-9]+$", "TYPES", "Placed,,Shipped", "PINGEVERY", "10"))
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if f.prefix != "order-" || f.regex.String() != "-[0-9]+$" || len(f.types) != 2 || !f.types["Shipped"] || f.pingEvery != 10 {
+		t.Fatalf("unexpected filter %+v", f)
+	}
+
+	if f, err = parseFilter(args("PREFIX", "order-")); err != nil || f.pingEvery != DefaultPingEvery {
+		t.Fatalf("expected the default ping interval, got %+v %v", f, err)
+	}
+
+	for _, bad := range [][]string{
+		{"PREFIX"},
+		{"STREAM", "order-1"},
+		{"REGEX", "("},
+		{"TYPES", ","},
+		{"PINGEVERY", "0"},
+		{"PINGEVERY", "x"},
+		{"PREFIX", "order-", "TYPES"},
+	} {
+		if _, err := parseFilter(args(bad...)); err == nil {
+			t.Fatalf("expected %v to be rejected", bad)
+		}
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	f, err := parseFilter(args("PREFIX", "order-", "REGEX", "-[0-9]+$", "TYPES", "Placed,Shipped"))
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	for _, tt := range []struct {
+		stream string
+		typ    string
+		match  bool
+	}{
+		{"order-1", "Placed", true},
+		{"order-12", "Shipped", true},
+		{"order-1", "Cancelled", false},
+		{"order-1", "", false},
+		{"order-a", "Placed", false},
+		{"user-1", "Placed", false},
+		{"$ce-order-1", "Placed", false},
+	} {
+		if got := f.match(tt.stream, store.Event{Type: tt.typ}); got != tt.match {
+			t.Fatalf("expected %s %s to match=%v", tt.stream, tt.typ, tt.match)
+		}
+	}
+
+	if f, _ = parseFilter(args("PINGEVERY", "5")); !f.match("anything", store.Event{}) {
+		t.Fatal("expected a filter without conditions to match every event")
+	}
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package snapshot
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	cmds "github.com/maarek/aves/commands"
+	"github.com/maarek/aves/store"
+	"github.com/maarek/aves/streammeta"
+)
+
+// saveMu - keeps a snapshot from being replaced by an older one saved at the same time
+var saveMu sync.Mutex
+
+// SnapshotCommand - SNAPSHOT SAVE <stream> <version> <state> | SNAPSHOT LOAD <stream>
+func SnapshotCommand(c *cmds.Context) {
+	if len(c.Args) < 2 {
+		c.WriteError("SNAPSHOT command must have at least 2 arguments: SNAPSHOT SAVE <stream> <version> <state> | SNAPSHOT LOAD <stream>")
+		return
+	}
+
+	stream := string(c.Args[1])
+
+	switch strings.ToUpper(string(c.Args[0])) {
+	case "SAVE":
+		if len(c.Args) != 4 {
+			c.WriteError("SNAPSHOT SAVE must have 3 arguments: SNAPSHOT SAVE <stream> <version> <state>")
+			return
+		}
+
+		version, err := strconv.ParseUint(string(c.Args[2]), 10, 64)
+		if err != nil || version == 0 {
+			c.WriteError("SNAPSHOT version must be the version of an event")
+			return
+		}
+
+		if err := Save(c.DB, stream, version, string(c.Args[3])); err != nil {
+			c.WriteError("SNAPSHOT " + err.Error())
+			return
+		}
+
+		c.WriteString("OK")
+	case "LOAD":
+		version, state, err := Load(c.DB, stream)
+		if err != nil {
+			c.WriteError(err.Error())
+			return
+		}
+		if version == 0 {
+			c.WriteNull()
+			return
+		}
+
+		c.WriteArray(2)
+		c.WriteInt64(int64(version))
+		c.WriteBulkString(state)
+	default:
+		c.WriteError("SNAPSHOT subcommand must be one of SAVE, LOAD")
+	}
+}
+
+// Save - saves the state of the stream as of the version, the version must be written
+// already and a snapshot at a later version is kept rather than replaced
+func Save(db store.DB, stream string, version uint64, state string) error {
+	saveMu.Lock()
+	defer saveMu.Unlock()
+
+	head, err := db.Head(store.StreamID(stream))
+	if err != nil {
+		return err
+	}
+	if version > head {
+		return fmt.Errorf("version %d is past the head of the stream at %d", version, head)
+	}
+
+	saved, _, err := load(db, stream)
+	if err != nil {
+		return err
+	}
+	if saved > version {
+		return fmt.Errorf("version %d is behind the saved snapshot at %d", version, saved)
+	}
+
+	return db.SetMeta(store.SnapshotNamespace, stream, string(store.EncodeVersion(version))+state)
+}
+
+// Load - the latest snapshot of the stream and its version, version 0 when there is none or
+// the events it was taken from are soft deleted
+func Load(db store.DB, stream string) (uint64, string, error) {
+	version, state, err := load(db, stream)
+	if err != nil || version == 0 {
+		return 0, "", err
+	}
+
+	deleted, err := streammeta.Deleted(db, stream)
+	if err != nil {
+		return 0, "", err
+	}
+	if version <= deleted {
+		return 0, "", nil
+	}
+
+	return version, state, nil
+}
+
+// load - the stored snapshot, the version followed by the state
+func load(db store.DB, stream string) (uint64, string, error) {
+	v, err := db.GetMeta(store.SnapshotNamespace, stream)
+	if errors.Is(err, store.ErrNotFound) {
+		return 0, "", nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+
+	if len(v) < store.VersionSize {
+		return 0, "", fmt.Errorf("unable to load snapshot of %s", stream)
+	}
+	version, err := store.DecodeVersion([]byte(v[:store.VersionSize]))
+	if err != nil {
+		return 0, "", fmt.Errorf("unable to load snapshot of %s: %v", stream, err)
+	}
+
+	return version, v[store.VersionSize:], nil
+}
@@ -0,0 +1,154 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package snapshot_test
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/maarek/aves/client"
+	"github.com/maarek/aves/commands/snapshot"
+	"github.com/maarek/aves/server/servertest"
+	"github.com/maarek/aves/store"
+	"github.com/maarek/aves/store/storetest"
+)
+
+// publish - appends the events to the stream
+func publish(t *testing.T, c *client.Context, stream string, data ...string) {
+	t.Helper()
+
+	for _, d := range data {
+		if _, err := c.Publish(stream, "ANY", d); err != nil {
+			t.Fatalf("publish failed: %v", err)
+		}
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	c := servertest.Client(t)
+	stream := servertest.Name()
+
+	if s, err := c.SnapshotLoad(stream); err != nil || s != nil {
+		t.Fatalf("expected no snapshot, got %+v %v", s, err)
+	}
+
+	// the version must be written already
+	if ok, err := c.SnapshotSave(stream, 1, `{"total": 1}`); ok || err == nil || !strings.Contains(err.Error(), "past the head") {
+		t.Fatalf("expected a snapshot past the head to be rejected, got %v", err)
+	}
+
+	publish(t, c, stream, "1", "2", "3")
+	for _, v := range []int{1, 2, 2} {
+		if ok, err := c.SnapshotSave(stream, v, `{"total": `+strconv.Itoa(v)+`}`); !ok || err != nil {
+			t.Fatalf("expected the snapshot at %d to be saved, got %v", v, err)
+		}
+	}
+	if s, err := c.SnapshotLoad(stream); err != nil || s == nil || s.Version != 2 || s.State != `{"total": 2}` {
+		t.Fatalf("expected the snapshot at 2, got %+v %v", s, err)
+	}
+
+	// a snapshot at a later version is kept rather than replaced
+	if ok, err := c.SnapshotSave(stream, 1, `{"total": 1}`); ok || err == nil || !strings.Contains(err.Error(), "behind the saved snapshot") {
+		t.Fatalf("expected an older snapshot to be rejected, got %v", err)
+	}
+	if s, err := c.SnapshotLoad(stream); err != nil || s == nil || s.Version != 2 {
+		t.Fatalf("expected the snapshot at 2 to be kept, got %+v %v", s, err)
+	}
+
+	// the state is stored as is, empty included
+	if ok, err := c.SnapshotSave(stream, 3, ""); !ok || err != nil {
+		t.Fatalf("expected an empty snapshot to be saved, got %v", err)
+	}
+	if s, err := c.SnapshotLoad(stream); err != nil || s == nil || s.Version != 3 || s.State != "" {
+		t.Fatalf("expected the empty snapshot at 3, got %+v %v", s, err)
+	}
+
+	conn := servertest.Dial(t)
+	for _, args := range [][]interface{}{
+		{"SAVE"},
+		{"SAVE", stream, "3"},
+		{"SAVE", stream, "0", "{}"},
+		{"SAVE", stream, "-1", "{}"},
+		{"SAVE", stream, "x", "{}"},
+		{"SAVE", stream, "3", "{}", "{}"},
+		{"DROP", stream},
+	} {
+		if _, err := conn.Do("SNAPSHOT", args...); err == nil {
+			t.Fatalf("expected SNAPSHOT %v to be rejected", args)
+		}
+	}
+}
+
+func TestSnapshotDeleted(t *testing.T) {
+	c := servertest.Client(t)
+	stream := servertest.Name()
+
+	publish(t, c, stream, "1", "2")
+	if ok, err := c.SnapshotSave(stream, 2, "{}"); !ok || err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+
+	// the snapshot is hidden with the events it was taken from
+	if ok, err := c.Delete(stream); !ok || err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if s, err := c.SnapshotLoad(stream); err != nil || s != nil {
+		t.Fatalf("expected the snapshot to be hidden, got %+v %v", s, err)
+	}
+
+	// and a new one is saved once the stream is written again
+	publish(t, c, stream, "3")
+	if ok, err := c.SnapshotSave(stream, 3, `{"n": 3}`); !ok || err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+	if s, err := c.SnapshotLoad(stream); err != nil || s == nil || s.Version != 3 || s.State != `{"n": 3}` {
+		t.Fatalf("expected the snapshot at 3, got %+v %v", s, err)
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	db := storetest.OpenMemory(t)
+	storetest.AppendEvents(t, db, "order-1", 2)
+
+	if version, state, err := snapshot.Load(db, "order-1"); err != nil || version != 0 || state != "" {
+		t.Fatalf("expected no snapshot, got %d %q %v", version, state, err)
+	}
+	if err := snapshot.Save(db, "order-1", 2, `{"total": 2}`); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+	if version, state, err := snapshot.Load(db, "order-1"); err != nil || version != 2 || state != `{"total": 2}` {
+		t.Fatalf("expected the snapshot at 2, got %d %q %v", version, state, err)
+	}
+
+	// the snapshot is stored in its own namespace, version first
+	v, err := db.GetMeta(store.SnapshotNamespace, "order-1")
+	if err != nil || v != string(store.EncodeVersion(2))+`{"total": 2}` {
+		t.Fatalf("unexpected stored snapshot %q %v", v, err)
+	}
+
+	// a stored value too short to hold a version is reported
+	if err := db.SetMeta(store.SnapshotNamespace, "order-1", "x"); err != nil {
+		t.Fatalf("set failed: %v", err)
+	}
+	if _, _, err := snapshot.Load(db, "order-1"); err == nil {
+		t.Fatal("expected a corrupt snapshot to be reported")
+	}
+	if err := snapshot.Save(db, "order-1", 1, "{}"); err == nil {
+		t.Fatal("expected saving over a corrupt snapshot to be reported")
+	}
+}
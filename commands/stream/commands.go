@@ -17,77 +17,428 @@
 package stream
 
 import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+
 	cmds "github.com/maarek/aves/commands"
+	"github.com/maarek/aves/commands/pubsub"
 	"github.com/maarek/aves/store"
+	"github.com/maarek/aves/streammeta"
 	"github.com/oklog/ulid/v2"
 )
 
-// DeleteCommand - DELETE <stream>
+const (
+	// DeletedStream - the stream recording every deleted stream, its events are also
+	// published to the subscribers of the stream deleted
+	DeletedStream = "$deleted"
+	// DeletedEventType - the type of the events recording a deleted stream
+	DeletedEventType = "$streamDeleted"
+)
+
+// deletion - the event recording a deleted stream and the version it was deleted at
+type deletion struct {
+	Stream  string `json:"stream"`
+	Version uint64 `json:"version"`
+	Hard    bool   `json:"hard"`
+}
+
+// DeleteCommand - DELETE <stream> [<stream> ...] [SOFT | HARD]
+// A hard delete, the default, removes the events of the streams and rejects further appends.
+// A soft delete hides the events of the streams until they are restored with UNDELETE and
+// appends carry on after them.
 func DeleteCommand(c *cmds.Context) {
 	if len(c.Args) < 1 {
-		c.WriteError("DELETE command must have at least 1 argument: DEL <stream> [<key2> ...]")
+		c.WriteError("DELETE command must have at least 1 argument: DELETE <stream> [<stream> ...] [SOFT | HARD]")
 		return
 	}
 
-	keys := make([]string, len(c.Args))
-	for i, arg := range c.Args {
-		keys[i] = string(arg)
+	// a single argument is always a stream
+	args := c.Args
+	hard := true
+	if len(args) > 1 {
+		switch strings.ToUpper(string(args[len(args)-1])) {
+		case "SOFT":
+			hard = false
+			args = args[:len(args)-1]
+		case "HARD":
+			args = args[:len(args)-1]
+		}
 	}
 
-	if err := c.DB.Del(keys); err != nil {
+	streams := make([]string, len(args))
+	for i, arg := range args {
+		if len(arg) == 0 {
+			c.WriteError("DELETE stream must not be empty")
+			return
+		}
+		streams[i] = string(arg)
+	}
+
+	var deleted map[string]uint64
+	var err error
+	if hard {
+		deleted, err = c.DB.Del(streams)
+	} else {
+		deleted, err = softDelete(c.DB, streams)
+	}
+	if err != nil {
 		c.WriteError(err.Error())
 		return
 	}
 
+	// the deletions are recorded in the order the streams were given, the streams are deleted
+	// by now so a deletion that fails to be recorded is logged rather than failing the command
+	for _, stream := range streams {
+		version, ok := deleted[stream]
+		if !ok {
+			continue
+		}
+		delete(deleted, stream)
+
+		v, err := json.Marshal(deletion{Stream: stream, Version: version, Hard: hard})
+		if err == nil {
+			e := store.Event{
+				Type:        DeletedEventType,
+				ContentType: "application/json",
+				Data:        string(v),
+			}
+			_, err = pubsub.AppendEvent(c, store.StreamID(DeletedStream), e, stream)
+		}
+		if err != nil {
+			log.Printf("unable to record the deletion of %s: %v", stream, err)
+		}
+	}
+
 	c.WriteString("OK")
 }
 
-// ExistsCommand - EXISTS <stream>
+// softDelete - soft deletes the streams that have events not deleted yet, returning the
+// head each of them was deleted at
+func softDelete(db store.DB, streams []string) (map[string]uint64, error) {
+	deleted := make(map[string]uint64)
+	for _, stream := range streams {
+		head, err := db.Head(store.StreamID(stream))
+		if err != nil {
+			return nil, err
+		}
+		if head == 0 {
+			continue
+		}
+
+		version, err := streammeta.Deleted(db, stream)
+		if err != nil {
+			return nil, err
+		}
+		if version == head {
+			continue
+		}
+
+		if deleted[stream], err = streammeta.SoftDelete(db, stream); err != nil {
+			return nil, err
+		}
+	}
+	return deleted, nil
+}
+
+// UndeleteCommand - UNDELETE <stream>
+func UndeleteCommand(c *cmds.Context) {
+	if len(c.Args) != 1 {
+		c.WriteError("UNDELETE command must have 1 argument: UNDELETE <stream>")
+		return
+	}
+
+	restored, err := streammeta.Restore(c.DB, string(c.Args[0]))
+	if err != nil {
+		c.WriteError(err.Error())
+		return
+	}
+
+	if restored {
+		c.WriteInt(1)
+		return
+	}
+	c.WriteInt(0)
+}
+
+// the deletion states of a stream replied by EXISTS WITHSTATE
+const (
+	// StateNone - no event was written to the stream
+	StateNone = "none"
+	// StateActive - the stream is not deleted
+	StateActive = "active"
+	// StateDeleted - the events of the stream up to its head are soft deleted
+	StateDeleted = "deleted"
+	// StateTombstoned - the stream was hard deleted
+	StateTombstoned = "tombstoned"
+)
+
+// ExistsCommand - EXISTS [WITHSTATE] <stream> [<stream> ...]
+// Replies with the number of streams given that have events to read, a stream given twice
+// is counted twice like the Redis EXISTS command. With WITHSTATE it replies with whether each
+// stream exists, its head version and its deletion state instead.
 func ExistsCommand(c *cmds.Context) {
-	if len(c.Args) < 1 {
-		c.WriteError("EXISTS command must have at least 1 argument: EXISTS <stream>")
+	// a single argument is always a stream
+	args := c.Args
+	withState := len(args) > 1 && strings.EqualFold(string(args[0]), "WITHSTATE")
+	if withState {
+		args = args[1:]
+	}
+
+	if len(args) < 1 {
+		c.WriteError("EXISTS command must have at least 1 argument: EXISTS [WITHSTATE] <stream> [<stream> ...]")
 		return
 	}
 
-	key := store.Key{
-		ID:      ulid.ULID{},
-		Stream:  store.StreamID(c.Args[0]),
-		Version: []byte{},
+	statuses := make([]status, len(args))
+	for i, stream := range args {
+		var err error
+		if statuses[i], err = streamStatus(c.DB, string(stream)); err != nil {
+			c.WriteError(err.Error())
+			return
+		}
 	}
 
-	// TODO: This needs a Scan with Badger but a Get for Bucket is fine with Bolt
-	_, err := c.DB.Get(key)
-	if err != nil {
-		c.WriteInt(0)
+	if !withState {
+		count := 0
+		for _, s := range statuses {
+			if s.exists {
+				count++
+			}
+		}
+		c.WriteInt(count)
 		return
 	}
 
-	c.WriteInt(1)
+	FIELDS := 3
+	c.WriteArray(len(statuses) * FIELDS)
+	for _, s := range statuses {
+		if s.exists {
+			c.WriteInt(1)
+		} else {
+			c.WriteInt(0)
+		}
+		c.WriteInt64(int64(s.head))
+		c.WriteBulkString(s.state)
+	}
+}
+
+// status - whether a stream has events to read, its head version and its deletion state
+type status struct {
+	exists bool
+	head   uint64
+	state  string
+}
+
+// streamStatus - reads the status of the stream from the catalog, a stream truncated or
+// scavenged down to no events or soft deleted up to its head does not exist
+func streamStatus(db store.DB, stream string) (status, error) {
+	info, err := store.LoadStreamInfo(db, store.StreamID(stream))
+	if errors.Is(err, store.ErrNotFound) {
+		// the catalog record is removed along with the events of a hard deleted stream
+		_, err = db.GetMeta(store.TombstoneNamespace, stream)
+		if errors.Is(err, store.ErrNotFound) {
+			return status{state: StateNone}, nil
+		}
+		return status{state: StateTombstoned}, err
+	}
+	if err != nil {
+		return status{}, err
+	}
+
+	deleted, err := streammeta.Deleted(db, stream)
+	if err != nil {
+		return status{}, err
+	}
+
+	s := status{
+		exists: info.Count > 0 && info.Head > deleted,
+		head:   info.Head,
+		state:  StateActive,
+	}
+	if deleted > 0 && deleted == info.Head {
+		s.state = StateDeleted
+	}
+
+	return s, nil
 }
 
-// ListCommand - SLIST
+// DefaultListCount - the number of streams SLIST looks at for a page when COUNT is not given
+const DefaultListCount = 10
+
+// ListCommand - SLIST [CURSOR <cursor>] [MATCH <pattern>] [COUNT <count>]
+// Each stream is replied with its name, event count, head version, size in bytes and the unix
+// times in milliseconds of the first and last event written, read from the catalog.
+// Without options every stream is replied at once, otherwise a page of the streams is replied
+// after the cursor to pass for the next page, like the Redis SCAN command. A page starts at
+// cursor 0 and the cursor replied is 0 after the last page.
 func ListCommand(c *cmds.Context) {
-	// TODO: Logic does not hold for all data stores
-	data := make(map[string]int)
-
-	err := c.DB.Scan(store.ScannerOptions{
-		FetchValues:   false,
-		IncludeOffset: true,
-		Handler: func(k store.Key, _ string) bool {
-			data[string(k.Stream)]++
-			return true
-		},
-	})
+	if len(c.Args) == 0 {
+		streams, infos, _, err := listStreams(c.DB, nil, "*", 0)
+		if err != nil {
+			c.WriteError(err.Error())
+			return
+		}
+		writeStreams(c, streams, infos)
+		return
+	}
+
+	cursor := "0"
+	pattern := "*"
+	count := DefaultListCount
+	for i := 0; i < len(c.Args); i += 2 {
+		option := strings.ToUpper(string(c.Args[i]))
+		if i+1 == len(c.Args) {
+			c.WriteError("SLIST option " + option + " must have a value")
+			return
+		}
+
+		value := string(c.Args[i+1])
+		switch option {
+		case "CURSOR":
+			cursor = value
+		case "MATCH":
+			pattern = value
+		case "COUNT":
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				c.WriteError("SLIST COUNT must be a positive integer")
+				return
+			}
+			count = n
+		default:
+			c.WriteError("SLIST option must be one of CURSOR, MATCH, COUNT")
+			return
+		}
+	}
+
+	// the cursor is the hex encoded name of the next stream to look at
+	var from []byte
+	if cursor != "0" {
+		var err error
+		if from, err = hex.DecodeString(cursor); err != nil || len(from) == 0 {
+			c.WriteError("SLIST invalid cursor")
+			return
+		}
+	}
 
+	streams, infos, next, err := listStreams(c.DB, from, pattern, count)
 	if err != nil {
 		c.WriteError(err.Error())
 		return
 	}
 
-	FIELDS := 2
-	c.WriteArray(len(data) * FIELDS)
-	for k, size := range data {
-		c.WriteBulkString(k)
-		c.WriteInt(size)
+	c.WriteArray(2)
+	if next == nil {
+		c.WriteBulkString("0")
+	} else {
+		c.WriteBulkString(hex.EncodeToString(next))
+	}
+	writeStreams(c, streams, infos)
+}
+
+// listStreams - looks at up to count streams of the catalog from the one given, any number when
+// count is 0, and collects those matching the pattern along with the next stream to look at,
+// nil when there are no more
+func listStreams(db store.DB, from []byte, pattern string, count int) ([]store.StreamID, []store.StreamInfo, store.StreamID, error) {
+	// streams not starting with the literal start of the pattern can not match it
+	prefix := pattern
+	if i := strings.IndexAny(pattern, "*?[\\"); i >= 0 {
+		prefix = pattern[:i]
+	}
+	if bytes.Compare(from, []byte(prefix)) < 0 {
+		from = []byte(prefix)
+	}
+
+	var streams []store.StreamID
+	var infos []store.StreamInfo
+	var next store.StreamID
+	seen := 0
+
+	err := store.ScanStreams(db, from, func(stream store.StreamID, info store.StreamInfo) bool {
+		if !bytes.HasPrefix(stream, []byte(prefix)) {
+			return false
+		}
+		if count > 0 && seen == count {
+			next = stream
+			return false
+		}
+		seen++
+
+		if store.MatchGlob(pattern, string(stream)) {
+			streams = append(streams, stream)
+			infos = append(infos, info)
+		}
+		return true
+	})
+
+	return streams, infos, next, err
+}
+
+// writeStreams - writes the fields of each stream in a flat array
+func writeStreams(c *cmds.Context, streams []store.StreamID, infos []store.StreamInfo) {
+	FIELDS := 6
+	c.WriteArray(len(streams) * FIELDS)
+	for i, stream := range streams {
+		c.WriteBulk(stream)
+		c.WriteInt64(int64(infos[i].Count))
+		c.WriteInt64(int64(infos[i].Head))
+		c.WriteInt64(infos[i].Size)
+		c.WriteInt64(int64(ulid.Timestamp(infos[i].Created)))
+		c.WriteInt64(int64(ulid.Timestamp(infos[i].Updated)))
+	}
+}
+
+// MetaCommand - SMETA SET <stream> <metadata> | SMETA GET <stream>
+// where the metadata is a JSON object, see the streammeta package for the reserved keys
+func MetaCommand(c *cmds.Context) {
+	if len(c.Args) < 2 {
+		c.WriteError("SMETA command must have at least 2 arguments: SMETA SET <stream> <metadata> | SMETA GET <stream>")
+		return
+	}
+
+	stream := string(c.Args[1])
+	if len(stream) == 0 {
+		c.WriteError("SMETA stream must not be empty")
+		return
+	}
+
+	switch strings.ToUpper(string(c.Args[0])) {
+	case "SET":
+		if len(c.Args) != 3 {
+			c.WriteError("SMETA SET must have 2 arguments: SMETA SET <stream> <metadata>")
+			return
+		}
+
+		m, err := streammeta.Parse(c.Args[2])
+		if err != nil {
+			c.WriteError("SMETA " + err.Error())
+			return
+		}
+
+		if err := streammeta.Save(c.DB, stream, m); err != nil {
+			c.WriteError(err.Error())
+			return
+		}
+
+		c.WriteString("OK")
+	case "GET":
+		v, err := c.DB.GetMeta(store.StreamMetaNamespace, stream)
+		if errors.Is(err, store.ErrNotFound) {
+			c.WriteNull()
+			return
+		}
+		if err != nil {
+			c.WriteError(err.Error())
+			return
+		}
+
+		c.WriteBulkString(v)
+	default:
+		c.WriteError("SMETA subcommand must be one of SET, GET")
 	}
 }
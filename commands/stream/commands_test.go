@@ -0,0 +1,209 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stream_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/maarek/aves/client"
+	"github.com/maarek/aves/server/servertest"
+)
+
+// streamInfo - the SLIST entry of the stream
+func streamInfo(t *testing.T, c *client.Context, stream string) client.Stream {
+	t.Helper()
+
+	it := c.SListIterator(stream, 100)
+	for it.Next() {
+		if it.Stream().StreamID == stream {
+			return it.Stream()
+		}
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("slist failed: %v", err)
+	}
+	t.Fatalf("expected %s to be listed", stream)
+	return client.Stream{}
+}
+
+func TestHardDeleteLinks(t *testing.T) {
+	c := servertest.Client(t)
+	category := servertest.Name()
+	a, b := category+"-a", category+"-b"
+
+	for _, e := range []struct{ stream, data string }{{a, "a1"}, {b, "b1"}, {a, "a2"}} {
+		if _, err := c.PublishEvent(e.stream, "", e.data, client.Envelope{Type: category}); err != nil {
+			t.Fatalf("publish failed: %v", err)
+		}
+	}
+
+	if ok, err := c.HardDelete(a); !ok || err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+
+	// the links to the events deleted are removed but for the head of the link stream,
+	// which reads skip
+	for _, stream := range []string{"$ce-" + category, "$et-" + category} {
+		events, err := c.EList(stream, "0", "")
+		if err != nil || len(events) != 1 || events[0].Data != "b1" || events[0].Version != 2 {
+			t.Fatalf("expected only the link to b1 in %s, got %+v %v", stream, events, err)
+		}
+		if info := streamInfo(t, c, stream); info.EventCount != 2 || info.Head != 3 {
+			t.Fatalf("expected %s to count the links kept, got %+v", stream, info)
+		}
+	}
+
+	// the deletion is recorded
+	events, err := c.EList("$deleted", "0", "")
+	if err != nil {
+		t.Fatalf("elist failed: %v", err)
+	}
+	var recorded bool
+	for _, e := range events {
+		var d struct {
+			Stream  string `json:"stream"`
+			Version int    `json:"version"`
+			Hard    bool   `json:"hard"`
+		}
+		if err := json.Unmarshal([]byte(e.Data), &d); err == nil && d.Stream == a {
+			recorded = d.Version == 2 && d.Hard
+		}
+	}
+	if !recorded {
+		t.Fatalf("expected the hard delete of %s at version 2 to be recorded", a)
+	}
+}
+
+func TestDeleteUnrecorded(t *testing.T) {
+	// the deletions of this server cannot be recorded once $deleted is tombstoned
+	conn := servertest.DialAddr(t, servertest.Start(t))
+
+	if _, err := conn.Do("PUBLISH", "order-1", "{}"); err != nil {
+		t.Fatalf("publish failed: %v", err)
+	}
+	if _, err := conn.Do("DELETE", "$deleted"); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+
+	for _, mode := range []string{"SOFT", "HARD"} {
+		if v, err := conn.Do("DELETE", "order-1", mode); err != nil || fmt.Sprint(v) != "OK" {
+			t.Fatalf("expected the %s delete to succeed, got %v %v", mode, v, err)
+		}
+	}
+	if n, err := conn.Do("EXISTS", "order-1"); err != nil || n != int64(0) {
+		t.Fatalf("expected order-1 to be deleted, got %v %v", n, err)
+	}
+}
+
+func TestExists(t *testing.T) {
+	c := servertest.Client(t)
+	a, b, missing := servertest.Name(), servertest.Name(), servertest.Name()
+
+	for _, stream := range []string{a, b} {
+		if _, err := c.Publish(stream, "ANY", "{}"); err != nil {
+			t.Fatalf("publish failed: %v", err)
+		}
+	}
+
+	// the streams that exist are counted, a stream given twice is counted twice
+	for _, tc := range []struct {
+		streams []string
+		count   int
+	}{
+		{[]string{a}, 1},
+		{[]string{missing}, 0},
+		{[]string{a, b, missing}, 2},
+		{[]string{a, a, missing, a}, 3},
+	} {
+		if n, err := c.ExistsCount(tc.streams...); err != nil || n != tc.count {
+			t.Fatalf("expected %v to count %d, got %d %v", tc.streams, tc.count, n, err)
+		}
+	}
+
+	// WITHSTATE comes first, a single argument and a trailing one are streams
+	conn := servertest.Dial(t)
+	for _, tc := range []struct {
+		args []interface{}
+		want string
+	}{
+		{[]interface{}{"WITHSTATE"}, "0"},
+		{[]interface{}{"withstate", a}, "[1 1 active]"},
+		{[]interface{}{a, "WITHSTATE"}, "1"},
+		{[]interface{}{"WITHSTATE", a, a}, "[1 1 active 1 1 active]"},
+		{[]interface{}{"WITHSTATE", "WITHSTATE"}, "[0 0 none]"},
+	} {
+		v, err := conn.Do("EXISTS", tc.args...)
+		if values, ok := v.([]interface{}); ok {
+			for i, value := range values {
+				if b, ok := value.([]byte); ok {
+					values[i] = string(b)
+				}
+			}
+		}
+		if err != nil || fmt.Sprint(v) != tc.want {
+			t.Fatalf("expected EXISTS %v to reply %s, got %v %v", tc.args, tc.want, v, err)
+		}
+	}
+	if _, err := conn.Do("EXISTS"); err == nil {
+		t.Fatal("expected EXISTS without a stream to be rejected")
+	}
+}
+
+func TestExistsStates(t *testing.T) {
+	c := servertest.Client(t)
+	active, deleted, restored, tombstoned, missing := servertest.Name(), servertest.Name(), servertest.Name(), servertest.Name(), servertest.Name()
+
+	for _, stream := range []string{active, deleted, restored, tombstoned} {
+		for i := 0; i < 2; i++ {
+			if _, err := c.Publish(stream, "ANY", "{}"); err != nil {
+				t.Fatalf("publish failed: %v", err)
+			}
+		}
+	}
+	for _, stream := range []string{deleted, restored} {
+		if ok, err := c.Delete(stream); !ok || err != nil {
+			t.Fatalf("delete failed: %v", err)
+		}
+	}
+	// an event published after a soft delete is visible
+	if _, err := c.Publish(restored, "ANY", "{}"); err != nil {
+		t.Fatalf("publish failed: %v", err)
+	}
+	if ok, err := c.HardDelete(tombstoned); !ok || err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+
+	states, err := c.StreamStates(active, deleted, restored, tombstoned, missing)
+	if err != nil {
+		t.Fatalf("exists failed: %v", err)
+	}
+	want := []client.StreamState{
+		{StreamID: active, Exists: true, Head: 2, State: "active"},
+		{StreamID: deleted, Exists: false, Head: 2, State: "deleted"},
+		{StreamID: restored, Exists: true, Head: 3, State: "active"},
+		{StreamID: tombstoned, Exists: false, Head: 0, State: "tombstoned"},
+		{StreamID: missing, Exists: false, Head: 0, State: "none"},
+	}
+	if fmt.Sprint(states) != fmt.Sprint(want) {
+		t.Fatalf("expected %+v, got %+v", want, states)
+	}
+	if n, err := c.ExistsCount(active, deleted, restored, tombstoned, missing); err != nil || n != 2 {
+		t.Fatalf("expected 2 streams to exist, got %d %v", n, err)
+	}
+}
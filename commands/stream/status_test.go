@@ -0,0 +1,59 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stream
+
+import (
+	"testing"
+
+	"github.com/maarek/aves/store"
+	"github.com/maarek/aves/store/storetest"
+	"github.com/maarek/aves/streammeta"
+)
+
+func TestStreamStatus(t *testing.T) {
+	db := storetest.OpenMemory(t)
+	storetest.AppendEvents(t, db, "order-1", 3)
+	storetest.AppendEvents(t, db, "order-2", 3)
+	storetest.AppendEvents(t, db, "order-3", 3)
+
+	// truncated down to no events, the head is kept
+	if err := db.Truncate(store.StreamID("order-1"), 4); err != nil {
+		t.Fatalf("truncate failed: %v", err)
+	}
+	// truncated with events left to read
+	if err := db.Truncate(store.StreamID("order-2"), 3); err != nil {
+		t.Fatalf("truncate failed: %v", err)
+	}
+	// soft deleted and truncated
+	if _, err := streammeta.SoftDelete(db, "order-3"); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if err := db.Truncate(store.StreamID("order-3"), 3); err != nil {
+		t.Fatalf("truncate failed: %v", err)
+	}
+
+	for stream, want := range map[string]status{
+		"order-1": {exists: false, head: 3, state: StateActive},
+		"order-2": {exists: true, head: 3, state: StateActive},
+		"order-3": {exists: false, head: 3, state: StateDeleted},
+		"order-4": {exists: false, head: 0, state: StateNone},
+	} {
+		if s, err := streamStatus(db, stream); err != nil || s != want {
+			t.Errorf("expected %s to be %+v, got %+v %v", stream, want, s, err)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package consumer implements competing consumer groups. The events of the
+// streams matched by a group are handed out to whichever member reads next
+// and handed out again when they are not acknowledged in time. Only the
+// checkpoint of a group is stored, events read but not acknowledged before a
+// restart are delivered again.
+package consumer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/maarek/aves/oplog"
+	"github.com/maarek/aves/store"
+	"github.com/oklog/ulid/v2"
+)
+
+var (
+	// ErrGroupExists - returned when creating a group that already exists
+	ErrGroupExists = errors.New("group already exists")
+	// ErrNoGroup - returned when using a group that does not exist
+	ErrNoGroup = errors.New("group does not exist")
+)
+
+// Event - an event handed out to a member of a group
+type Event struct {
+	Key   store.Key
+	Value string
+
+	// the number of times the event has been handed out, including this one
+	Deliveries int
+}
+
+// Position - identifies an event handed out by a group. Links share the position of the
+// event they link to, the stream read tells apart the events at a position and no
+// stream stands for every event at the position.
+type Position struct {
+	ID     ulid.ULID
+	Stream store.StreamID
+}
+
+// state - the part of a group that is stored
+type state struct {
+	Pattern    string    `json:"pattern"`
+	Checkpoint ulid.ULID `json:"checkpoint"`
+}
+
+// delivery - an event read from the store that has not been acknowledged
+type delivery struct {
+	Event
+
+	consumer string
+	deadline time.Time
+	acked    bool
+}
+
+// Group - a consumer group reading the streams matching its pattern
+type Group struct {
+	db   store.DB
+	name string
+
+	mu      sync.Mutex
+	pattern string
+
+	// every event up to the checkpoint has been acknowledged
+	checkpoint ulid.ULID
+	// the last position of the index read from the store, every event at it has been read
+	cursor ulid.ULID
+	// events read from the store and not acknowledged in position order
+	pending []*delivery
+}
+
+// Registry - the consumer groups of a store, loaded when first used
+type Registry struct {
+	db store.DB
+
+	mu     sync.Mutex
+	groups map[string]*Group
+}
+
+// NewRegistry - creates the registry of the groups stored in the db
+func NewRegistry(db store.DB) *Registry {
+	return &Registry{
+		db:     db,
+		groups: make(map[string]*Group),
+	}
+}
+
+// Create - creates a group reading the streams matching the pattern after the position,
+// the zero position reads every event
+func (r *Registry) Create(name, pattern string, position ulid.ULID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, err := r.db.GetMeta(store.GroupNamespace, name)
+	if err == nil {
+		return ErrGroupExists
+	}
+	if !errors.Is(err, store.ErrNotFound) {
+		return err
+	}
+
+	g := &Group{
+		db:         r.db,
+		name:       name,
+		pattern:    pattern,
+		checkpoint: position,
+		cursor:     position,
+	}
+	if err := g.save(); err != nil {
+		return err
+	}
+
+	r.groups[name] = g
+
+	return nil
+}
+
+// Get - fetches a group, loading it from the store when it is first used
+func (r *Registry) Get(name string) (*Group, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if g, ok := r.groups[name]; ok {
+		return g, nil
+	}
+
+	v, err := r.db.GetMeta(store.GroupNamespace, name)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, ErrNoGroup
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var s state
+	if err := json.Unmarshal([]byte(v), &s); err != nil {
+		return nil, fmt.Errorf("unable to load group %s: %v", name, err)
+	}
+
+	g := &Group{
+		db:         r.db,
+		name:       name,
+		pattern:    s.Pattern,
+		checkpoint: s.Checkpoint,
+		cursor:     s.Checkpoint,
+	}
+	r.groups[name] = g
+
+	return g, nil
+}
+
+// save - stores the pattern and checkpoint of the group
+func (g *Group) save() error {
+	v, err := json.Marshal(state{
+		Pattern:    g.pattern,
+		Checkpoint: g.checkpoint,
+	})
+	if err != nil {
+		return err
+	}
+
+	return g.db.SetMeta(store.GroupNamespace, g.name, string(v))
+}
+
+// Checkpoint - the position up to which every event of the group has been acknowledged
+func (g *Group) Checkpoint() ulid.ULID {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.checkpoint
+}
+
+// Read - hands out up to count events to the consumer that no other member holds, events
+// not acknowledged within the visibility timeout are handed out again
+func (g *Group) Read(consumer string, count int, visibility time.Duration) ([]Event, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	deadline := now.Add(visibility)
+
+	var events []Event
+	handOut := func(d *delivery) {
+		d.consumer = consumer
+		d.deadline = deadline
+		d.Deliveries++
+		events = append(events, d.Event)
+	}
+
+	// events that were never acknowledged go first to keep the group in position order
+	for _, d := range g.pending {
+		if len(events) == count {
+			return events, nil
+		}
+		if d.acked || (d.consumer != "" && now.Before(d.deadline)) {
+			continue
+		}
+		handOut(d)
+	}
+
+	if len(events) == count {
+		return events, nil
+	}
+
+	fetched, err := g.fetch(count - len(events))
+	if err != nil {
+		return nil, err
+	}
+
+	// events fetched past the count are held back for the next read
+	for _, d := range fetched {
+		g.pending = append(g.pending, d)
+		if len(events) < count {
+			handOut(d)
+		}
+	}
+
+	return events, nil
+}
+
+// fetch - reads at least count events of the group from the index after the cursor when
+// there are enough, every event at the last position read is fetched along with it
+func (g *Group) fetch(count int) ([]*delivery, error) {
+	var fetched []*delivery
+
+	opts := store.ScannerOptions{
+		Index:       true,
+		FetchValues: true,
+		Handler: func(k store.Key, v string) bool {
+			// the fetch stops at the next position, the cursor only moves past positions read whole
+			if len(fetched) >= count && k.ID != g.cursor {
+				return false
+			}
+			g.cursor = k.ID
+			// a group of every stream reads the events linked to already
+			if g.pattern == oplog.Wildcard && store.IsLink(v) {
+				return true
+			}
+			if oplog.Match(g.pattern, string(k.Stream)) {
+				fetched = append(fetched, &delivery{Event: Event{Key: k, Value: v}})
+			}
+			return true
+		},
+	}
+	if g.cursor != (ulid.ULID{}) {
+		opts.Offset = g.cursor[:]
+	}
+
+	if err := g.db.Scan(opts); err != nil {
+		return nil, err
+	}
+
+	return fetched, nil
+}
+
+// Ack - acknowledges the events at the positions, moving the checkpoint past every
+// event acknowledged in order. Returns the number of events acknowledged.
+func (g *Group) Ack(positions ...Position) (int, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	acked := 0
+	for _, p := range positions {
+		for _, d := range g.find(p) {
+			if !d.acked {
+				d.acked = true
+				acked++
+			}
+		}
+	}
+
+	// drop the acknowledged events in front of the first event still pending
+	n := 0
+	for n < len(g.pending) && g.pending[n].acked {
+		n++
+	}
+	// the checkpoint is a position, it stays before a position with events still pending
+	for n > 0 && n < len(g.pending) && g.pending[n].Key.ID == g.pending[n-1].Key.ID {
+		n--
+	}
+	if n == 0 {
+		return acked, nil
+	}
+
+	g.checkpoint = g.pending[n-1].Key.ID
+	g.pending = g.pending[n:]
+	if len(g.pending) == 0 {
+		g.checkpoint = g.cursor
+	}
+
+	return acked, g.save()
+}
+
+// Nack - hands the events at the positions back to the group to be read again right away.
+// Returns the number of events handed back.
+func (g *Group) Nack(positions ...Position) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	nacked := 0
+	for _, p := range positions {
+		for _, d := range g.find(p) {
+			if !d.acked && d.consumer != "" {
+				d.consumer = ""
+				d.deadline = time.Time{}
+				nacked++
+			}
+		}
+	}
+
+	return nacked
+}
+
+// find - the pending events at the position
+func (g *Group) find(p Position) []*delivery {
+	i := sort.Search(len(g.pending), func(i int) bool {
+		return g.pending[i].Key.ID.Compare(p.ID) >= 0
+	})
+
+	var found []*delivery
+	for ; i < len(g.pending) && g.pending[i].Key.ID == p.ID; i++ {
+		if len(p.Stream) == 0 || bytes.Equal(g.pending[i].Key.Stream, p.Stream) {
+			found = append(found, g.pending[i])
+		}
+	}
+	return found
+}
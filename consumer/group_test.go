@@ -0,0 +1,213 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package consumer
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/maarek/aves/store"
+	"github.com/maarek/aves/store/storetest"
+	"github.com/oklog/ulid/v2"
+)
+
+func read(t *testing.T, g *Group, consumer string, count int, visibility time.Duration) []Event {
+	t.Helper()
+
+	events, err := g.Read(consumer, count, visibility)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	return events
+}
+
+func TestCompetingConsumers(t *testing.T) {
+	db := storetest.OpenMemory(t)
+	r := NewRegistry(db)
+
+	keys := storetest.AppendEvents(t, db, "order-1", 3)
+	storetest.AppendEvents(t, db, "user-1", 2)
+	keys = append(keys, storetest.AppendEvents(t, db, "order-2", 3)...)
+
+	if err := r.Create("billing", "order-*", ulid.ULID{}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	if err := r.Create("billing", "order-*", ulid.ULID{}); err != ErrGroupExists {
+		t.Fatalf("expected the group to exist, got %v", err)
+	}
+	if _, err := r.Get("missing"); err != ErrNoGroup {
+		t.Fatalf("expected no group, got %v", err)
+	}
+
+	g, err := r.Get("billing")
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+
+	// members are handed different events in position order
+	a := read(t, g, "a", 2, time.Minute)
+	b := read(t, g, "b", 3, time.Minute)
+	c := read(t, g, "c", 5, time.Minute)
+	if len(a) != 2 || len(b) != 3 || len(c) != 1 {
+		t.Fatalf("expected 2, 3 and 1 events, got %d, %d and %d", len(a), len(b), len(c))
+	}
+	for i, e := range append(append(a, b...), c...) {
+		if e.Key.ID != keys[i].ID || e.Deliveries != 1 {
+			t.Fatalf("expected event %s at %d, got %s", keys[i].ID, i, e.Key.ID)
+		}
+	}
+
+	// the checkpoint only moves past events acknowledged in order
+	if n, err := g.Ack(Position{ID: b[0].Key.ID}, Position{ID: a[1].Key.ID}); err != nil || n != 2 {
+		t.Fatalf("expected 2 acks, got %d %v", n, err)
+	}
+	if cp := g.Checkpoint(); cp != (ulid.ULID{}) {
+		t.Fatalf("expected the checkpoint to wait for the first event, got %s", cp)
+	}
+	if n, _ := g.Ack(Position{ID: a[0].Key.ID}, Position{ID: a[0].Key.ID}); n != 1 {
+		t.Fatalf("expected an event to be acknowledged once, got %d", n)
+	}
+	if cp := g.Checkpoint(); cp != b[0].Key.ID {
+		t.Fatalf("expected the checkpoint at %s, got %s", b[0].Key.ID, cp)
+	}
+
+	// a nacked event is handed out again right away
+	if n := g.Nack(Position{ID: b[1].Key.ID}); n != 1 {
+		t.Fatalf("expected 1 nack, got %d", n)
+	}
+	again := read(t, g, "c", 5, time.Minute)
+	if len(again) != 1 || again[0].Key.ID != b[1].Key.ID || again[0].Deliveries != 2 {
+		t.Fatalf("expected %s to be handed out again, got %v", b[1].Key.ID, again)
+	}
+}
+
+func TestVisibilityTimeout(t *testing.T) {
+	db := storetest.OpenMemory(t)
+	r := NewRegistry(db)
+
+	keys := storetest.AppendEvents(t, db, "order", 2)
+	if err := r.Create("billing", "order", ulid.ULID{}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	g, _ := r.Get("billing")
+
+	read(t, g, "a", 1, 10*time.Millisecond)
+	if e := read(t, g, "b", 1, time.Minute); len(e) != 1 || e[0].Key.ID != keys[1].ID {
+		t.Fatalf("expected the second event while the first is held, got %v", e)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	e := read(t, g, "b", 1, time.Minute)
+	if len(e) != 1 || e[0].Key.ID != keys[0].ID || e[0].Deliveries != 2 {
+		t.Fatalf("expected the first event to be redelivered, got %v", e)
+	}
+}
+
+func TestCheckpointIsStored(t *testing.T) {
+	db := storetest.OpenMemory(t)
+
+	keys := storetest.AppendEvents(t, db, "order", 4)
+	start := keys[0].ID
+
+	r := NewRegistry(db)
+	if err := r.Create("billing", "order", start); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	g, _ := r.Get("billing")
+
+	e := read(t, g, "a", 2, time.Minute)
+	if len(e) != 2 || e[0].Key.ID != keys[1].ID {
+		t.Fatalf("expected to read after the start position, got %v", e)
+	}
+	if _, err := g.Ack(Position{ID: e[0].Key.ID}); err != nil {
+		t.Fatalf("ack failed: %v", err)
+	}
+
+	// a restarted server delivers the events that were not acknowledged again
+	g, err := NewRegistry(db).Get("billing")
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	e = read(t, g, "a", 5, time.Minute)
+	if len(e) != 2 || e[0].Key.ID != keys[2].ID || e[1].Key.ID != keys[3].ID {
+		t.Fatalf("expected to resume after the checkpoint, got %v", e)
+	}
+
+	// once everything read is acknowledged the checkpoint is the last event read
+	if _, err := g.Ack(Position{ID: e[0].Key.ID}, Position{ID: e[1].Key.ID}); err != nil {
+		t.Fatalf("ack failed: %v", err)
+	}
+	if cp := g.Checkpoint(); cp != keys[3].ID {
+		t.Fatalf("expected the checkpoint at %s, got %s", keys[3].ID, cp)
+	}
+}
+
+func TestLinkedEvents(t *testing.T) {
+	db := storetest.OpenMemory(t)
+	r := NewRegistry(db)
+
+	// the links of an event share its position
+	var positions []ulid.ULID
+	for i := 0; i < 2; i++ {
+		v := store.EncodeEvent(store.Event{Type: "created", Data: "order"})
+		keys, _, err := db.AppendLinked(store.StreamID("order-1"), store.ExpectAny, []string{v}, store.SystemLinks)
+		if err != nil {
+			t.Fatalf("append failed: %v", err)
+		}
+		positions = append(positions, keys[0].ID)
+	}
+
+	if err := r.Create("links", "$*", ulid.ULID{}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	g, _ := r.Get("links")
+
+	// a read stopping within a position leaves the rest of it for the next read
+	a := read(t, g, "a", 1, time.Minute)
+	b := read(t, g, "b", 1, time.Minute)
+	if len(a) != 1 || len(b) != 1 || a[0].Key.ID != positions[0] || b[0].Key.ID != positions[0] ||
+		bytes.Equal(a[0].Key.Stream, b[0].Key.Stream) {
+		t.Fatalf("expected both links of the first event, got %v and %v", a, b)
+	}
+
+	// each link is acknowledged on its own
+	if n, err := g.Ack(Position{ID: a[0].Key.ID, Stream: a[0].Key.Stream}); err != nil || n != 1 {
+		t.Fatalf("expected 1 ack, got %d %v", n, err)
+	}
+	if cp := g.Checkpoint(); cp != (ulid.ULID{}) {
+		t.Fatalf("expected the checkpoint to wait for the second link, got %s", cp)
+	}
+	if n, err := g.Ack(Position{ID: b[0].Key.ID, Stream: b[0].Key.Stream}); err != nil || n != 1 {
+		t.Fatalf("expected 1 ack, got %d %v", n, err)
+	}
+	if cp := g.Checkpoint(); cp != positions[0] {
+		t.Fatalf("expected the checkpoint at %s, got %s", positions[0], cp)
+	}
+
+	// a position alone acknowledges every event read at it
+	c := read(t, g, "c", 5, time.Minute)
+	if len(c) != 2 || c[0].Key.ID != positions[1] || c[1].Key.ID != positions[1] {
+		t.Fatalf("expected both links of the second event, got %v", c)
+	}
+	if n, err := g.Ack(Position{ID: positions[1]}); err != nil || n != 2 {
+		t.Fatalf("expected 2 acks, got %d %v", n, err)
+	}
+	if cp := g.Checkpoint(); cp != positions[1] {
+		t.Fatalf("expected the checkpoint at %s, got %s", positions[1], cp)
+	}
+}
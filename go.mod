@@ -8,9 +8,11 @@ require (
 	github.com/dgraph-io/badger/v2 v2.0.2
 	github.com/golang/protobuf v1.3.3 // indirect
 	github.com/gomodule/redigo v2.0.0+incompatible
+	github.com/google/btree v1.0.0
 	github.com/mattn/go-colorable v0.1.4 // indirect
 	github.com/mattn/go-isatty v0.0.12 // indirect
 	github.com/oklog/ulid/v2 v2.0.2
 	github.com/tidwall/redcon v1.3.2
+	go.etcd.io/bbolt v1.3.5
 	go.uber.org/automaxprocs v1.3.0
 )
@@ -0,0 +1,330 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oplog
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Wildcard - a pattern ending with the wildcard matches every topic starting with the
+// rest of the pattern, on its own it matches every topic
+const Wildcard = "*"
+
+var (
+	// ErrOverflow - the subscription was ended as its buffer was full
+	ErrOverflow = errors.New("subscriber buffer overflow")
+	// ErrLagged - the subscription was ended as its buffer was full and the subscriber
+	// is expected to catch up from the store
+	ErrLagged = errors.New("subscriber lagged behind")
+	// ErrClosed - the subscription was closed by the subscriber
+	ErrClosed = errors.New("subscription closed")
+)
+
+// Policy - what happens to a subscription whose buffer is full when a value is written
+type Policy int
+
+const (
+	// Disconnect - the subscription is ended with ErrOverflow
+	Disconnect Policy = iota
+	// CatchUp - the subscription is ended with ErrLagged
+	CatchUp
+	// Block - the writer waits until the subscriber makes room, a subscriber that has not
+	// started reading yet is still catching up and is ended with ErrLagged instead
+	Block
+)
+
+var policies = map[Policy]string{
+	Disconnect: "disconnect",
+	CatchUp:    "catchup",
+	Block:      "block",
+}
+
+func (p Policy) String() string {
+	return policies[p]
+}
+
+// ParsePolicy - parses the name of a policy
+func ParsePolicy(s string) (Policy, error) {
+	for p, name := range policies {
+		if strings.EqualFold(s, name) {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown slow subscriber policy %q", s)
+}
+
+// Options - the buffer and policy given to each subscription
+type Options struct {
+	Buffer int
+	Policy Policy
+}
+
+// DefaultOptions - options used for subscriptions unless configured
+var DefaultOptions = Options{
+	Buffer: 1024,
+	Policy: CatchUp,
+}
+
+// Topics - delivers values only to the subscriptions whose pattern matches the topic
+// they are written to. Every subscription has a buffer of its own so a slow subscriber
+// holds on to at most that many values.
+type Topics struct {
+	// counters first to be aligned for atomic access
+	published uint64
+	overflows uint64
+	lagged    uint64
+
+	opts Options
+
+	mu       sync.RWMutex
+	exact    map[string]map[*Subscription]struct{}
+	prefixes map[string]map[*Subscription]struct{}
+}
+
+// Subscription - a receiver of the values written to the topics matching a pattern
+type Subscription struct {
+	delivered uint64
+	// set once the subscriber reads, writers only wait for subscribers that read
+	reading uint32
+
+	topics  *Topics
+	pattern string
+	policy  Policy
+
+	c    chan interface{}
+	done chan struct{}
+	once sync.Once
+	err  error
+}
+
+// NewTopics - create a new set of topics without subscriptions
+func NewTopics(opts Options) *Topics {
+	if opts.Buffer < 1 {
+		opts.Buffer = DefaultOptions.Buffer
+	}
+
+	return &Topics{
+		opts:     opts,
+		exact:    make(map[string]map[*Subscription]struct{}),
+		prefixes: make(map[string]map[*Subscription]struct{}),
+	}
+}
+
+// IsPattern - determines if the pattern matches more than one topic
+func IsPattern(pattern string) bool {
+	return strings.HasSuffix(pattern, Wildcard)
+}
+
+// Match - determines if the topic is matched by the pattern
+func Match(pattern, name string) bool {
+	if IsPattern(pattern) {
+		return strings.HasPrefix(name, strings.TrimSuffix(pattern, Wildcard))
+	}
+	return pattern == name
+}
+
+// group - the subscriptions of the same kind as the pattern and the key of the pattern within them
+func (t *Topics) group(pattern string) (map[string]map[*Subscription]struct{}, string) {
+	if IsPattern(pattern) {
+		return t.prefixes, strings.TrimSuffix(pattern, Wildcard)
+	}
+	return t.exact, pattern
+}
+
+// Listen - start receiving the values written to the topics matching the pattern
+func (t *Topics) Listen(pattern string) *Subscription {
+	s := &Subscription{
+		topics:  t,
+		pattern: pattern,
+		policy:  t.opts.Policy,
+		c:       make(chan interface{}, t.opts.Buffer),
+		done:    make(chan struct{}),
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	group, key := t.group(pattern)
+	if group[key] == nil {
+		group[key] = make(map[*Subscription]struct{})
+	}
+	group[key][s] = struct{}{}
+
+	return s
+}
+
+// Write - deliver a value to the subscriptions of every pattern matching the topic. The
+// subscriptions are delivered to once the lock is released so that a blocked writer does not
+// hold up Listen and Close.
+func (t *Topics) Write(name string, v interface{}) {
+	atomic.AddUint64(&t.published, 1)
+
+	for _, s := range t.matching(name) {
+		s.deliver(v)
+	}
+}
+
+// matching - the subscriptions of every pattern matching the topic
+func (t *Topics) matching(name string) []*Subscription {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var matched []*Subscription
+	for s := range t.exact[name] {
+		matched = append(matched, s)
+	}
+
+	for prefix, subs := range t.prefixes {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		for s := range subs {
+			matched = append(matched, s)
+		}
+	}
+
+	return matched
+}
+
+// deliver - buffers the value for the subscriber or applies the policy when the buffer is full
+func (s *Subscription) deliver(v interface{}) {
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+
+	if s.policy == Block && atomic.LoadUint32(&s.reading) == 1 {
+		select {
+		case s.c <- v:
+		case <-s.done:
+		}
+		return
+	}
+
+	select {
+	case s.c <- v:
+	default:
+		if s.policy != Disconnect {
+			atomic.AddUint64(&s.topics.lagged, 1)
+			s.end(ErrLagged)
+			return
+		}
+		atomic.AddUint64(&s.topics.overflows, 1)
+		s.end(ErrOverflow)
+	}
+}
+
+// end - ends the subscription, the values still buffered are dropped
+func (s *Subscription) end(err error) {
+	s.once.Do(func() {
+		s.err = err
+		close(s.done)
+	})
+}
+
+// Read - read the next value written to the topics of the subscription, waiting until one
+// is available. Once the subscription has ended the reason is returned instead.
+func (s *Subscription) Read() (interface{}, error) {
+	atomic.StoreUint32(&s.reading, 1)
+
+	select {
+	case <-s.done:
+		return nil, s.err
+	default:
+	}
+
+	select {
+	case v := <-s.c:
+		atomic.AddUint64(&s.delivered, 1)
+		return v, nil
+	case <-s.done:
+		return nil, s.err
+	}
+}
+
+// Close - stop receiving values, pending reads return ErrClosed unless the subscription already ended
+func (s *Subscription) Close() {
+	s.end(ErrClosed)
+
+	t := s.topics
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	group, key := t.group(s.pattern)
+	delete(group[key], s)
+	if len(group[key]) == 0 {
+		delete(group, key)
+	}
+}
+
+// SubscriptionStats - the state of the buffer of a subscription
+type SubscriptionStats struct {
+	Pattern   string `json:"pattern"`
+	Policy    string `json:"policy"`
+	Buffered  int    `json:"buffered"`
+	Capacity  int    `json:"capacity"`
+	Delivered uint64 `json:"delivered"`
+}
+
+// Stats - counters of the topics and how far behind each subscription is
+type Stats struct {
+	Published     uint64              `json:"published"`
+	Overflows     uint64              `json:"overflows"`
+	Lagged        uint64              `json:"lagged"`
+	MaxLag        int                 `json:"max_lag"`
+	Subscriptions []SubscriptionStats `json:"subscriptions"`
+}
+
+// Stats - collects the counters of the topics, the lag of a subscription is the number of
+// values buffered that it has not read yet
+func (t *Topics) Stats() Stats {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	stats := Stats{
+		Published:     atomic.LoadUint64(&t.published),
+		Overflows:     atomic.LoadUint64(&t.overflows),
+		Lagged:        atomic.LoadUint64(&t.lagged),
+		Subscriptions: []SubscriptionStats{},
+	}
+
+	for _, group := range []map[string]map[*Subscription]struct{}{t.exact, t.prefixes} {
+		for _, subs := range group {
+			for s := range subs {
+				ss := SubscriptionStats{
+					Pattern:   s.pattern,
+					Policy:    s.policy.String(),
+					Buffered:  len(s.c),
+					Capacity:  cap(s.c),
+					Delivered: atomic.LoadUint64(&s.delivered),
+				}
+				if ss.Buffered > stats.MaxLag {
+					stats.MaxLag = ss.Buffered
+				}
+				stats.Subscriptions = append(stats.Subscriptions, ss)
+			}
+		}
+	}
+
+	return stats
+}
@@ -0,0 +1,197 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package oplog
+
+import (
+	"testing"
+	"time"
+)
+
+func expectValues(t *testing.T, name string, s *Subscription, values ...int) {
+	t.Helper()
+	for _, want := range values {
+		got, err := s.Read()
+		if err != nil || got != want {
+			t.Fatalf("expected %s to read %d, got %v %v", name, want, got, err)
+		}
+	}
+}
+
+func TestTopics(t *testing.T) {
+	topics := NewTopics(DefaultOptions)
+
+	stream := topics.Listen("order-1")
+	prefix := topics.Listen("order-*")
+	all := topics.Listen(Wildcard)
+	other := topics.Listen("other")
+
+	topics.Write("order-1", 1)
+	topics.Write("order-2", 2)
+	topics.Write("other", 3)
+
+	expectValues(t, "stream", stream, 1)
+	expectValues(t, "prefix", prefix, 1, 2)
+	expectValues(t, "all", all, 1, 2, 3)
+	expectValues(t, "other", other, 3)
+
+	// a closed subscription is no longer delivered to
+	other.Close()
+	other.Close()
+	if _, ok := topics.exact["other"]; ok {
+		t.Fatalf("expected the topic to be removed once its subscriptions are closed")
+	}
+
+	topics.Write("other", 4)
+	topics.Write("order-1", 5)
+	expectValues(t, "stream", stream, 5)
+	expectValues(t, "all", all, 4, 5)
+
+	// a pending read returns once the subscription is closed
+	done := make(chan error)
+	go func() {
+		_, err := stream.Read()
+		done <- err
+	}()
+	stream.Close()
+	if err := <-done; err != ErrClosed {
+		t.Fatalf("expected a closed subscription to return ErrClosed, got %v", err)
+	}
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	for _, tt := range []struct {
+		policy Policy
+		err    error
+	}{
+		{Disconnect, ErrOverflow},
+		{CatchUp, ErrLagged},
+	} {
+		topics := NewTopics(Options{Buffer: 2, Policy: tt.policy})
+		slow := topics.Listen("order")
+		fast := topics.Listen("order")
+
+		topics.Write("order", 1)
+		expectValues(t, "fast", fast, 1)
+		topics.Write("order", 2)
+		expectValues(t, "fast", fast, 2)
+		topics.Write("order", 3)
+		expectValues(t, "fast", fast, 3)
+
+		// the slow subscriber ends without holding the publisher or the fast subscriber
+		if _, err := slow.Read(); err != tt.err {
+			t.Fatalf("expected %s to end the slow subscriber with %v, got %v", tt.policy, tt.err, err)
+		}
+
+		stats := topics.Stats()
+		if stats.Published != 3 || stats.Overflows+stats.Lagged != 1 {
+			t.Fatalf("unexpected stats for %s %+v", tt.policy, stats)
+		}
+	}
+}
+
+func TestBlockingSubscriber(t *testing.T) {
+	topics := NewTopics(Options{Buffer: 1, Policy: Block})
+	sub := topics.Listen("order")
+
+	if stats := topics.Stats(); stats.MaxLag != 0 || len(stats.Subscriptions) != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// writers only wait for a subscriber that has started reading
+	topics.Write("order", 0)
+	expectValues(t, "sub", sub, 0)
+
+	topics.Write("order", 1)
+
+	written := make(chan struct{})
+	go func() {
+		topics.Write("order", 2)
+		close(written)
+	}()
+
+	select {
+	case <-written:
+		t.Fatalf("expected the writer to wait for the subscriber")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if stats := topics.Stats(); stats.MaxLag != 1 {
+		t.Fatalf("expected a lag of 1, got %+v", stats)
+	}
+
+	// a blocked writer does not hold up other subscribers listening and closing
+	listened := make(chan struct{})
+	go func() {
+		topics.Listen("order").Close()
+		close(listened)
+	}()
+	select {
+	case <-listened:
+	case <-time.After(time.Second):
+		t.Fatalf("expected listen and close not to wait for the blocked writer")
+	}
+
+	expectValues(t, "sub", sub, 1)
+	<-written
+	expectValues(t, "sub", sub, 2)
+}
+
+func TestBlockingSubscriberCatchingUp(t *testing.T) {
+	topics := NewTopics(Options{Buffer: 1, Policy: Block})
+	// a subscriber listens before catching up from the store and reads afterwards
+	sub := topics.Listen("order")
+
+	written := make(chan struct{})
+	go func() {
+		topics.Write("order", 1)
+		topics.Write("order", 2)
+		close(written)
+	}()
+
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the writer not to wait for a subscriber catching up")
+	}
+
+	if _, err := sub.Read(); err != ErrLagged {
+		t.Fatalf("expected the subscriber to lag, got %v", err)
+	}
+	if stats := topics.Stats(); stats.Lagged != 1 {
+		t.Fatalf("expected a lagged subscriber, got %+v", stats)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		match         bool
+	}{
+		{"order", "order", true},
+		{"order", "order-1", false},
+		{"order-*", "order-1", true},
+		{"order-*", "order-", true},
+		{"order-*", "order", false},
+		{"*", "anything", true},
+	}
+
+	for _, tt := range tests {
+		if got := Match(tt.pattern, tt.name); got != tt.match {
+			t.Errorf("Match(%q, %q) = %v, expected %v", tt.pattern, tt.name, got, tt.match)
+		}
+	}
+}
@@ -0,0 +1,532 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package projection
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+
+	"github.com/maarek/aves/store"
+)
+
+// Values are those decoded by encoding/json: nil, bool, float64, string,
+// []interface{} and map[string]interface{}. A missing field reads as null,
+// null reads as 0 in arithmetic and as "" when added to a string.
+
+// the roots of a path
+const (
+	rootState = iota
+	rootData
+	rootMetadata
+	rootEvent
+)
+
+// env - the event a program runs for and the state of its partition
+type env struct {
+	state    map[string]interface{}
+	data     interface{}
+	metadata interface{}
+	event    map[string]interface{}
+}
+
+// newEnv - decodes the event for a run, data and metadata that are not JSON read as strings
+func newEnv(k store.Key, e store.Event, state map[string]interface{}) *env {
+	return &env{
+		state:    state,
+		data:     decodeJSON(e.Data),
+		metadata: decodeJSON(e.Metadata),
+		event: map[string]interface{}{
+			"type":          e.Type,
+			"stream":        string(k.Stream),
+			"version":       float64(k.Version),
+			"position":      k.ID.String(),
+			"contentType":   e.ContentType,
+			"correlationId": e.CorrelationID,
+			"causationId":   e.CausationID,
+		},
+	}
+}
+
+func decodeJSON(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return s
+	}
+	return v
+}
+
+// literal - a constant value
+type literal struct {
+	value interface{}
+}
+
+func (x *literal) eval(*env) (interface{}, error) {
+	return x.value, nil
+}
+
+// path - the value of a root followed by fields of objects and indexes of arrays
+type path struct {
+	root   int
+	fields []expr
+}
+
+func (x *path) eval(env *env) (interface{}, error) {
+	var v interface{}
+	switch x.root {
+	case rootState:
+		v = env.state
+	case rootData:
+		v = env.data
+	case rootMetadata:
+		v = env.metadata
+	case rootEvent:
+		v = env.event
+	}
+
+	for _, f := range x.fields {
+		key, err := f.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		if v, err = index(v, key); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// index - the field of an object or the element of an array, null when missing
+func index(v, key interface{}) (interface{}, error) {
+	switch c := v.(type) {
+	case map[string]interface{}:
+		name, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("object field must be a string, got %s", describe(key))
+		}
+		return c[name], nil
+	case []interface{}:
+		i, ok := key.(float64)
+		if !ok || i != math.Trunc(i) {
+			return nil, fmt.Errorf("array index must be an integer, got %s", describe(key))
+		}
+		n, ok := element(c, i)
+		if !ok {
+			return nil, nil
+		}
+		return c[n], nil
+	case nil:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("can not read %s of %s", describe(key), describe(v))
+}
+
+// element - the position of an integer index in the array, false when it is out of range.
+// The range is checked on the float since converting a large one to an int overflows.
+func element(c []interface{}, i float64) (int, bool) {
+	if i < 0 || i >= float64(len(c)) {
+		return 0, false
+	}
+	return int(i), true
+}
+
+// container - the object or array holding the last field of the path in the state,
+// creating the objects leading up to it when create is set
+func (x *path) container(env *env, create bool) (interface{}, interface{}, error) {
+	var v interface{} = env.state
+	for i, f := range x.fields {
+		key, err := f.eval(env)
+		if err != nil {
+			return nil, nil, err
+		}
+		if i == len(x.fields)-1 {
+			return v, key, nil
+		}
+
+		next, err := index(v, key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if next == nil && create {
+			obj, ok := v.(map[string]interface{})
+			name, isName := key.(string)
+			if !ok || !isName {
+				return nil, nil, fmt.Errorf("can not create %s in %s", describe(key), describe(v))
+			}
+			next = make(map[string]interface{})
+			obj[name] = next
+		}
+		if next == nil {
+			return nil, nil, nil
+		}
+		v = next
+	}
+	return nil, nil, nil
+}
+
+// assign - sets a field of the state
+type assign struct {
+	target *path
+	value  expr
+}
+
+func (s *assign) exec(env *env) error {
+	value, err := s.value.eval(env)
+	if err != nil {
+		return err
+	}
+
+	c, key, err := s.target.container(env, true)
+	if err != nil {
+		return err
+	}
+
+	switch c := c.(type) {
+	case map[string]interface{}:
+		name, ok := key.(string)
+		if !ok {
+			return fmt.Errorf("object field must be a string, got %s", describe(key))
+		}
+		c[name] = value
+		return nil
+	case []interface{}:
+		i, ok := key.(float64)
+		if !ok || i != math.Trunc(i) {
+			return fmt.Errorf("array index %s is out of range", describe(key))
+		}
+		n, ok := element(c, i)
+		if !ok {
+			return fmt.Errorf("array index %s is out of range", describe(key))
+		}
+		c[n] = value
+		return nil
+	}
+	return fmt.Errorf("can not set %s of %s", describe(key), describe(c))
+}
+
+// deleteStmt - removes a field of the state
+type deleteStmt struct {
+	target *path
+}
+
+func (s *deleteStmt) exec(env *env) error {
+	c, key, err := s.target.container(env, false)
+	if err != nil {
+		return err
+	}
+	if obj, ok := c.(map[string]interface{}); ok {
+		if name, ok := key.(string); ok {
+			delete(obj, name)
+		}
+	}
+	return nil
+}
+
+// ifStmt - runs either branch depending on the condition
+type ifStmt struct {
+	cond      expr
+	then      []stmt
+	otherwise []stmt
+}
+
+func (s *ifStmt) exec(env *env) error {
+	cond, err := s.cond.eval(env)
+	if err != nil {
+		return err
+	}
+
+	body := s.otherwise
+	if truthy(cond) {
+		body = s.then
+	}
+	for _, st := range body {
+		if err := st.exec(env); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unary - negation and not
+type unary struct {
+	op string
+	x  expr
+}
+
+func (x *unary) eval(env *env) (interface{}, error) {
+	v, err := x.x.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if x.op == "!" {
+		return !truthy(v), nil
+	}
+	n, err := number(v)
+	return -n, err
+}
+
+// binary - arithmetic, comparisons and logic, && and || evaluate their right side only when needed
+type binary struct {
+	op          string
+	left, right expr
+}
+
+func (x *binary) eval(env *env) (interface{}, error) {
+	l, err := x.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch x.op {
+	case "&&":
+		if !truthy(l) {
+			return false, nil
+		}
+		r, err := x.right.eval(env)
+		return truthy(r), err
+	case "||":
+		if truthy(l) {
+			return true, nil
+		}
+		r, err := x.right.eval(env)
+		return truthy(r), err
+	}
+
+	r, err := x.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch x.op {
+	case "==":
+		return reflect.DeepEqual(l, r), nil
+	case "!=":
+		return !reflect.DeepEqual(l, r), nil
+	case "<", "<=", ">", ">=":
+		return compare(x.op, l, r)
+	case "+":
+		_, ls := l.(string)
+		_, rs := r.(string)
+		if ls || rs {
+			return text(l) + text(r), nil
+		}
+	}
+
+	a, err := number(l)
+	if err != nil {
+		return nil, err
+	}
+	b, err := number(r)
+	if err != nil {
+		return nil, err
+	}
+
+	switch x.op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/":
+		if b == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return a / b, nil
+	}
+	if b == 0 {
+		return nil, errors.New("division by zero")
+	}
+	return math.Mod(a, b), nil
+}
+
+// compare - orders two numbers or two strings
+func compare(op string, l, r interface{}) (interface{}, error) {
+	var c int
+	ls, lok := l.(string)
+	rs, rok := r.(string)
+	if lok && rok {
+		switch {
+		case ls < rs:
+			c = -1
+		case ls > rs:
+			c = 1
+		}
+	} else {
+		a, err := number(l)
+		if err != nil {
+			return nil, err
+		}
+		b, err := number(r)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case a < b:
+			c = -1
+		case a > b:
+			c = 1
+		}
+	}
+
+	switch op {
+	case "<":
+		return c < 0, nil
+	case "<=":
+		return c <= 0, nil
+	case ">":
+		return c > 0, nil
+	}
+	return c >= 0, nil
+}
+
+// call - a call of a built in function
+type call struct {
+	name string
+	fn   func(args []interface{}) (interface{}, error)
+	args []expr
+}
+
+func (x *call) eval(env *env) (interface{}, error) {
+	args := make([]interface{}, len(x.args))
+	for i, arg := range x.args {
+		v, err := arg.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+
+	v, err := x.fn(args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", x.name, err)
+	}
+	return v, nil
+}
+
+// functions - the built in functions
+var functions = map[string]func(args []interface{}) (interface{}, error){
+	"len": func(args []interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, errors.New("expects 1 argument")
+		}
+		switch v := args[0].(type) {
+		case string:
+			return float64(len(v)), nil
+		case []interface{}:
+			return float64(len(v)), nil
+		case map[string]interface{}:
+			return float64(len(v)), nil
+		case nil:
+			return float64(0), nil
+		}
+		return nil, fmt.Errorf("can not measure %s", describe(args[0]))
+	},
+	"min": func(args []interface{}) (interface{}, error) {
+		return extreme(args, func(a, b float64) bool { return a < b })
+	},
+	"max": func(args []interface{}) (interface{}, error) {
+		return extreme(args, func(a, b float64) bool { return a > b })
+	},
+	"append": func(args []interface{}) (interface{}, error) {
+		if len(args) < 1 {
+			return nil, errors.New("expects an array")
+		}
+		list, ok := args[0].([]interface{})
+		if !ok && args[0] != nil {
+			return nil, fmt.Errorf("can not append to %s", describe(args[0]))
+		}
+		return append(append([]interface{}{}, list...), args[1:]...), nil
+	},
+}
+
+// extreme - the number preferred over every other, ignoring nulls
+func extreme(args []interface{}, better func(a, b float64) bool) (interface{}, error) {
+	var best interface{}
+	for _, arg := range args {
+		if arg == nil {
+			continue
+		}
+		n, err := number(arg)
+		if err != nil {
+			return nil, err
+		}
+		if best == nil || better(n, best.(float64)) {
+			best = n
+		}
+	}
+	return best, nil
+}
+
+// number - the value as a number, null being 0
+func number(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case float64:
+		return n, nil
+	case nil:
+		return 0, nil
+	}
+	return 0, fmt.Errorf("expected a number, got %s", describe(v))
+}
+
+// text - the value as a string, null being ""
+func text(v interface{}) string {
+	switch s := v.(type) {
+	case string:
+		return s
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(s, 'f', -1, 64)
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// truthy - false, null, 0 and "" are false and anything else is true
+func truthy(v interface{}) bool {
+	switch b := v.(type) {
+	case bool:
+		return b
+	case nil:
+		return false
+	case float64:
+		return b != 0
+	case string:
+		return b != ""
+	}
+	return true
+}
+
+// describe - a short description of a value for errors
+func describe(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case map[string]interface{}:
+		return "an object"
+	case []interface{}:
+		return "an array"
+	}
+	return fmt.Sprintf("%q", text(v))
+}
@@ -0,0 +1,583 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package projection
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The source of a projection selects the events it reads, how they are partitioned
+// and the handlers reducing each event into the state of its partition:
+//
+//   from category "order"
+//   partition by event.stream
+//
+//   on OrderPlaced {
+//     count += 1
+//     total = total + data.total
+//   }
+//   on OrderShipped, OrderDelivered {
+//     if data.late { late += 1 } else { status = "shipped" }
+//   }
+//
+// Statements are assignments to the state, with =, += or -=, delete and if/else.
+// Expressions read the state by name and the event through data, metadata and
+// event, and combine them with arithmetic, comparisons and the functions len,
+// min, max and append.
+
+// token kinds
+const (
+	tokEOF = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokOp
+)
+
+// token - a lexed token and the line it starts on
+type token struct {
+	kind int
+	text string
+	line int
+}
+
+// operators, longest first so that they are matched greedily
+var operators = []string{
+	"+=", "-=", "==", "!=", "<=", ">=", "&&", "||",
+	"+", "-", "*", "/", "%", "<", ">", "!", "=", "(", ")", "{", "}", "[", "]", ".", ",", ";",
+}
+
+// lex - splits the source into tokens, # starts a comment until the end of the line
+func lex(src string) ([]token, error) {
+	var tokens []token
+	line := 1
+
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case c == '"':
+			end := i + 1
+			for end < len(src) && src[end] != '"' {
+				if src[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(src) {
+				return nil, fmt.Errorf("line %d: unterminated string", line)
+			}
+			s, err := strconv.Unquote(src[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid string %s", line, src[i:end+1])
+			}
+			tokens = append(tokens, token{kind: tokString, text: s, line: line})
+			i = end + 1
+		case c >= '0' && c <= '9':
+			end := i
+			for end < len(src) && (src[end] >= '0' && src[end] <= '9' || src[end] == '.') {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokNumber, text: src[i:end], line: line})
+			i = end
+		case c == '_' || unicode.IsLetter(rune(c)):
+			end := i
+			for end < len(src) && (src[end] == '_' || unicode.IsLetter(rune(src[end])) || unicode.IsDigit(rune(src[end]))) {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: src[i:end], line: line})
+			i = end
+		default:
+			op := ""
+			for _, o := range operators {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("line %d: unexpected character %q", line, c)
+			}
+			tokens = append(tokens, token{kind: tokOp, text: op, line: line})
+			i += len(op)
+		}
+	}
+
+	return append(tokens, token{kind: tokEOF, line: line}), nil
+}
+
+// expr - an expression evaluated against an event and the state of its partition
+type expr interface {
+	eval(env *env) (interface{}, error)
+}
+
+// stmt - a statement changing the state of a partition
+type stmt interface {
+	exec(env *env) error
+}
+
+// handler - the statements run for the events of the types given, every type when nil
+type handler struct {
+	types map[string]bool
+	body  []stmt
+}
+
+// Program - a parsed projection source
+type Program struct {
+	// the streams read, every stream when both are empty
+	stream   string
+	category string
+
+	// the partition of an event, a single partition when nil
+	partition expr
+
+	handlers []handler
+}
+
+// parser - a recursive descent parser over the tokens of a source
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// Parse - parses the source of a projection
+func Parse(src string) (*Program, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	prog := &Program{}
+
+	for p.peek().kind != tokEOF {
+		t := p.next()
+		switch {
+		case t.kind == tokIdent && t.text == "from":
+			if err := p.parseFrom(prog); err != nil {
+				return nil, err
+			}
+		case t.kind == tokIdent && t.text == "partition":
+			if err := p.expectIdent("by"); err != nil {
+				return nil, err
+			}
+			if prog.partition, err = p.parseExpr(); err != nil {
+				return nil, err
+			}
+		case t.kind == tokIdent && t.text == "on":
+			h, err := p.parseHandler()
+			if err != nil {
+				return nil, err
+			}
+			prog.handlers = append(prog.handlers, h)
+		case t.kind == tokOp && t.text == ";":
+		default:
+			return nil, p.errorf(t, "expected from, partition or on")
+		}
+	}
+
+	if len(prog.handlers) == 0 {
+		return nil, fmt.Errorf("projection must have at least one on handler")
+	}
+
+	return prog, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept - consumes the operator when it is next
+func (p *parser) accept(op string) bool {
+	if t := p.peek(); t.kind == tokOp && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(op string) error {
+	if !p.accept(op) {
+		return p.errorf(p.peek(), "expected %s", op)
+	}
+	return nil
+}
+
+func (p *parser) expectIdent(name string) error {
+	if t := p.next(); t.kind != tokIdent || t.text != name {
+		return p.errorf(t, "expected %s", name)
+	}
+	return nil
+}
+
+func (p *parser) errorf(t token, format string, args ...interface{}) error {
+	found := t.text
+	if t.kind == tokEOF {
+		found = "end of source"
+	}
+	return fmt.Errorf("line %d: %s, found %q", t.line, fmt.Sprintf(format, args...), found)
+}
+
+// name - an identifier or a string naming a stream, category or event type
+func (p *parser) name() (string, error) {
+	t := p.next()
+	if t.kind != tokIdent && t.kind != tokString {
+		return "", p.errorf(t, "expected a name")
+	}
+	return t.text, nil
+}
+
+// parseFrom - from all | from stream <name> | from category <name>
+func (p *parser) parseFrom(prog *Program) error {
+	t := p.next()
+	if t.kind != tokIdent {
+		return p.errorf(t, "expected all, stream or category")
+	}
+
+	var err error
+	switch t.text {
+	case "all":
+		prog.stream, prog.category = "", ""
+	case "stream":
+		prog.stream, err = p.name()
+	case "category":
+		prog.category, err = p.name()
+	default:
+		return p.errorf(t, "expected all, stream or category")
+	}
+	return err
+}
+
+// parseHandler - on * { ... } | on <type> [, <type> ...] { ... }
+func (p *parser) parseHandler() (handler, error) {
+	var h handler
+
+	if !p.accept("*") {
+		h.types = make(map[string]bool)
+		for {
+			name, err := p.name()
+			if err != nil {
+				return h, err
+			}
+			h.types[name] = true
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+
+	body, err := p.parseBlock()
+	h.body = body
+	return h, err
+}
+
+// parseBlock - { <statement> ... }
+func (p *parser) parseBlock() ([]stmt, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+
+	var body []stmt
+	for !p.accept("}") {
+		if p.accept(";") {
+			continue
+		}
+		if p.peek().kind == tokEOF {
+			return nil, p.errorf(p.peek(), "expected }")
+		}
+		s, err := p.parseStmt()
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, s)
+	}
+	return body, nil
+}
+
+// parseStmt - an if, a delete or an assignment
+func (p *parser) parseStmt() (stmt, error) {
+	t := p.peek()
+	if t.kind == tokIdent && t.text == "if" {
+		p.next()
+		return p.parseIf()
+	}
+	if t.kind == tokIdent && t.text == "delete" {
+		p.next()
+		target, err := p.parseTarget()
+		if err != nil {
+			return nil, err
+		}
+		return &deleteStmt{target: target}, nil
+	}
+
+	target, err := p.parseTarget()
+	if err != nil {
+		return nil, err
+	}
+
+	op := p.next()
+	if op.kind != tokOp || (op.text != "=" && op.text != "+=" && op.text != "-=") {
+		return nil, p.errorf(op, "expected =, += or -=")
+	}
+
+	value, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.text {
+	case "+=":
+		value = &binary{op: "+", left: target, right: value}
+	case "-=":
+		value = &binary{op: "-", left: target, right: value}
+	}
+
+	return &assign{target: target, value: value}, nil
+}
+
+// parseIf - if <expr> { ... } [else { ... } | else if ...]
+func (p *parser) parseIf() (stmt, error) {
+	cond, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &ifStmt{cond: cond}
+	if s.then, err = p.parseBlock(); err != nil {
+		return nil, err
+	}
+
+	if t := p.peek(); t.kind == tokIdent && t.text == "else" {
+		p.next()
+		if t := p.peek(); t.kind == tokIdent && t.text == "if" {
+			p.next()
+			nested, err := p.parseIf()
+			if err != nil {
+				return nil, err
+			}
+			s.otherwise = []stmt{nested}
+		} else if s.otherwise, err = p.parseBlock(); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// parseTarget - a path into the state, either a bare name or one starting with state
+func (p *parser) parseTarget() (*path, error) {
+	t := p.peek()
+	if t.kind != tokIdent {
+		return nil, p.errorf(t, "expected a state field")
+	}
+
+	target, err := p.parsePath()
+	if err != nil {
+		return nil, err
+	}
+	if target.root != rootState {
+		return nil, p.errorf(t, "only the state can be changed")
+	}
+	if len(target.fields) == 0 {
+		return nil, p.errorf(t, "the state itself can not be replaced")
+	}
+
+	return target, nil
+}
+
+// parsePath - <name> { .<field> | [<expr>] }
+func (p *parser) parsePath() (*path, error) {
+	t := p.next()
+
+	x := &path{root: rootState}
+	switch t.text {
+	case "state":
+	case "data":
+		x.root = rootData
+	case "metadata":
+		x.root = rootMetadata
+	case "event":
+		x.root = rootEvent
+	default:
+		x.fields = append(x.fields, &literal{value: t.text})
+	}
+
+	for {
+		if p.accept(".") {
+			f := p.next()
+			if f.kind != tokIdent {
+				return nil, p.errorf(f, "expected a field name")
+			}
+			x.fields = append(x.fields, &literal{value: f.text})
+			continue
+		}
+		if p.accept("[") {
+			index, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			x.fields = append(x.fields, index)
+			continue
+		}
+		return x, nil
+	}
+}
+
+// binary operators by increasing precedence
+var precedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *parser) parseExpr() (expr, error) {
+	return p.parseBinary(0)
+}
+
+// parseBinary - parses the operators of a level of precedence, left associative
+func (p *parser) parseBinary(level int) (expr, error) {
+	if level == len(precedence) {
+		return p.parseUnary()
+	}
+
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t := p.peek()
+		if t.kind != tokOp || !contains(precedence[level], t.text) {
+			return left, nil
+		}
+		p.next()
+
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &binary{op: t.text, left: left, right: right}
+	}
+}
+
+func (p *parser) parseUnary() (expr, error) {
+	if p.accept("-") {
+		x, err := p.parseUnary()
+		return &unary{op: "-", x: x}, err
+	}
+	if p.accept("!") {
+		x, err := p.parseUnary()
+		return &unary{op: "!", x: x}, err
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (expr, error) {
+	t := p.peek()
+	switch t.kind {
+	case tokNumber:
+		p.next()
+		n, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, p.errorf(t, "invalid number")
+		}
+		return &literal{value: n}, nil
+	case tokString:
+		p.next()
+		return &literal{value: t.text}, nil
+	case tokIdent:
+		switch t.text {
+		case "true", "false":
+			p.next()
+			return &literal{value: t.text == "true"}, nil
+		case "null":
+			p.next()
+			return &literal{}, nil
+		}
+		if next := p.tokens[p.pos+1]; next.kind == tokOp && next.text == "(" {
+			return p.parseCall()
+		}
+		return p.parsePath()
+	case tokOp:
+		if p.accept("(") {
+			x, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			return x, p.expect(")")
+		}
+	}
+	return nil, p.errorf(t, "expected an expression")
+}
+
+// parseCall - <function>(<expr>, ...)
+func (p *parser) parseCall() (expr, error) {
+	t := p.next()
+	fn, ok := functions[t.text]
+	if !ok {
+		return nil, p.errorf(t, "unknown function")
+	}
+	p.next()
+
+	c := &call{name: t.text, fn: fn}
+	for !p.accept(")") {
+		if len(c.args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		c.args = append(c.args, arg)
+	}
+	return c, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,594 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package projection runs user defined projections inside the server. A projection
+// reads every event of the store in position order, like SUBSCRIBEALL, and reduces
+// those it handles into the state of their partition. The state of each partition
+// is stored along with the position of the last event applied to it, and the
+// checkpoint of the projection once a batch of events is applied, so a projection
+// picks up where it left off after a restart without applying an event twice.
+//
+// A projection that fails to apply an event is faulted, it keeps the state as of
+// the last batch applied and stops until it is deleted and created again.
+package projection
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/maarek/aves/oplog"
+	"github.com/maarek/aves/store"
+	"github.com/maarek/aves/streammeta"
+	"github.com/oklog/ulid/v2"
+)
+
+// the number of index entries read from the store at once
+const batchSize = 1000
+
+// partitionSeparator - separates the name of a projection from the partition in the keys of their state
+const partitionSeparator = "\x00"
+
+var (
+	// ErrProjectionExists - returned when creating a projection that already exists
+	ErrProjectionExists = errors.New("projection already exists")
+	// ErrNoProjection - returned when using a projection that does not exist
+	ErrNoProjection = errors.New("projection does not exist")
+)
+
+// definition - the part of a projection that is stored
+type definition struct {
+	Source     string    `json:"source"`
+	Checkpoint ulid.ULID `json:"checkpoint"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// partition - the stored state of a partition and the position of the last event applied to it
+type partition struct {
+	Position ulid.ULID              `json:"position"`
+	State    map[string]interface{} `json:"state"`
+}
+
+// Info - the progress of a projection
+type Info struct {
+	Name string
+	// every event up to the checkpoint has been applied
+	Checkpoint ulid.ULID
+	// the reason the projection stopped, empty while it runs
+	Error string
+}
+
+// Projection - a projection applying the events of the store as they are appended
+type Projection struct {
+	db     store.DB
+	topics *oplog.Topics
+	name   string
+	source string
+	prog   *Program
+
+	mu         sync.Mutex
+	checkpoint ulid.ULID
+	err        string
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Registry - the projections of a store
+type Registry struct {
+	db     store.DB
+	topics *oplog.Topics
+
+	mu          sync.Mutex
+	projections map[string]*Projection
+}
+
+// NewRegistry - creates the registry of the projections stored in the db, the topics
+// wake the projections when events are published
+func NewRegistry(db store.DB, topics *oplog.Topics) *Registry {
+	return &Registry{
+		db:          db,
+		topics:      topics,
+		projections: make(map[string]*Projection),
+	}
+}
+
+// Start - loads the stored projections and starts those that are not faulted
+func (r *Registry) Start() error {
+	defs := make(map[string]definition)
+	err := r.db.ScanMeta(store.ProjectionNamespace, func(name, v string) bool {
+		var d definition
+		if err := json.Unmarshal([]byte(v), &d); err != nil {
+			d.Error = fmt.Sprintf("unable to load projection: %v", err)
+		}
+		defs[name] = d
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for name, d := range defs {
+		var prog *Program
+		if d.Error == "" {
+			if prog, err = Parse(d.Source); err != nil {
+				d.Error = err.Error()
+			}
+		}
+
+		p := r.newProjection(name, d)
+		p.prog = prog
+		r.projections[name] = p
+
+		if p.err == "" {
+			go p.run()
+		}
+	}
+
+	return nil
+}
+
+// Stop - stops every running projection
+func (r *Registry) Stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, p := range r.projections {
+		p.halt()
+	}
+}
+
+func (r *Registry) newProjection(name string, d definition) *Projection {
+	p := &Projection{
+		db:         r.db,
+		topics:     r.topics,
+		name:       name,
+		source:     d.Source,
+		checkpoint: d.Checkpoint,
+		err:        d.Error,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	if p.err != "" {
+		close(p.done)
+	}
+	return p
+}
+
+// Create - creates a projection from its source and starts it from the first event of the store
+func (r *Registry) Create(name, source string) error {
+	if name == "" || strings.Contains(name, partitionSeparator) {
+		return fmt.Errorf("invalid projection name %q", name)
+	}
+
+	prog, err := Parse(source)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.projections[name]; ok {
+		return ErrProjectionExists
+	}
+
+	p := r.newProjection(name, definition{Source: source})
+	p.prog = prog
+	if err := p.save(); err != nil {
+		return err
+	}
+	r.projections[name] = p
+
+	go p.run()
+
+	return nil
+}
+
+// Delete - stops the projection and removes it along with the state of its partitions
+func (r *Registry) Delete(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	p, ok := r.projections[name]
+	if !ok {
+		return ErrNoProjection
+	}
+	p.halt()
+
+	var keys []string
+	prefix := name + partitionSeparator
+	err := r.db.ScanMeta(store.ProjectionStateNamespace, func(key, v string) bool {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := r.db.DelMeta(store.ProjectionStateNamespace, key); err != nil {
+			return err
+		}
+	}
+
+	if err := r.db.DelMeta(store.ProjectionNamespace, name); err != nil {
+		return err
+	}
+	delete(r.projections, name)
+
+	return nil
+}
+
+// Get - the state of a partition of the projection as JSON, false when no event was
+// applied to the partition yet. Projections without partitions have a single empty partition.
+func (r *Registry) Get(name, partition string) (string, bool, error) {
+	r.mu.Lock()
+	_, ok := r.projections[name]
+	r.mu.Unlock()
+	if !ok {
+		return "", false, ErrNoProjection
+	}
+
+	v, err := r.db.GetMeta(store.ProjectionStateNamespace, name+partitionSeparator+partition)
+	if errors.Is(err, store.ErrNotFound) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	var p struct {
+		State json.RawMessage `json:"state"`
+	}
+	if err := json.Unmarshal([]byte(v), &p); err != nil {
+		return "", false, fmt.Errorf("unable to load partition %q of projection %s: %v", partition, name, err)
+	}
+
+	return string(p.State), true, nil
+}
+
+// List - the progress of every projection by name
+func (r *Registry) List() []Info {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	infos := make([]Info, 0, len(r.projections))
+	for _, p := range r.projections {
+		infos = append(infos, p.Info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+
+	return infos
+}
+
+// Info - the progress of the projection
+func (p *Projection) Info() Info {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return Info{
+		Name:       p.name,
+		Checkpoint: p.checkpoint,
+		Error:      p.err,
+	}
+}
+
+// save - stores the source, checkpoint and error of the projection
+func (p *Projection) save() error {
+	v, err := json.Marshal(definition{
+		Source:     p.source,
+		Checkpoint: p.checkpoint,
+		Error:      p.err,
+	})
+	if err != nil {
+		return err
+	}
+
+	return p.db.SetMeta(store.ProjectionNamespace, p.name, string(v))
+}
+
+// halt - stops the projection and waits for the batch being applied
+func (p *Projection) halt() {
+	select {
+	case <-p.stop:
+	default:
+		close(p.stop)
+	}
+	<-p.done
+}
+
+// run - applies the events stored after the checkpoint, then those appended whenever the
+// oplog wakes the projection, until the projection is stopped or faulted
+func (p *Projection) run() {
+	defer close(p.done)
+
+	var sub *oplog.Subscription
+	defer func() {
+		// a bug in a handler must not take the server down, the projection faults instead
+		if r := recover(); r != nil {
+			sub.Close()
+			p.fault(fmt.Errorf("projection failed: %v", r))
+		}
+	}()
+
+	for {
+		sub = p.topics.Listen(oplog.Wildcard)
+		wake, lost := watch(sub)
+
+		for caughtUp := false; !caughtUp; {
+			if err := p.catchUp(); err != nil {
+				sub.Close()
+				p.fault(err)
+				return
+			}
+
+			select {
+			case <-p.stop:
+				sub.Close()
+				return
+			case <-wake:
+			case <-lost:
+				// events may have been dropped, listen again and read them from the store
+				caughtUp = true
+			}
+		}
+	}
+}
+
+// watch - turns the values read from the subscription into wake ups, several values read
+// before the projection wakes up make a single wake up. Lost is closed when the subscription ends.
+func watch(sub *oplog.Subscription) (<-chan struct{}, <-chan struct{}) {
+	wake := make(chan struct{}, 1)
+	lost := make(chan struct{})
+
+	go func() {
+		defer close(lost)
+		for {
+			if _, err := sub.Read(); err != nil {
+				return
+			}
+			select {
+			case wake <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	return wake, lost
+}
+
+// fault - stops the projection for good and stores the reason
+func (p *Projection) fault(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.err = err.Error()
+	// the definition may be gone when the projection was deleted meanwhile
+	select {
+	case <-p.stop:
+		return
+	default:
+	}
+	_ = p.save()
+}
+
+// entry - an event read from the index
+type entry struct {
+	key   store.Key
+	value string
+}
+
+// catchUp - applies the events stored after the checkpoint in batches
+func (p *Projection) catchUp() error {
+	for {
+		select {
+		case <-p.stop:
+			return nil
+		default:
+		}
+
+		entries, last, err := p.fetch()
+		if err != nil {
+			return err
+		}
+		if last == p.Info().Checkpoint {
+			return nil
+		}
+
+		if err := p.apply(entries, last); err != nil {
+			return err
+		}
+	}
+}
+
+// fetch - reads a batch of events from the index after the checkpoint, the batch ends at
+// the position of an event so that its links are not split from it. Links are left out,
+// their events are read at the same position. Returns the position of the last entry read.
+func (p *Projection) fetch() ([]entry, ulid.ULID, error) {
+	last := p.Info().Checkpoint
+
+	var entries []entry
+	read := 0
+	opts := store.ScannerOptions{
+		Index:       true,
+		FetchValues: true,
+		Handler: func(k store.Key, v string) bool {
+			if read >= batchSize && k.ID != last {
+				return false
+			}
+			read++
+			last = k.ID
+
+			if !store.IsLink(v) {
+				entries = append(entries, entry{key: k, value: v})
+			}
+			return true
+		},
+	}
+	if last != (ulid.ULID{}) {
+		opts.Offset = append([]byte{}, last[:]...)
+	}
+
+	if err := p.db.Scan(opts); err != nil {
+		return nil, ulid.ULID{}, err
+	}
+
+	return entries, last, nil
+}
+
+// apply - reduces the events into the state of their partitions, stores the partitions
+// changed and moves the checkpoint to the last position read
+func (p *Projection) apply(entries []entry, last ulid.ULID) error {
+	filter := streammeta.NewFilter(p.db)
+	partitions := make(map[string]*partition)
+
+	for _, en := range entries {
+		if !p.prog.reads(en.key.Stream) {
+			continue
+		}
+
+		visible, err := filter.Visible(en.key)
+		if err != nil {
+			return err
+		}
+		if !visible {
+			continue
+		}
+
+		e, err := store.DecodeEvent(en.value)
+		if err != nil {
+			return fmt.Errorf("event %d@%s: %v", en.key.Version, en.key.Stream, err)
+		}
+		if !p.prog.handles(e.Type) {
+			continue
+		}
+
+		if err := p.applyEvent(partitions, en.key, e); err != nil {
+			return fmt.Errorf("event %d@%s: %v", en.key.Version, en.key.Stream, err)
+		}
+	}
+
+	for name, part := range partitions {
+		v, err := json.Marshal(part)
+		if err != nil {
+			return err
+		}
+		if err := p.db.SetMeta(store.ProjectionStateNamespace, p.name+partitionSeparator+name, string(v)); err != nil {
+			return err
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.checkpoint = last
+	return p.save()
+}
+
+// applyEvent - runs the handlers of the event against the state of its partition, the
+// event is skipped when its partition is null or empty or it was applied before
+func (p *Projection) applyEvent(partitions map[string]*partition, k store.Key, e store.Event) error {
+	name := ""
+	if p.prog.partition != nil {
+		v, err := p.prog.partition.eval(newEnv(k, e, map[string]interface{}{}))
+		if err != nil {
+			return err
+		}
+		if name = text(v); name == "" {
+			return nil
+		}
+	}
+
+	part, ok := partitions[name]
+	if !ok {
+		var err error
+		if part, err = p.load(name); err != nil {
+			return err
+		}
+		partitions[name] = part
+	}
+	if part.Position.Compare(k.ID) >= 0 {
+		return nil
+	}
+
+	env := newEnv(k, e, part.State)
+	for _, h := range p.prog.handlers {
+		if h.types != nil && !h.types[e.Type] {
+			continue
+		}
+		for _, s := range h.body {
+			if err := s.exec(env); err != nil {
+				return err
+			}
+		}
+	}
+	part.Position = k.ID
+
+	return nil
+}
+
+// load - the stored state of a partition, empty when no event was applied to it yet
+func (p *Projection) load(name string) (*partition, error) {
+	part := &partition{}
+
+	v, err := p.db.GetMeta(store.ProjectionStateNamespace, p.name+partitionSeparator+name)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal([]byte(v), part); err != nil {
+			return nil, fmt.Errorf("unable to load partition %q: %v", name, err)
+		}
+	}
+	if part.State == nil {
+		part.State = make(map[string]interface{})
+	}
+
+	return part, nil
+}
+
+// reads - determines if the program reads the events of the stream
+func (prog *Program) reads(stream store.StreamID) bool {
+	switch {
+	case prog.stream != "":
+		return string(stream) == prog.stream
+	case prog.category != "":
+		i := strings.IndexByte(string(stream), '-')
+		return i > 0 && string(stream[:i]) == prog.category
+	}
+	return true
+}
+
+// handles - determines if the program has a handler for the type of event
+func (prog *Program) handles(typ string) bool {
+	for _, h := range prog.handlers {
+		if h.types == nil || h.types[typ] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,351 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package projection
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maarek/aves/oplog"
+	"github.com/maarek/aves/store"
+	"github.com/maarek/aves/store/storetest"
+)
+
+// publish - appends the event with its system links and wakes the projections
+func publish(t *testing.T, db store.DB, topics *oplog.Topics, stream, typ, data string) {
+	t.Helper()
+
+	v := store.EncodeEvent(store.Event{Type: typ, Data: data})
+	keys, _, err := db.AppendLinked(store.StreamID(stream), store.ExpectAny, []string{v}, store.SystemLinks)
+	if err != nil {
+		t.Fatalf("append failed: %v", err)
+	}
+	topics.Write(stream, keys[0])
+}
+
+// await - waits for the state of the partition to become the JSON given
+func await(t *testing.T, r *Registry, name, partition, want string) {
+	t.Helper()
+
+	var got string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		state, ok, err := r.Get(name, partition)
+		if err != nil {
+			t.Fatalf("get failed: %v", err)
+		}
+		if !ok {
+			continue
+		}
+		if got = state; equalJSON(t, got, want) {
+			return
+		}
+	}
+	t.Fatalf("expected partition %q of %s to be %s, got %s", partition, name, want, got)
+}
+
+func equalJSON(t *testing.T, a, b string) bool {
+	var x, y interface{}
+	if err := json.Unmarshal([]byte(a), &x); err != nil {
+		t.Fatalf("invalid state %s: %v", a, err)
+	}
+	if err := json.Unmarshal([]byte(b), &y); err != nil {
+		t.Fatalf("invalid state %s: %v", b, err)
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, tc := range []struct {
+		src, err string
+	}{
+		{``, "at least one on handler"},
+		{`from nowhere on * {}`, "expected all, stream or category"},
+		{`on * { count = }`, "expected an expression"},
+		{`on * { count + 1 }`, "expected =, += or -="},
+		{`on * { data.total = 1 }`, "only the state can be changed"},
+		{`on * { state = 1 }`, "can not be replaced"},
+		{`on * { x = nope(1) }`, "unknown function"},
+		{"on * {\n x = \"open\n}", "line 2: unterminated string"},
+		{`on * { x = 1`, "expected }"},
+	} {
+		_, err := Parse(tc.src)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%q: expected an error containing %q, got %v", tc.src, tc.err, err)
+		}
+	}
+}
+
+func TestEval(t *testing.T) {
+	prog, err := Parse(`
+		# a bit of everything
+		on Placed {
+			count += 1
+			total = total + data.total
+			largest = max(largest, data.total)
+			lines = append(lines, data.sku)
+			customer.name = "#" + data.customer
+			if data.total >= 100 && !data.gift { big += 1 } else if data.gift { gifts += 1 } else { small += 1 }
+			last = event.type + "@" + event.stream + ":" + event.version
+		}
+		on Cancelled {
+			count -= 1
+			delete customer
+			share = len(lines) * 10 % 7 / 2
+		}
+	`)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	state := map[string]interface{}{}
+	run := func(version uint64, typ, data string) {
+		k := store.Key{Stream: store.StreamID("order-1"), Version: version}
+		env := newEnv(k, store.Event{Type: typ, Data: data}, state)
+		for _, h := range prog.handlers {
+			if h.types != nil && !h.types[typ] {
+				continue
+			}
+			for _, s := range h.body {
+				if err := s.exec(env); err != nil {
+					t.Fatalf("%s failed: %v", typ, err)
+				}
+			}
+		}
+	}
+
+	run(1, "Placed", `{"total": 120, "sku": "a", "customer": "ann"}`)
+	run(2, "Placed", `{"total": 30, "sku": "b", "customer": "bob", "gift": true}`)
+	run(3, "Placed", `{"total": 5, "sku": "c", "customer": "cat"}`)
+	got, _ := json.Marshal(state)
+	if !equalJSON(t, string(got), `{
+		"count": 3, "total": 155, "largest": 120, "lines": ["a", "b", "c"], "customer": {"name": "#cat"},
+		"big": 1, "gifts": 1, "small": 1, "last": "Placed@order-1:3"
+	}`) {
+		t.Fatalf("unexpected state %s", got)
+	}
+
+	run(4, "Cancelled", ``)
+	if state["count"] != float64(2) || state["customer"] != nil || state["share"] != float64(1) {
+		t.Fatalf("unexpected state %v", state)
+	}
+}
+
+func TestRuntimeErrors(t *testing.T) {
+	for _, tc := range []struct {
+		src, err string
+	}{
+		{`on * { x = 1 / 0 }`, "division by zero"},
+		{`on * { x = data.name * 2 }`, "expected a number"},
+		{`on * { x = len(1) }`, "len: can not measure"},
+		{`on * { x = 1; x.y = 2 }`, "can not set"},
+	} {
+		prog, err := Parse(tc.src)
+		if err != nil {
+			t.Fatalf("%q: parse failed: %v", tc.src, err)
+		}
+
+		env := newEnv(store.Key{}, store.Event{Data: `{"name": "a"}`}, map[string]interface{}{})
+		for _, s := range prog.handlers[0].body {
+			if err = s.exec(env); err != nil {
+				break
+			}
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%q: expected an error containing %q, got %v", tc.src, tc.err, err)
+		}
+	}
+}
+
+func TestOutOfRangeIndex(t *testing.T) {
+	prog, err := Parse(`on * { lines = append(lines, 1); first = lines[data.i] }`)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	assign, err := Parse(`on * { lines = append(lines, 1); lines[data.i] = 2 }`)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	for _, i := range []string{"1", "-1", "1e20", "-1e20", "1e300"} {
+		data := `{"i": ` + i + `}`
+
+		state := map[string]interface{}{}
+		env := newEnv(store.Key{}, store.Event{Data: data}, state)
+		for _, s := range prog.handlers[0].body {
+			if err := s.exec(env); err != nil {
+				t.Fatalf("%s: read failed: %v", i, err)
+			}
+		}
+		if first, ok := state["first"]; !ok || first != nil {
+			t.Errorf("%s: expected null, got %v", i, first)
+		}
+
+		env = newEnv(store.Key{}, store.Event{Data: data}, map[string]interface{}{})
+		for _, s := range assign.handlers[0].body {
+			if err = s.exec(env); err != nil {
+				break
+			}
+		}
+		if err == nil || !strings.Contains(err.Error(), "out of range") {
+			t.Errorf("%s: expected an out of range error, got %v", i, err)
+		}
+	}
+}
+
+func TestProjection(t *testing.T) {
+	db := storetest.OpenMemory(t)
+	topics := oplog.NewTopics(oplog.DefaultOptions)
+
+	r := NewRegistry(db, topics)
+	if err := r.Start(); err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+
+	// events stored before the projection is created are applied too
+	publish(t, db, topics, "order-1", "Placed", `{"total": 10}`)
+	publish(t, db, topics, "user-1", "Placed", `{"total": 1000}`)
+
+	src := `
+		from category order
+		partition by event.stream
+		on Placed { count += 1; total += data.total }
+	`
+	if err := r.Create("totals", src); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	if err := r.Create("totals", src); err != ErrProjectionExists {
+		t.Fatalf("expected the projection to exist, got %v", err)
+	}
+	if err := r.Create("counts", `on * { events += 1 }`); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+
+	publish(t, db, topics, "order-2", "Placed", `{"total": 5}`)
+	publish(t, db, topics, "order-1", "Placed", `{"total": 20}`)
+	publish(t, db, topics, "order-1", "Shipped", `{}`)
+
+	await(t, r, "totals", "order-1", `{"count": 2, "total": 30}`)
+	await(t, r, "totals", "order-2", `{"count": 1, "total": 5}`)
+	// the links written to $ce-order and $et-Placed are not applied again
+	await(t, r, "counts", "", `{"events": 5}`)
+
+	if _, ok, err := r.Get("totals", "user-1"); ok || err != nil {
+		t.Fatalf("expected no state for user-1, got %v %v", ok, err)
+	}
+	if _, _, err := r.Get("missing", ""); err != ErrNoProjection {
+		t.Fatalf("expected no projection, got %v", err)
+	}
+
+	// a restarted registry picks up after the checkpoint
+	r.Stop()
+	publish(t, db, topics, "order-2", "Placed", `{"total": 7}`)
+
+	r = NewRegistry(db, topics)
+	if err := r.Start(); err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	defer r.Stop()
+
+	await(t, r, "totals", "order-2", `{"count": 2, "total": 12}`)
+	await(t, r, "counts", "", `{"events": 6}`)
+
+	infos := r.List()
+	if len(infos) != 2 || infos[0].Name != "counts" || infos[1].Name != "totals" || infos[1].Error != "" {
+		t.Fatalf("unexpected projections %+v", infos)
+	}
+
+	if err := r.Delete("totals"); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if _, _, err := r.Get("totals", "order-1"); err != ErrNoProjection {
+		t.Fatalf("expected no projection, got %v", err)
+	}
+
+	// the state of a deleted projection is gone when it is created again
+	if err := r.Create("totals", `on Shipped { shipped += 1 }`); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	await(t, r, "totals", "", `{"shipped": 1}`)
+	if _, ok, _ := r.Get("totals", "order-1"); ok {
+		t.Fatal("expected the state of order-1 to be removed")
+	}
+}
+
+func TestFaultedProjection(t *testing.T) {
+	db := storetest.OpenMemory(t)
+	topics := oplog.NewTopics(oplog.DefaultOptions)
+
+	r := NewRegistry(db, topics)
+	if err := r.Start(); err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+
+	publish(t, db, topics, "order-1", "Placed", `{"total": 10}`)
+	publish(t, db, topics, "order-1", "Placed", `{"total": 0}`)
+
+	if err := r.Create("ratio", `on Placed { ratio = 100 / data.total }`); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+
+	var info Info
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline) && info.Error == ""; time.Sleep(5 * time.Millisecond) {
+		info = r.List()[0]
+	}
+	if !strings.Contains(info.Error, "event 2@order-1: division by zero") {
+		t.Fatalf("expected the projection to fault, got %+v", info)
+	}
+	r.Stop()
+
+	// the fault is kept across restarts
+	r = NewRegistry(db, topics)
+	if err := r.Start(); err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	defer r.Stop()
+
+	if info := r.List()[0]; info.Error == "" {
+		t.Fatalf("expected the projection to stay faulted, got %+v", info)
+	}
+}
+
+func TestFaultedIndex(t *testing.T) {
+	db := storetest.OpenMemory(t)
+	topics := oplog.NewTopics(oplog.DefaultOptions)
+
+	r := NewRegistry(db, topics)
+	if err := r.Start(); err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	defer r.Stop()
+
+	if err := r.Create("lines", `on Placed { lines = append(lines, data.i); lines[data.i] = 1 }`); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	publish(t, db, topics, "order-1", "Placed", `{"i": 0}`)
+	publish(t, db, topics, "order-1", "Placed", `{"i": 1e20}`)
+
+	var info Info
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline) && info.Error == ""; time.Sleep(5 * time.Millisecond) {
+		info = r.List()[0]
+	}
+	if !strings.HasPrefix(info.Error, "event 2@order-1: array index") || !strings.HasSuffix(info.Error, "is out of range") {
+		t.Fatalf("expected the projection to fault, got %+v", info)
+	}
+}
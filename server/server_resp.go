@@ -18,17 +18,26 @@ package aves
 
 import (
 	"bytes"
+	"expvar"
 	"fmt"
 	"log"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/alash3al/go-color"
 	"github.com/maarek/aves"
 	cmds "github.com/maarek/aves/commands"
+	"github.com/maarek/aves/consumer"
 	"github.com/maarek/aves/oplog"
+	"github.com/maarek/aves/projection"
 	"github.com/maarek/aves/store"
 	"github.com/maarek/aves/store/badger"
+	"github.com/maarek/aves/store/bolt"
+	"github.com/maarek/aves/store/memory"
 	"github.com/maarek/aves/store/pebble"
+	"github.com/maarek/aves/streammeta"
 	"github.com/tidwall/redcon"
 )
 
@@ -38,12 +47,22 @@ type Server struct {
 	dbType  store.DBType
 	path    string
 	verbose bool
+	oplog   oplog.Options
+
+	// how often events hidden by stream metadata are deleted, never when 0
+	scavenge time.Duration
+	// whether the $ce- and $et- link streams are written
+	systemLinks bool
 }
 
 // NewRespServer - creates a server for running the data store
 func NewRespServer(addr, dbt, out string, verbose bool) *Server {
 	var dbType store.DBType
 	switch dbt {
+	case "bolt":
+		dbType = store.BOLT
+	case "memory":
+		dbType = store.MEMORY
 	case "pebble":
 		dbType = store.PEBBLE
 	default:
@@ -55,9 +74,51 @@ func NewRespServer(addr, dbt, out string, verbose bool) *Server {
 		dbType:  dbType,
 		path:    out,
 		verbose: verbose,
+		oplog:   oplog.DefaultOptions,
+
+		scavenge:    DefaultScavengeInterval,
+		systemLinks: true,
 	}
 }
 
+// WithOplog - sets the buffer and slow subscriber policy of every subscription
+func (s *Server) WithOplog(opts oplog.Options) *Server {
+	s.oplog = opts
+	return s
+}
+
+// DefaultScavengeInterval - how often events hidden by stream metadata are deleted unless configured
+const DefaultScavengeInterval = time.Minute
+
+// WithScavenger - sets how often events hidden by stream metadata are deleted, 0 disables the scavenger
+func (s *Server) WithScavenger(interval time.Duration) *Server {
+	s.scavenge = interval
+	return s
+}
+
+// WithSystemLinks - sets whether published events are linked to the $ce-<category>
+// and $et-<type> streams, enabled unless configured
+func (s *Server) WithSystemLinks(enabled bool) *Server {
+	s.systemLinks = enabled
+	return s
+}
+
+// oplogVar - the oplog of the running server exposed with the runtime variables
+var oplogVar struct {
+	sync.Once
+	topics atomic.Value
+}
+
+// publishOplog - exposes the counters of the oplog at /debug/vars
+func publishOplog(topics *oplog.Topics) {
+	oplogVar.topics.Store(topics)
+	oplogVar.Do(func() {
+		expvar.Publish("oplog", expvar.Func(func() interface{} {
+			return oplogVar.topics.Load().(*oplog.Topics).Stats()
+		}))
+	})
+}
+
 // Start the RESP Server
 func (s *Server) Start() error {
 	// initialize the data store
@@ -66,7 +127,26 @@ func (s *Server) Start() error {
 		return fmt.Errorf("db error: %s", err.Error())
 	}
 
-	opl := oplog.NewBroadcaster()
+	opl := oplog.NewTopics(s.oplog)
+	publishOplog(opl)
+
+	groups := consumer.NewRegistry(db)
+
+	var links store.Linker
+	if s.systemLinks {
+		links = store.SystemLinks
+	}
+
+	projections := projection.NewRegistry(db, opl)
+	if err := projections.Start(); err != nil {
+		return fmt.Errorf("projection error: %s", err.Error())
+	}
+	defer projections.Stop()
+
+	if s.scavenge > 0 {
+		scavenger := streammeta.StartScavenger(db, s.scavenge)
+		defer scavenger.Stop()
+	}
 
 	return redcon.ListenAndServe(
 		s.addr,
@@ -114,11 +194,14 @@ func (s *Server) Start() error {
 
 			// dispatch the command and catch its errors
 			fn(&cmds.Context{
-				Conn:   conn,
-				Action: action,
-				Args:   args,
-				DB:     db,
-				OpLog:  opl,
+				Conn:        conn,
+				Action:      action,
+				Args:        args,
+				DB:          db,
+				OpLog:       opl,
+				Groups:      groups,
+				Links:       links,
+				Projections: projections,
 			})
 		},
 		func(conn redcon.Conn) bool {
@@ -134,8 +217,14 @@ func loadDB(dbType store.DBType, out string) (db store.DB, err error) {
 	switch dbType {
 	case store.BADGER:
 		db, err = badger.OpenDB(out)
+	case store.BOLT:
+		db, err = bolt.OpenDB(out)
 	case store.PEBBLE:
 		db, err = pebble.OpenDB(out)
+	case store.MEMORY:
+		db, err = memory.OpenDB()
+	default:
+		err = fmt.Errorf("unsupported database type %d", dbType)
 	}
 	if err != nil {
 		return nil, err
@@ -44,7 +44,7 @@ func BenchmarkBadger(b *testing.B) {
 
 	for i := 0; i < fill; i++ {
 		stream := store.GenUlid().String()
-		if _, err := conn.Do("PUBLISH", stream, i, "somepayload"); err != nil {
+		if _, err := conn.Do("PUBLISH", stream, "NO_STREAM", "somepayload"); err != nil {
 			b.Fatalf("%v", err.Error())
 		}
 	}
@@ -94,7 +94,7 @@ func BenchmarkPebble(b *testing.B) {
 
 	for i := 0; i < fill; i++ {
 		stream := store.GenUlid().String()
-		if _, err := conn.Do("PUBLISH", stream, i, "somepayload"); err != nil {
+		if _, err := conn.Do("PUBLISH", stream, "NO_STREAM", "somepayload"); err != nil {
 			b.Fatalf("%v", err.Error())
 		}
 	}
@@ -125,6 +125,55 @@ func BenchmarkPebble(b *testing.B) {
 	conn.Close()
 }
 
+func BenchmarkMemory(b *testing.B) {
+	b.ReportAllocs()
+	// Setup
+	go func() {
+		if err := NewRespServer(":6379", "memory", "", false).Start(); err != nil {
+			b.Errorf("server should start up without error %v", err.Error())
+		}
+	}()
+
+	time.Sleep(time.Second / 4)
+
+	conn, err := redis.Dial("tcp", ":6379", redis.DialConnectTimeout(time.Minute))
+	if err != nil {
+		b.Fatalf("%v", err.Error())
+	}
+
+	for i := 0; i < fill; i++ {
+		stream := store.GenUlid().String()
+		if _, err := conn.Do("PUBLISH", stream, "NO_STREAM", "somepayload"); err != nil {
+			b.Fatalf("%v", err.Error())
+		}
+	}
+
+	// Benchmarks
+	b.Run("BenchmarkMemorySet", func(b *testing.B) {
+		stream := store.GenUlid().String()
+		for n := 0; n < b.N; n++ {
+			if _, err := conn.Do("PUBLISH", stream, n, "somepayload"); err != nil {
+				b.Errorf("%v", err.Error())
+			}
+		}
+	})
+	b.Run("BenchmarkMemoryGet", func(b *testing.B) {
+		stream := store.GenUlid().String()
+		for n := 0; n < b.N; n++ {
+			if _, err := conn.Do("ELIST", stream); err != nil {
+				b.Errorf("%v", err.Error())
+			}
+		}
+	})
+
+	// Cleanup
+	if _, err := conn.Do("QUIT"); err != nil {
+		b.Fatalf("%v", err.Error())
+	}
+
+	conn.Close()
+}
+
 func cleanupDir(dir string) { // The target directory.
 	_ = os.RemoveAll(dir)
 }
@@ -0,0 +1,134 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package servertest runs a server backed by an in memory store for the tests of the
+// commands and the client. The tests of a package share the server, each test writes to
+// streams of its own.
+package servertest
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/maarek/aves/client"
+	su "github.com/maarek/aves/server"
+	"github.com/maarek/aves/store"
+)
+
+var server struct {
+	sync.Once
+	addr string
+	err  error
+}
+
+// start - starts a server on a free port and waits for it to accept connections
+func start() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	failed := make(chan error, 1)
+	go func() {
+		failed <- su.NewRespServer(addr, "memory", "", false).WithScavenger(0).Start()
+	}()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		select {
+		case err := <-failed:
+			return "", err
+		default:
+		}
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return addr, nil
+		}
+	}
+	return "", fmt.Errorf("server did not start listening on %s", addr)
+}
+
+// Start - starts a server of its own for a test changing what the other tests share,
+// such as the system streams, and returns its address
+func Start(t *testing.T) string {
+	t.Helper()
+
+	addr, err := start()
+	if err != nil {
+		t.Fatalf("server failed: %v", err)
+	}
+	return addr
+}
+
+// Addr - the address of the shared server, started by the first test asking for it
+func Addr(t *testing.T) string {
+	t.Helper()
+
+	server.Do(func() {
+		server.addr, server.err = start()
+	})
+	if server.err != nil {
+		t.Fatalf("server failed: %v", server.err)
+	}
+	return server.addr
+}
+
+// Dial - a connection to the shared server, closed when the test ends
+func Dial(t *testing.T) redis.Conn {
+	t.Helper()
+	return DialAddr(t, Addr(t))
+}
+
+// DialAddr - a connection to the server at the address, closed when the test ends
+func DialAddr(t *testing.T, addr string) redis.Conn {
+	t.Helper()
+
+	conn, err := redis.Dial("tcp", addr, redis.DialReadTimeout(5*time.Second))
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// Client - a client of the shared server, closed when the test ends
+func Client(t *testing.T) *client.Context {
+	t.Helper()
+	return ClientAddr(t, Addr(t))
+}
+
+// ClientAddr - a client of the server at the address, closed when the test ends
+func ClientAddr(t *testing.T, addr string) *client.Context {
+	t.Helper()
+
+	c, err := client.NewClient(addr)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// Name - a name no other test uses, without a '-' so that it can be used as a category
+func Name() string {
+	return strings.ToLower(store.GenUlid().String())
+}
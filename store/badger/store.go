@@ -19,7 +19,8 @@ package badger
 import (
 	"bytes"
 	"fmt"
-	"strings"
+	"math"
+	"sync"
 
 	"github.com/dgraph-io/badger/v2"
 	"github.com/dgraph-io/badger/v2/options"
@@ -30,6 +31,12 @@ import (
 // DB - represents a badger db implementation
 type DB struct {
 	badger *badger.DB
+
+	// serializes writes so that stream heads are checked and written atomically
+	mu sync.Mutex
+
+	// assigns global positions in commit order
+	ids *store.Monotonic
 }
 
 // OpenDB - Opens the specified path
@@ -53,6 +60,22 @@ func OpenDB(path string) (*DB, error) {
 	db := new(DB)
 	db.badger = bdb
 
+	var last ulid.ULID
+	err = bdb.View(func(txn *badger.Txn) (err error) {
+		last, err = lastPosition(txn)
+		return err
+	})
+	if err != nil {
+		bdb.Close()
+		return nil, err
+	}
+	db.ids = store.NewMonotonic(last)
+
+	if err := store.BuildCatalog(db); err != nil {
+		bdb.Close()
+		return nil, err
+	}
+
 	go (func() {
 		for db.badger.RunValueLogGC(0.5) == nil {
 			// cleaning ...
@@ -73,7 +96,7 @@ func (db *DB) Size() int64 {
 	return lsm + vlog
 }
 
-// GC - runs the garbage collector
+// GC - runs the garbage collector until there is nothing left to rewrite
 func (db *DB) GC() error {
 	var err error
 	for {
@@ -82,48 +105,276 @@ func (db *DB) GC() error {
 			break
 		}
 	}
+	if err == badger.ErrNoRewrite || err == badger.ErrRejected {
+		return nil
+	}
 	return err
 }
 
 // Set - sets a key with the specified value if the version doesn't exist
 func (db *DB) Set(k store.Key, v string) error {
+	if k.Version == 0 {
+		return fmt.Errorf("unable to pack key %v", k)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
 	return db.badger.Update(func(txn *badger.Txn) (err error) {
-		key, err := packStream(k)
+		key, err := store.PackStream(k)
 		if err != nil {
 			return err
 		}
 
 		item, err := txn.Get(key)
-		if err != nil && err.Error() != "Key not found" {
+		if err != nil && err != badger.ErrKeyNotFound {
 			return err
 		}
 		if item != nil {
 			return fmt.Errorf("event for key exists %v", k)
 		}
 
-		err = txn.Set(key, []byte(v))
+		if err := checkTombstone(txn, k.Stream); err != nil {
+			return err
+		}
+
+		db.ids.Observe(k.ID)
+
+		c := catalog(txn)
+		if err := setEvent(txn, c, k, v); err != nil {
+			return err
+		}
+
+		return c.Write(txn.Set)
+	})
+}
+
+// Append - appends an event to the stream if its head matches the expected version
+func (db *DB) Append(stream store.StreamID, expected int64, v string) (store.Key, error) {
+	keys, err := db.AppendBatch(stream, expected, []string{v})
+	if err != nil {
+		return store.Key{}, err
+	}
+	return keys[0], nil
+}
+
+// AppendBatch - appends all events to the stream in a single transaction
+// if its head matches the expected version
+func (db *DB) AppendBatch(stream store.StreamID, expected int64, values []string) ([]store.Key, error) {
+	keys, _, err := db.AppendLinked(stream, expected, values, nil)
+	return keys, err
+}
+
+// AppendLinked - appends all events to the stream in a single transaction if its head matches
+// the expected version, along with the links of each event to the streams given by the linker
+func (db *DB) AppendLinked(stream store.StreamID, expected int64, values []string, linker store.Linker) ([]store.Key, []store.Key, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var keys, linked []store.Key
+	err := db.badger.Update(func(txn *badger.Txn) error {
+		if err := checkTombstone(txn, stream); err != nil {
+			return err
+		}
+
+		head, err := streamHead(txn, stream)
 		if err != nil {
 			return err
 		}
 
-		id := [16]byte(store.GenUlid())
-		key = packIndex(id[:], k.Stream[:], k.Version)
-		err = txn.Set(key, []byte(v))
+		if err := store.CheckExpectedVersion(stream, expected, head); err != nil {
+			return err
+		}
 
+		links := store.NewLinks(linker, func(link store.StreamID) (uint64, error) {
+			if err := checkTombstone(txn, link); err != nil {
+				return 0, err
+			}
+			return streamHead(txn, link)
+		})
+
+		c := catalog(txn)
+		keys = make([]store.Key, len(values))
+		for i, v := range values {
+			keys[i] = store.Key{ID: db.ids.Next(), Stream: stream, Version: head + uint64(i) + 1}
+			if err := setEvent(txn, c, keys[i], v); err != nil {
+				return err
+			}
+			if err := setLinks(txn, c, links, keys[i], v); err != nil {
+				return err
+			}
+		}
+		linked = links.Keys
+
+		return c.Write(txn.Set)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return keys, linked, nil
+}
+
+// setEvent - writes the event and its time series index entry and records it in the catalog
+func setEvent(txn *badger.Txn, c *store.Catalog, k store.Key, v string) error {
+	key, err := store.PackStream(k)
+	if err != nil {
+		return err
+	}
+
+	record := store.EncodeRecord(k.ID, v)
+
+	err = txn.Set(key, record)
+	if err != nil {
 		return err
+	}
+
+	key = store.PackIndex(k)
+
+	err = txn.Set(key, record)
+	if err != nil {
+		return err
+	}
+
+	return c.Add(k, len(record))
+}
+
+// setLinks - writes the links of the event
+func setLinks(txn *badger.Txn, c *store.Catalog, links *store.Links, k store.Key, v string) error {
+	keys, err := links.Next(k, v)
+	if err != nil {
+		return err
+	}
+	for _, link := range keys {
+		if err := setEvent(txn, c, link, store.EncodeLink(k)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// catalog - the catalog records changed by a write, read within the transaction
+func catalog(txn *badger.Txn) *store.Catalog {
+	return store.NewCatalog(func(key []byte) ([]byte, error) {
+		item, err := txn.Get(key)
+		if err == badger.ErrKeyNotFound {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return item.ValueCopy(nil)
 	})
 }
 
+// lastPosition - finds the global position of the last event written, zero when there are none
+func lastPosition(txn *badger.Txn) (ulid.ULID, error) {
+	var id ulid.ULID
+	prefix := store.IndexScanPrefix(nil)
+
+	iteratorOpts := badger.DefaultIteratorOptions
+	iteratorOpts.PrefetchValues = false
+	iteratorOpts.Reverse = true
+
+	it := txn.NewIterator(iteratorOpts)
+	defer it.Close()
+
+	it.Seek(store.UpperBound(prefix))
+	if !it.ValidForPrefix(prefix) {
+		return id, nil
+	}
+
+	k, err := store.UnpackIndex(it.Item().Key())
+	if err != nil {
+		return id, err
+	}
+
+	return k.ID, nil
+}
+
+// checkTombstone - rejects writes to a stream that was hard deleted
+func checkTombstone(txn *badger.Txn, stream store.StreamID) error {
+	_, err := txn.Get(store.PackMeta(store.TombstoneNamespace, string(stream)))
+	if err == badger.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return store.ErrStreamDeleted
+}
+
+// streamHead - finds the highest version written to a stream, 0 when it has no events
+func streamHead(txn *badger.Txn, stream store.StreamID) (uint64, error) {
+	prefix := store.StreamScanPrefix(stream)
+
+	iteratorOpts := badger.DefaultIteratorOptions
+	iteratorOpts.PrefetchValues = false
+	iteratorOpts.Reverse = true
+
+	it := txn.NewIterator(iteratorOpts)
+	defer it.Close()
+
+	// seek past the highest possible version and walk back to the last event
+	seek := append(append([]byte{}, prefix...), bytes.Repeat([]byte{0xff}, store.VersionSize)...)
+
+	for it.Seek(seek); it.ValidForPrefix(prefix); it.Next() {
+		key := it.Item().Key()
+		if len(key) != len(prefix)+store.VersionSize {
+			continue
+		}
+		return store.DecodeVersion(key[len(prefix):])
+	}
+
+	return 0, nil
+}
+
 // Get - fetches the value of the specified key
 func (db *DB) Get(k store.Key) (string, error) {
 	var data string
 
 	err := db.badger.View(func(txn *badger.Txn) error {
-		key, err := packStream(k)
+		key, err := store.PackStream(k)
 		if err != nil {
 			return err
 		}
 		item, err := txn.Get(key)
+		if err == badger.ErrKeyNotFound {
+			return store.ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+
+		_, data, err = store.DecodeRecord(val)
+
+		return err
+	})
+
+	return data, err
+}
+
+// SetMeta - sets a value in the namespace
+func (db *DB) SetMeta(ns store.Namespace, key, v string) error {
+	return db.badger.Update(func(txn *badger.Txn) error {
+		return txn.Set(store.PackMeta(ns, key), []byte(v))
+	})
+}
+
+// GetMeta - fetches a value of the namespace
+func (db *DB) GetMeta(ns store.Namespace, key string) (string, error) {
+	var data string
+
+	err := db.badger.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(store.PackMeta(ns, key))
+		if err == badger.ErrKeyNotFound {
+			return store.ErrNotFound
+		}
 		if err != nil {
 			return err
 		}
@@ -141,210 +392,374 @@ func (db *DB) Get(k store.Key) (string, error) {
 	return data, err
 }
 
-// Del - removes key(s) from the store
-func (db *DB) Del(keys []string) error {
-	return db.badger.Update(func(txn1 *badger.Txn) error {
-		for _, key := range keys {
-			keyLen := len(key)
-			keyCopy := key
-
-			// scan for keys with prefix
-			err := db.badger.View(func(txn2 *badger.Txn) error {
-				it := txn2.NewIterator(badger.DefaultIteratorOptions)
-				defer it.Close()
-
-				// TODO: Move to Pack
-				var sb strings.Builder
-				sb.Grow(2 + keyLen)
-				sb.WriteString("s:")
-				sb.WriteString(keyCopy)
-				prefix := []byte(sb.String())
-
-				for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-					item := it.Item()
-					k := item.Key()
-					// delete each key
-					err := txn1.Delete(k)
-					if err != nil {
-						return err
-					}
-				}
-				return nil
-			})
+// DelMeta - removes a value from the namespace
+func (db *DB) DelMeta(ns store.Namespace, key string) error {
+	return db.badger.Update(func(txn *badger.Txn) error {
+		return txn.Delete(store.PackMeta(ns, key))
+	})
+}
+
+// ScanMeta - passes every value of the namespace to the handler in key order
+func (db *DB) ScanMeta(ns store.Namespace, handler store.MetaHandler) error {
+	return db.ScanMetaFrom(ns, "", handler)
+}
+
+// ScanMetaFrom - passes the values of the namespace from the key given onwards to the handler in key order
+func (db *DB) ScanMetaFrom(ns store.Namespace, from string, handler store.MetaHandler) error {
+	prefix := store.PackMeta(ns, "")
+
+	return db.badger.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(store.PackMeta(ns, from)); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+
+			val, err := item.ValueCopy(nil)
 			if err != nil {
 				return err
 			}
+
+			if !handler(string(item.Key()[len(prefix):]), string(val)) {
+				break
+			}
 		}
 
 		return nil
 	})
 }
 
-// Scan - iterate over the whole store using the handler function
-func (db *DB) Scan(scannerOpt store.ScannerOptions) error {
-	var prefix []byte
-	// Index scan for time
-	if scannerOpt.Index {
-		prefix = indexScanPrefix(scannerOpt.Prefix)
-	} else {
-		prefix = streamScanPrefix(scannerOpt.Prefix)
-	}
+// Head - finds the highest version written to a stream, 0 when it has no events
+func (db *DB) Head(stream store.StreamID) (uint64, error) {
+	var head uint64
 
-	return db.badger.View(func(txn *badger.Txn) error {
-		iteratorOpts := badger.DefaultIteratorOptions
-		iteratorOpts.PrefetchValues = scannerOpt.FetchValues
+	err := db.badger.View(func(txn *badger.Txn) (err error) {
+		head, err = streamHead(txn, stream)
+		return err
+	})
 
-		it := txn.NewIterator(iteratorOpts)
-		defer it.Close()
+	return head, err
+}
 
-		start := func(it *badger.Iterator) {
-			if len(prefix) == 0 {
-				it.Rewind()
-			} else {
-				it.Seek(prefix)
+// deleteBatch - the number of events removed per transaction, badger rejects a transaction
+// removing every event of a large stream as too big
+const deleteBatch = 1000
+
+// Truncate - removes the events of the stream before the version and their time series index entries,
+// a batch of events at a time with the catalog updated along with each batch
+func (db *DB) Truncate(stream store.StreamID, before uint64) error {
+	if len(stream) == 0 {
+		return fmt.Errorf("unable to truncate an empty stream name")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for done := false; !done; {
+		err := db.badger.Update(func(txn *badger.Txn) error {
+			events, size, err := eventKeys(txn, stream, before, deleteBatch)
+			if err != nil {
+				return err
 			}
-		}
+			done = len(events) < deleteBatch
 
-		valid := func(it *badger.Iterator) bool {
-			if !it.Valid() {
-				return false
+			if err := deleteEvents(txn, events); err != nil {
+				return err
 			}
 
-			if len(prefix) != 0 && !it.ValidForPrefix(prefix) {
-				return false
+			// the head is kept, appends carry on after the events removed
+			c := catalog(txn)
+			if err := c.Remove(stream, len(events), size); err != nil {
+				return err
 			}
 
-			return true
+			return c.Write(txn.Set)
+		})
+		if err != nil {
+			return err
 		}
+	}
 
-		seen := false
+	return nil
+}
 
-		for start(it); valid(it); it.Next() {
-			item := it.Item()
+// eventKeys - collects the keys of up to limit events in the stream before the version along
+// with the size of their records
+func eventKeys(txn *badger.Txn, stream store.StreamID, before uint64, limit int) ([]store.Key, int64, error) {
+	var events []store.Key
+	var size int64
 
-			hs := bytes.HasSuffix(item.Key(), scannerOpt.Offset)
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
 
-			// ignore up to offset
-			if !seen && !hs {
-				continue
-			}
+	prefix := store.StreamScanPrefix(stream)
+	for it.Seek(prefix); it.ValidForPrefix(prefix) && len(events) < limit; it.Next() {
+		item := it.Item()
 
-			seen = true
+		k, err := store.UnpackStream(item.Key())
+		if err != nil {
+			return nil, 0, err
+		}
+		if k.Version >= before {
+			break
+		}
 
-			if hs && !scannerOpt.IncludeOffset {
-				continue
-			}
+		// the record holds the position of the index entry
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		if k.ID, _, err = store.DecodeRecord(val); err != nil {
+			return nil, 0, err
+		}
 
-			var k, v []byte
+		events = append(events, k)
+		size += int64(len(val))
+	}
 
-			k = item.KeyCopy(nil)
+	return events, size, nil
+}
 
-			if scannerOpt.FetchValues {
-				v, _ = item.ValueCopy(nil)
-			}
+// deleteEvents - deletes the stream and time series index keys of the events
+func deleteEvents(txn *badger.Txn, events []store.Key) error {
+	for _, k := range events {
+		key, err := store.PackStream(k)
+		if err != nil {
+			return err
+		}
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+		if err := txn.Delete(store.PackIndex(k)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-			var key store.Key
-			var err error
+// Del - hard deletes the streams, removing their events, time series index entries, the links
+// to their events and the records kept besides them. The tombstones that reject any further
+// appends are written first and the events are then deleted a batch at a time, a stream whose
+// delete was interrupted is deleted again. Returns the head of every stream deleted, streams
+// already tombstoned are left out.
+func (db *DB) Del(streams []string) (map[string]uint64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	deleted := make(map[string]uint64)
+	gone := make(map[string]bool)
+	var pending []string
+	err := db.badger.Update(func(txn *badger.Txn) error {
+		for _, stream := range streams {
+			// an empty name would prefix every stream
+			if len(stream) == 0 || gone[stream] {
+				continue
+			}
+			gone[stream] = true
+			pending = append(pending, stream)
 
-			if scannerOpt.Index {
-				key, err = unpackIndex(k)
-			} else {
-				key, err = unpackStream(k)
+			err := checkTombstone(txn, store.StreamID(stream))
+			if err == store.ErrStreamDeleted {
+				continue
 			}
 			if err != nil {
-				return fmt.Errorf("invalid key format %s", string(k))
+				return err
 			}
 
-			if !scannerOpt.Handler(key, string(v)) {
-				break
+			if deleted[stream], err = streamHead(txn, store.StreamID(stream)); err != nil {
+				return err
+			}
+			if err := txn.Set(store.PackMeta(store.TombstoneNamespace, stream), nil); err != nil {
+				return err
 			}
 		}
-
 		return nil
 	})
-}
+	if err != nil {
+		return nil, err
+	}
 
-func streamScanIdentifier() []byte {
-	return []byte{'s', ':'}
-}
+	for _, stream := range pending {
+		for done := false; !done; {
+			err := db.badger.Update(func(txn *badger.Txn) error {
+				events, _, err := eventKeys(txn, store.StreamID(stream), math.MaxUint64, deleteBatch)
+				if err != nil {
+					return err
+				}
+				done = len(events) < deleteBatch
 
-func streamScanPrefix(prefix []byte) []byte {
-	if len(prefix) == 0 {
-		return streamScanIdentifier()
+				c := catalog(txn)
+				links, err := linkKeys(txn, c, events, gone)
+				if err != nil {
+					return err
+				}
+
+				if err := deleteEvents(txn, append(events, links...)); err != nil {
+					return err
+				}
+				return c.Write(txn.Set)
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	buf := make([]byte, len(prefix)+2)
-	copy(buf, streamScanIdentifier())
-	copy(buf[2:], prefix)
+	err = db.badger.Update(func(txn *badger.Txn) error {
+		for _, stream := range pending {
+			for _, k := range store.HardDeleteKeys(stream) {
+				if err := txn.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	return buf
+	return deleted, nil
 }
 
-func indexScanPrefix(ts []byte) []byte {
-	var buf []byte
-	buf = append(buf, 't', ':')
-	if len(ts) == 0 {
-		return buf
+// linkKeys - collects the keys of the links to the events from the streams not deleted along
+// with them, removing the links from the catalog. The head of a link stream is kept so that its
+// versions carry on from it, readers skip it once its event is gone.
+func linkKeys(txn *badger.Txn, c *store.Catalog, events []store.Key, gone map[string]bool) ([]store.Key, error) {
+	type found struct {
+		link store.Key
+		size int
 	}
 
-	// Nab the first 6 bytes of the time index
-	return append(buf, ts[:6]...)
-}
+	// a transaction writing has one iterator open at a time, the heads are looked up after
+	var candidates []found
+	err := func() error {
+		// a position holds a few keys, prefetching would read past them on every seek
+		iteratorOpts := badger.DefaultIteratorOptions
+		iteratorOpts.PrefetchValues = false
+
+		it := txn.NewIterator(iteratorOpts)
+		defer it.Close()
 
-func packStream(k store.Key) ([]byte, error) {
-	if len(k.Stream) == 0 {
-		return make([]byte, 0), fmt.Errorf("unable to pack key %v", k)
+		for _, k := range events {
+			prefix := store.PositionPrefix(k.ID)
+			for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+				item := it.Item()
+				v, err := item.ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+
+				link, ok, err := store.LinkTo(item.Key(), v, k)
+				if err != nil {
+					return err
+				}
+				if ok && !gone[string(link.Stream)] {
+					candidates = append(candidates, found{link: link, size: len(v)})
+				}
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		return nil, err
 	}
-	var buf []byte
-	buf = append(buf, 's', ':')
-	buf = append(buf, k.Stream[:]...)
-	if len(k.Version) > 0 {
-		buf = append(buf, ':')
-		buf = append(buf, k.Version...)
+
+	var links []store.Key
+	heads := make(map[string]uint64)
+	for _, f := range candidates {
+		head, seen := heads[string(f.link.Stream)]
+		if !seen {
+			if head, err = streamHead(txn, f.link.Stream); err != nil {
+				return nil, err
+			}
+			heads[string(f.link.Stream)] = head
+		}
+		if f.link.Version == head {
+			continue
+		}
+
+		links = append(links, f.link)
+		if err := c.Remove(f.link.Stream, 1, int64(f.size)); err != nil {
+			return nil, err
+		}
 	}
-	return buf, nil
-}
 
-func unpackStream(key []byte) (store.Key, error) {
-	k := store.Key{}
-	v := bytes.Split(key, []byte{':'})
+	return links, nil
+}
 
-	if len(v) < 3 && (len(v[1]) == 0 || len(v[2]) == 0) {
-		return k, fmt.Errorf("unable to unpack key %v", key)
+// Scan - iterate over the whole store using the handler function
+func (db *DB) Scan(scannerOpt store.ScannerOptions) error {
+	var prefix []byte
+	// Index scan for time
+	if scannerOpt.Index {
+		prefix = store.IndexScanPrefix(scannerOpt.Prefix)
+	} else {
+		prefix = store.StreamScanPrefix(scannerOpt.Prefix)
 	}
 
-	k.ID = ulid.ULID{}
-	k.Stream = store.StreamID(v[1])
-	k.Version = v[2]
+	// seek directly to the offset within the prefix
+	start := append(append([]byte{}, prefix...), scannerOpt.Offset...)
 
-	return k, nil
-}
+	return db.badger.View(func(txn *badger.Txn) error {
+		iteratorOpts := badger.DefaultIteratorOptions
+		iteratorOpts.PrefetchValues = scannerOpt.FetchValues
+		iteratorOpts.Reverse = scannerOpt.Reverse
 
-func packIndex(ts, stream, offset []byte) []byte {
-	var buf []byte
-	buf = append(buf, 't', ':')
-	buf = append(buf, ts...)
-	buf = append(buf, ':')
-	buf = append(buf, stream...)
-	buf = append(buf, ':')
-	buf = append(buf, offset...)
-	return buf
-}
+		it := txn.NewIterator(iteratorOpts)
+		defer it.Close()
 
-func unpackIndex(key []byte) (store.Key, error) {
-	k := store.Key{}
-	v := bytes.Split(key, []byte{':'})
+		// a reverse iterator seeks to the highest key at or below the bound, the keys
+		// at the bound are above the scan
+		seek := start
+		var bound []byte
+		if scannerOpt.Reverse {
+			bound = store.ReverseBound(prefix, scannerOpt.Offset, scannerOpt.IncludeOffset)
+			seek = bound
+		}
 
-	if len(v) == 4 && (len(v[1]) != 16 || len(v[2]) == 0 || len(v[3]) == 0) {
-		return k, fmt.Errorf("unable to unpack key %v", key)
-	}
+		for it.Seek(seek); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
 
-	var id ulid.ULID
-	copy(id[:], v[1])
+			if bound != nil && bytes.Compare(item.Key(), bound) >= 0 {
+				continue
+			}
 
-	k.ID = id
-	k.Stream = store.StreamID(v[2])
-	k.Version = v[3]
+			// every key at the offset starts with it, there can be several at an index position
+			if len(scannerOpt.Offset) > 0 && !scannerOpt.IncludeOffset && bytes.HasPrefix(item.Key(), start) {
+				continue
+			}
+
+			k := item.KeyCopy(nil)
+
+			var key store.Key
+			var err error
 
-	return k, nil
+			if scannerOpt.Index {
+				key, err = store.UnpackIndex(k)
+			} else {
+				key, err = store.UnpackStream(k)
+			}
+			if err != nil {
+				return fmt.Errorf("invalid key format %s", string(k))
+			}
+
+			var v string
+			if scannerOpt.FetchValues {
+				val, err := item.ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+				if key.ID, v, err = store.DecodeRecord(val); err != nil {
+					return err
+				}
+			}
+
+			if !scannerOpt.Handler(key, v) {
+				break
+			}
+		}
+
+		return nil
+	})
 }
@@ -0,0 +1,42 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/maarek/aves/store"
+	"github.com/maarek/aves/store/storetest"
+)
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.DB {
+		dir, err := ioutil.TempDir("", "aves-badger")
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		t.Cleanup(func() { os.RemoveAll(dir) })
+
+		db, err := OpenDB(dir)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		return db
+	})
+}
@@ -0,0 +1,782 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bolt
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/maarek/aves/store"
+	"github.com/oklog/ulid/v2"
+	bolt "go.etcd.io/bbolt"
+)
+
+// scanBatch - the number of events a scan reads within a read transaction
+const scanBatch = 256
+
+var (
+	// streamsBucket - holds a nested bucket per stream keyed by encoded version
+	streamsBucket = []byte("streams")
+	// indexBucket - holds the time series index keyed by packed index keys
+	indexBucket = []byte("index")
+	// metaBucket - holds the values stored besides the events keyed by packed meta keys
+	metaBucket = []byte("meta")
+)
+
+// DB - represents a bolt db implementation
+type DB struct {
+	bolt *bolt.DB
+
+	// assigns global positions in commit order, only used within write transactions
+	// which bolt runs one at a time
+	ids *store.Monotonic
+}
+
+// OpenDB - Opens the specified database file
+func OpenDB(path string) (*DB, error) {
+	bdb, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	var last ulid.ULID
+	err = bdb.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(streamsBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(metaBucket); err != nil {
+			return err
+		}
+		index, err := tx.CreateBucketIfNotExists(indexBucket)
+		if err != nil {
+			return err
+		}
+		last, err = lastPosition(index)
+		return err
+	})
+	if err != nil {
+		bdb.Close()
+		return nil, err
+	}
+
+	db := new(DB)
+	db.bolt = bdb
+	db.ids = store.NewMonotonic(last)
+
+	if err := store.BuildCatalog(db); err != nil {
+		bdb.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// Close - closes the database
+func (db *DB) Close() {
+	db.bolt.Close()
+}
+
+// Size - returns the size of the database file in bytes
+func (db *DB) Size() int64 {
+	var size int64
+	_ = db.bolt.View(func(tx *bolt.Tx) error {
+		size = tx.Size()
+		return nil
+	})
+	return size
+}
+
+// GC - runs the garbage collector, bolt reuses freed pages so there is nothing to collect
+func (db *DB) GC() error {
+	return nil
+}
+
+// Set - sets a key with the specified value if the version doesn't exist
+func (db *DB) Set(k store.Key, v string) error {
+	if len(k.Stream) == 0 || k.Version == 0 {
+		return fmt.Errorf("unable to pack key %v", k)
+	}
+
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		if tombstoned(tx, k.Stream) {
+			return store.ErrStreamDeleted
+		}
+
+		b, err := tx.Bucket(streamsBucket).CreateBucketIfNotExists(k.Stream)
+		if err != nil {
+			return err
+		}
+
+		if b.Get(store.EncodeVersion(k.Version)) != nil {
+			return fmt.Errorf("event for key exists %v", k)
+		}
+
+		db.ids.Observe(k.ID)
+
+		c := catalog(tx)
+		if err := setEvent(tx, c, b, k, v); err != nil {
+			return err
+		}
+
+		return c.Write(tx.Bucket(metaBucket).Put)
+	})
+}
+
+// Append - appends an event to the stream if its head matches the expected version
+func (db *DB) Append(stream store.StreamID, expected int64, v string) (store.Key, error) {
+	keys, err := db.AppendBatch(stream, expected, []string{v})
+	if err != nil {
+		return store.Key{}, err
+	}
+	return keys[0], nil
+}
+
+// AppendBatch - appends all events to the stream in a single transaction
+// if its head matches the expected version
+func (db *DB) AppendBatch(stream store.StreamID, expected int64, values []string) ([]store.Key, error) {
+	keys, _, err := db.AppendLinked(stream, expected, values, nil)
+	return keys, err
+}
+
+// AppendLinked - appends all events to the stream in a single transaction if its head matches
+// the expected version, along with the links of each event to the streams given by the linker
+func (db *DB) AppendLinked(stream store.StreamID, expected int64, values []string, linker store.Linker) ([]store.Key, []store.Key, error) {
+	if len(stream) == 0 {
+		return nil, nil, fmt.Errorf("unable to append to an empty stream name")
+	}
+
+	var keys, linked []store.Key
+	err := db.bolt.Update(func(tx *bolt.Tx) error {
+		if tombstoned(tx, stream) {
+			return store.ErrStreamDeleted
+		}
+
+		b, err := tx.Bucket(streamsBucket).CreateBucketIfNotExists(stream)
+		if err != nil {
+			return err
+		}
+
+		head, err := streamHead(b)
+		if err != nil {
+			return err
+		}
+
+		if err := store.CheckExpectedVersion(stream, expected, head); err != nil {
+			return err
+		}
+
+		links := store.NewLinks(linker, func(link store.StreamID) (uint64, error) {
+			if tombstoned(tx, link) {
+				return 0, store.ErrStreamDeleted
+			}
+			lb, err := tx.Bucket(streamsBucket).CreateBucketIfNotExists(link)
+			if err != nil {
+				return 0, err
+			}
+			return streamHead(lb)
+		})
+
+		c := catalog(tx)
+		keys = make([]store.Key, len(values))
+		for i, v := range values {
+			keys[i] = store.Key{ID: db.ids.Next(), Stream: stream, Version: head + uint64(i) + 1}
+			if err := setEvent(tx, c, b, keys[i], v); err != nil {
+				return err
+			}
+			if err := setLinks(tx, c, links, keys[i], v); err != nil {
+				return err
+			}
+		}
+		linked = links.Keys
+
+		return c.Write(tx.Bucket(metaBucket).Put)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return keys, linked, nil
+}
+
+// setLinks - writes the links of the event to the buckets of their link streams
+func setLinks(tx *bolt.Tx, c *store.Catalog, links *store.Links, k store.Key, v string) error {
+	keys, err := links.Next(k, v)
+	if err != nil {
+		return err
+	}
+	for _, link := range keys {
+		// the bucket of the link stream was created when its head was looked up
+		b := tx.Bucket(streamsBucket).Bucket(link.Stream)
+		if err := setEvent(tx, c, b, link, store.EncodeLink(k)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setEvent - writes the event to its stream bucket and the time series index and records it in the catalog
+func setEvent(tx *bolt.Tx, c *store.Catalog, b *bolt.Bucket, k store.Key, v string) error {
+	record := store.EncodeRecord(k.ID, v)
+
+	if err := b.Put(store.EncodeVersion(k.Version), record); err != nil {
+		return err
+	}
+
+	if err := tx.Bucket(indexBucket).Put(store.PackIndex(k), record); err != nil {
+		return err
+	}
+
+	return c.Add(k, len(record))
+}
+
+// catalog - the catalog records changed by a write, read from the meta bucket
+func catalog(tx *bolt.Tx) *store.Catalog {
+	return store.NewCatalog(func(key []byte) ([]byte, error) {
+		// values are only valid for the life of the transaction
+		if v := tx.Bucket(metaBucket).Get(key); v != nil {
+			return append([]byte{}, v...), nil
+		}
+		return nil, nil
+	})
+}
+
+// lastPosition - finds the global position of the last event written, zero when there are none
+func lastPosition(b *bolt.Bucket) (ulid.ULID, error) {
+	k, _ := b.Cursor().Last()
+	if k == nil {
+		return ulid.ULID{}, nil
+	}
+
+	key, err := store.UnpackIndex(k)
+	if err != nil {
+		return ulid.ULID{}, err
+	}
+
+	return key.ID, nil
+}
+
+// tombstoned - determines if the stream was hard deleted
+func tombstoned(tx *bolt.Tx, stream store.StreamID) bool {
+	return tx.Bucket(metaBucket).Get(store.PackMeta(store.TombstoneNamespace, string(stream))) != nil
+}
+
+// streamHead - finds the highest version written to a stream, 0 when it has no events
+func streamHead(b *bolt.Bucket) (uint64, error) {
+	k, _ := b.Cursor().Last()
+	if k == nil {
+		return 0, nil
+	}
+	return store.DecodeVersion(k)
+}
+
+// Get - fetches the value of the specified key
+func (db *DB) Get(k store.Key) (string, error) {
+	var data string
+
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(streamsBucket).Bucket(k.Stream)
+		if b == nil || k.Version == 0 {
+			return store.ErrNotFound
+		}
+
+		val := b.Get(store.EncodeVersion(k.Version))
+		if val == nil {
+			return store.ErrNotFound
+		}
+
+		var err error
+		_, data, err = store.DecodeRecord(val)
+
+		return err
+	})
+
+	return data, err
+}
+
+// SetMeta - sets a value in the namespace
+func (db *DB) SetMeta(ns store.Namespace, key, v string) error {
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Put(store.PackMeta(ns, key), []byte(v))
+	})
+}
+
+// GetMeta - fetches a value of the namespace
+func (db *DB) GetMeta(ns store.Namespace, key string) (string, error) {
+	var data string
+
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		val := tx.Bucket(metaBucket).Get(store.PackMeta(ns, key))
+		if val == nil {
+			return store.ErrNotFound
+		}
+
+		data = string(val)
+
+		return nil
+	})
+
+	return data, err
+}
+
+// DelMeta - removes a value from the namespace
+func (db *DB) DelMeta(ns store.Namespace, key string) error {
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Delete(store.PackMeta(ns, key))
+	})
+}
+
+// ScanMeta - passes every value of the namespace to the handler in key order
+func (db *DB) ScanMeta(ns store.Namespace, handler store.MetaHandler) error {
+	return db.ScanMetaFrom(ns, "", handler)
+}
+
+// ScanMetaFrom - passes the values of the namespace from the key given onwards to the handler in key order
+func (db *DB) ScanMetaFrom(ns store.Namespace, from string, handler store.MetaHandler) error {
+	prefix := store.PackMeta(ns, "")
+
+	return db.bolt.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(metaBucket).Cursor()
+		for k, v := c.Seek(store.PackMeta(ns, from)); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			if !handler(string(k[len(prefix):]), string(v)) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// Head - finds the highest version written to a stream, 0 when it has no events
+func (db *DB) Head(stream store.StreamID) (uint64, error) {
+	var head uint64
+
+	err := db.bolt.View(func(tx *bolt.Tx) (err error) {
+		b := tx.Bucket(streamsBucket).Bucket(stream)
+		if b == nil {
+			return nil
+		}
+		head, err = streamHead(b)
+		return err
+	})
+
+	return head, err
+}
+
+// Truncate - removes the events of the stream bucket before the version and their time series index entries
+func (db *DB) Truncate(stream store.StreamID, before uint64) error {
+	if len(stream) == 0 {
+		return fmt.Errorf("unable to truncate an empty stream name")
+	}
+
+	return db.bolt.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(streamsBucket).Bucket(stream)
+		if b == nil {
+			return nil
+		}
+
+		// collect first, deleting while walking a cursor skips keys
+		var versions [][]byte
+		var positions []store.Key
+		var size int64
+
+		end := store.EncodeVersion(before)
+		c := b.Cursor()
+		for k, v := c.First(); k != nil && bytes.Compare(k, end) < 0; k, v = c.Next() {
+			version, err := store.DecodeVersion(k)
+			if err != nil {
+				return err
+			}
+
+			// the record holds the position of the index entry
+			id, _, err := store.DecodeRecord(v)
+			if err != nil {
+				return err
+			}
+
+			versions = append(versions, append([]byte{}, k...))
+			positions = append(positions, store.Key{ID: id, Stream: stream, Version: version})
+			size += int64(len(v))
+		}
+
+		index := tx.Bucket(indexBucket)
+		for i := range versions {
+			if err := b.Delete(versions[i]); err != nil {
+				return err
+			}
+			if err := index.Delete(store.PackIndex(positions[i])); err != nil {
+				return err
+			}
+		}
+
+		// the head is kept, appends carry on after the events removed
+		cat := catalog(tx)
+		if err := cat.Remove(stream, len(versions), size); err != nil {
+			return err
+		}
+
+		return cat.Write(tx.Bucket(metaBucket).Put)
+	})
+}
+
+// Del - hard deletes the streams in a single transaction, removing their buckets, time series
+// index entries, the links to their events and the records kept besides them and leaving a
+// tombstone that rejects any further appends. Returns the head of every stream deleted, streams already tombstoned are
+// left out.
+func (db *DB) Del(streams []string) (map[string]uint64, error) {
+	deleted := make(map[string]uint64)
+
+	err := db.bolt.Update(func(tx *bolt.Tx) error {
+		buckets := tx.Bucket(streamsBucket)
+		index := tx.Bucket(indexBucket)
+		meta := tx.Bucket(metaBucket)
+
+		var events []store.Key
+		for _, stream := range streams {
+			_, seen := deleted[stream]
+			if len(stream) == 0 || seen || tombstoned(tx, store.StreamID(stream)) {
+				continue
+			}
+			deleted[stream] = 0
+
+			b := buckets.Bucket([]byte(stream))
+			if b == nil {
+				continue
+			}
+
+			head, err := streamHead(b)
+			if err != nil {
+				return err
+			}
+			deleted[stream] = head
+
+			// the records hold the positions of the index entries
+			err = b.ForEach(func(k, v []byte) error {
+				version, err := store.DecodeVersion(k)
+				if err != nil {
+					return err
+				}
+
+				id, _, err := store.DecodeRecord(v)
+				if err != nil {
+					return err
+				}
+
+				key := store.Key{ID: id, Stream: []byte(stream), Version: version}
+				events = append(events, key)
+				return index.Delete(store.PackIndex(key))
+			})
+			if err != nil {
+				return err
+			}
+
+			if err := buckets.DeleteBucket([]byte(stream)); err != nil {
+				return err
+			}
+		}
+
+		c := catalog(tx)
+		if err := deleteLinks(tx, c, events, deleted); err != nil {
+			return err
+		}
+		if err := c.Write(meta.Put); err != nil {
+			return err
+		}
+
+		for stream := range deleted {
+			for _, k := range store.HardDeleteKeys(stream) {
+				if err := meta.Delete(k); err != nil {
+					return err
+				}
+			}
+			if err := meta.Put(store.PackMeta(store.TombstoneNamespace, stream), []byte{}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return deleted, nil
+}
+
+// deleteLinks - deletes the links to the events from the streams not deleted along with them,
+// removing the links from the catalog. The head of a link stream is kept so that its versions
+// carry on from it, readers skip it once its event is gone.
+func deleteLinks(tx *bolt.Tx, c *store.Catalog, events []store.Key, deleted map[string]uint64) error {
+	index := tx.Bucket(indexBucket)
+	heads := make(map[string]uint64)
+
+	for _, k := range events {
+		// keys are collected first, a cursor moves past the key following one it deletes
+		var matched [][]byte
+		var links []store.Key
+		prefix := store.PositionPrefix(k.ID)
+		cur := index.Cursor()
+		for key, v := cur.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, v = cur.Next() {
+			link, ok, err := store.LinkTo(key, v, k)
+			if _, gone := deleted[string(link.Stream)]; err != nil || !ok || gone {
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			head, seen := heads[string(link.Stream)]
+			if !seen {
+				if b := tx.Bucket(streamsBucket).Bucket(link.Stream); b != nil {
+					if head, err = streamHead(b); err != nil {
+						return err
+					}
+				}
+				heads[string(link.Stream)] = head
+			}
+			if link.Version == head {
+				continue
+			}
+
+			matched = append(matched, append([]byte{}, key...))
+			links = append(links, link)
+			if err := c.Remove(link.Stream, 1, int64(len(v))); err != nil {
+				return err
+			}
+		}
+
+		for i, link := range links {
+			if b := tx.Bucket(streamsBucket).Bucket(link.Stream); b != nil {
+				if err := b.Delete(store.EncodeVersion(link.Version)); err != nil {
+					return err
+				}
+			}
+			if err := index.Delete(matched[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// scanned - an event read by a scan and not yet passed to its handler
+type scanned struct {
+	key   store.Key
+	value string
+}
+
+// Scan - iterate over the whole store using the handler function. The handlers read from
+// the database and a read transaction open while they run blocks a write growing the file,
+// along with the reads started behind it. The events are read in batches and passed to the
+// handler once the transaction reading them is closed.
+func (db *DB) Scan(scannerOpt store.ScannerOptions) error {
+	opts := scannerOpt
+
+	// the stream a scan of every stream carries on from, at the offset of the batch
+	var from, offset []byte
+
+	for {
+		var batch []scanned
+		var stopped *store.Key
+		opts.Handler = func(k store.Key, v string) bool {
+			// a batch of the index ends at a new position, the next one starts at it
+			if len(batch) >= scanBatch && (!opts.Index || k.ID != batch[len(batch)-1].key.ID) {
+				stopped = &k
+				return false
+			}
+			batch = append(batch, scanned{key: k, value: v})
+			return true
+		}
+
+		err := db.bolt.View(func(tx *bolt.Tx) error {
+			return scan(tx, opts, from, offset)
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, e := range batch {
+			if !scannerOpt.Handler(e.key, e.value) {
+				return nil
+			}
+		}
+		if stopped == nil {
+			return nil
+		}
+
+		// the next batch starts at the event the last one stopped at
+		switch {
+		case opts.Index:
+			id := stopped.ID
+			opts.Offset, opts.IncludeOffset = id[:], true
+		case len(opts.Prefix) > 0:
+			opts.Offset, opts.IncludeOffset = store.EncodeVersion(stopped.Version), true
+		default:
+			from, offset = stopped.Stream, store.EncodeVersion(stopped.Version)
+		}
+	}
+}
+
+// scan - passes the events of a scan to the handler within the transaction, a scan of every
+// stream starts at the version given of the stream from when it is set
+func scan(tx *bolt.Tx, scannerOpt store.ScannerOptions, from, offset []byte) error {
+	// Index scan for time
+	if scannerOpt.Index {
+		return scanIndex(tx.Bucket(indexBucket), scannerOpt)
+	}
+
+	streams := tx.Bucket(streamsBucket)
+
+	if len(scannerOpt.Prefix) > 0 {
+		b := streams.Bucket(scannerOpt.Prefix)
+		if b == nil {
+			return nil
+		}
+		_, err := scanStream(b, scannerOpt.Prefix, scannerOpt)
+		return err
+	}
+
+	// walk every stream bucket in key order
+	c := streams.Cursor()
+	first, next := c.First, c.Next
+	if scannerOpt.Reverse {
+		first, next = c.Last, c.Prev
+	}
+	if from != nil {
+		first = func() ([]byte, []byte) {
+			name, v := c.Seek(from)
+			if scannerOpt.Reverse && !bytes.Equal(name, from) {
+				return seekBelow(c, from)
+			}
+			return name, v
+		}
+	}
+
+	for name, v := first(); name != nil; name, v = next() {
+		if v != nil {
+			continue
+		}
+
+		opts := scannerOpt
+		if bytes.Equal(name, from) {
+			opts.Offset, opts.IncludeOffset = offset, true
+		}
+
+		more, err := scanStream(streams.Bucket(name), name, opts)
+		if err != nil || !more {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// seekBelow - moves the cursor to the last key below the bound, to the last key when there is no bound
+func seekBelow(c *bolt.Cursor, bound []byte) ([]byte, []byte) {
+	if bound == nil {
+		return c.Last()
+	}
+	if k, _ := c.Seek(bound); k == nil {
+		return c.Last()
+	}
+	return c.Prev()
+}
+
+// scanStream - passes the events of a stream bucket to the handler, returning false when the handler stopped
+func scanStream(b *bolt.Bucket, stream []byte, scannerOpt store.ScannerOptions) (bool, error) {
+	c := b.Cursor()
+
+	var k, v []byte
+	next := c.Next
+	switch {
+	case scannerOpt.Reverse:
+		k, v = seekBelow(c, store.ReverseBound(nil, scannerOpt.Offset, scannerOpt.IncludeOffset))
+		next = c.Prev
+	case len(scannerOpt.Offset) > 0:
+		k, v = c.Seek(scannerOpt.Offset)
+	default:
+		k, v = c.First()
+	}
+
+	for ; k != nil; k, v = next() {
+		if len(scannerOpt.Offset) > 0 && !scannerOpt.IncludeOffset && bytes.Equal(k, scannerOpt.Offset) {
+			continue
+		}
+
+		version, err := store.DecodeVersion(k)
+		if err != nil {
+			return false, fmt.Errorf("invalid key format %s", string(k))
+		}
+
+		key := store.Key{
+			Stream:  store.StreamID(append([]byte{}, stream...)),
+			Version: version,
+		}
+
+		var val string
+		if scannerOpt.FetchValues {
+			if key.ID, val, err = store.DecodeRecord(v); err != nil {
+				return false, err
+			}
+		}
+
+		if !scannerOpt.Handler(key, val) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// scanIndex - passes the events of the time series index to the handler
+func scanIndex(b *bolt.Bucket, scannerOpt store.ScannerOptions) error {
+	prefix := store.IndexScanPrefix(scannerOpt.Prefix)
+	start := append(append([]byte{}, prefix...), scannerOpt.Offset...)
+
+	c := b.Cursor()
+	k, v := c.Seek(start)
+	next := c.Next
+	if scannerOpt.Reverse {
+		k, v = seekBelow(c, store.ReverseBound(prefix, scannerOpt.Offset, scannerOpt.IncludeOffset))
+		next = c.Prev
+	}
+
+	for ; k != nil && bytes.HasPrefix(k, prefix); k, v = next() {
+		// every key at the offset starts with it, there can be several at an index position
+		if len(scannerOpt.Offset) > 0 && !scannerOpt.IncludeOffset && bytes.HasPrefix(k, start) {
+			continue
+		}
+
+		key, err := store.UnpackIndex(k)
+		if err != nil {
+			return fmt.Errorf("invalid key format %s", string(k))
+		}
+
+		var val string
+		if scannerOpt.FetchValues {
+			if key.ID, val, err = store.DecodeRecord(v); err != nil {
+				return err
+			}
+		}
+
+		if !scannerOpt.Handler(key, val) {
+			break
+		}
+	}
+
+	return nil
+}
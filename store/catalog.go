@@ -0,0 +1,223 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// The catalog holds a record of every stream with events, written by the stores in the
+// same transaction as the events so that listing the streams does not read the events.
+// A hard delete removes the record of the stream along with its events.
+
+// CatalogBuilt - the key of the value written once the catalog of a database is built
+const CatalogBuilt = "catalog"
+
+// StreamInfo - the catalog record of a stream
+type StreamInfo struct {
+	// the highest version written
+	Head uint64 `json:"head"`
+	// the number of events stored, lower than the head once the stream was truncated
+	Count uint64 `json:"count"`
+	// the size in bytes of the events stored
+	Size int64 `json:"size"`
+	// the time the first and the last event were written, taken from their positions
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+// Catalog - the catalog records changed by a write, each record is loaded once and written
+// when the write commits
+type Catalog struct {
+	load    func(key []byte) ([]byte, error)
+	changed map[string]*StreamInfo
+}
+
+// NewCatalog - creates the catalog of a write, load reads a key within the transaction of the
+// write and returns nil when it does not exist
+func NewCatalog(load func(key []byte) ([]byte, error)) *Catalog {
+	return &Catalog{
+		load:    load,
+		changed: make(map[string]*StreamInfo),
+	}
+}
+
+// CatalogKey - the key of the catalog record of the stream
+func CatalogKey(stream StreamID) []byte {
+	return PackMeta(CatalogNamespace, string(stream))
+}
+
+func (c *Catalog) get(stream StreamID) (*StreamInfo, error) {
+	if info, ok := c.changed[string(stream)]; ok {
+		return info, nil
+	}
+
+	info := &StreamInfo{}
+	v, err := c.load(CatalogKey(stream))
+	if err != nil {
+		return nil, err
+	}
+	if v != nil {
+		if *info, err = DecodeStreamInfo(string(v)); err != nil {
+			return nil, err
+		}
+	}
+
+	c.changed[string(stream)] = info
+	return info, nil
+}
+
+// Add - records an event of the given size in bytes written to its stream
+func (c *Catalog) Add(k Key, size int) error {
+	info, err := c.get(k.Stream)
+	if err != nil {
+		return err
+	}
+
+	written := ulid.Time(k.ID.Time()).UTC()
+	if info.Created.IsZero() {
+		info.Created = written
+	}
+	if written.After(info.Updated) {
+		info.Updated = written
+	}
+	if k.Version > info.Head {
+		info.Head = k.Version
+	}
+	info.Count++
+	info.Size += int64(size)
+
+	return nil
+}
+
+// Remove - records events of the stream removed along with their size in bytes
+func (c *Catalog) Remove(stream StreamID, count int, size int64) error {
+	if count == 0 {
+		return nil
+	}
+
+	info, err := c.get(stream)
+	if err != nil {
+		return err
+	}
+
+	info.Count -= uint64(count)
+	info.Size -= size
+
+	return nil
+}
+
+// Write - passes the key and encoded value of every record changed to put
+func (c *Catalog) Write(put func(key, v []byte) error) error {
+	for stream, info := range c.changed {
+		if err := put(CatalogKey(StreamID(stream)), []byte(EncodeStreamInfo(*info))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EncodeStreamInfo - encodes a catalog record
+func EncodeStreamInfo(info StreamInfo) string {
+	v, _ := json.Marshal(info)
+	return string(v)
+}
+
+// DecodeStreamInfo - decodes a catalog record
+func DecodeStreamInfo(v string) (StreamInfo, error) {
+	var info StreamInfo
+	if err := json.Unmarshal([]byte(v), &info); err != nil {
+		return info, fmt.Errorf("unable to decode stream info: %v", err)
+	}
+	return info, nil
+}
+
+// LoadStreamInfo - the catalog record of the stream, ErrNotFound when it has no events
+// and was never written to
+func LoadStreamInfo(db DB, stream StreamID) (StreamInfo, error) {
+	v, err := db.GetMeta(CatalogNamespace, string(stream))
+	if err != nil {
+		return StreamInfo{}, err
+	}
+	return DecodeStreamInfo(v)
+}
+
+// ScanStreams - passes the catalog record of every stream from the one given onwards to the
+// handler in stream name order, from every stream when empty
+func ScanStreams(db DB, from StreamID, handler func(stream StreamID, info StreamInfo) bool) error {
+	var err error
+	scanErr := db.ScanMetaFrom(CatalogNamespace, string(from), func(key, v string) bool {
+		var info StreamInfo
+		if info, err = DecodeStreamInfo(v); err != nil {
+			return false
+		}
+		return handler(StreamID(key), info)
+	})
+	if scanErr != nil {
+		return scanErr
+	}
+	return err
+}
+
+// BuildCatalog - builds the catalog of a database written before the catalog was kept by
+// reading every event once. The catalog is marked as built after every record is written,
+// a build stopped partway is done again from the start the next time.
+func BuildCatalog(db DB) error {
+	_, err := db.GetMeta(StoreNamespace, CatalogBuilt)
+	if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	// the records are kept in memory, the catalog holds a few numbers per stream
+	records := make(map[string]string)
+	c := NewCatalog(func(key []byte) ([]byte, error) {
+		if v, ok := records[string(key)]; ok {
+			return []byte(v), nil
+		}
+		return nil, nil
+	})
+
+	var addErr error
+	err = db.Scan(ScannerOptions{
+		IncludeOffset: true,
+		FetchValues:   true,
+		Handler: func(k Key, v string) bool {
+			addErr = c.Add(k, len(EncodeRecord(k.ID, v)))
+			return addErr == nil
+		},
+	})
+	if err == nil {
+		err = addErr
+	}
+	if err != nil {
+		return err
+	}
+
+	// the records of a build stopped partway are written again
+	for stream, info := range c.changed {
+		if err := db.SetMeta(CatalogNamespace, stream, EncodeStreamInfo(*info)); err != nil {
+			return err
+		}
+	}
+
+	return db.SetMeta(StoreNamespace, CatalogBuilt, "1")
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package store
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// The value of an event is an envelope holding its data along with the fields
+// published with it. Every field but the data is prefixed by its length so the
+// data is stored as is:
+//
+//   <envelope version><type><content type><correlation id><causation id><metadata><data>
+
+const envelopeV1 byte = 1
+
+// Event - the data of an event and the fields published along with it
+type Event struct {
+	// Type - the name of what happened, eg OrderPlaced
+	Type string
+	// ContentType - the media type of the data, eg application/json
+	ContentType string
+	// CorrelationID - identifies the process the event is part of
+	CorrelationID string
+	// CausationID - identifies the event or command that caused the event
+	CausationID string
+	// Metadata - free form values of the event
+	Metadata string
+	// Data - the payload of the event
+	Data string
+}
+
+// fields - the length prefixed fields of the envelope in order
+func (e *Event) fields() []*string {
+	return []*string{&e.Type, &e.ContentType, &e.CorrelationID, &e.CausationID, &e.Metadata}
+}
+
+// EncodeEvent - encodes the event as the value stored for it
+func EncodeEvent(e Event) string {
+	size := 1 + len(e.Data)
+	for _, f := range e.fields() {
+		size += binary.MaxVarintLen64 + len(*f)
+	}
+
+	buf := make([]byte, 0, size)
+	buf = append(buf, envelopeV1)
+	for _, f := range e.fields() {
+		buf = appendUvarint(buf, uint64(len(*f)))
+		buf = append(buf, *f...)
+	}
+	buf = append(buf, e.Data...)
+
+	return string(buf)
+}
+
+// DecodeEvent - decodes a value encoded by EncodeEvent
+func DecodeEvent(v string) (Event, error) {
+	var e Event
+	if len(v) < 1 || v[0] != envelopeV1 {
+		return e, fmt.Errorf("unable to decode event envelope %q", v)
+	}
+
+	b := []byte(v[1:])
+	for _, f := range e.fields() {
+		n, read := binary.Uvarint(b)
+		if read <= 0 || uint64(len(b)-read) < n {
+			return Event{}, fmt.Errorf("unable to decode event envelope %q", v)
+		}
+		*f = string(b[read : read+int(n)])
+		b = b[read+int(n):]
+	}
+	e.Data = string(b)
+
+	return e, nil
+}
+
+func appendUvarint(buf []byte, n uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], n)]...)
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package store
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEventEnvelope(t *testing.T) {
+	for _, e := range []Event{
+		{},
+		{Data: "hello"},
+		{
+			Type:          "OrderPlaced",
+			ContentType:   "application/json",
+			CorrelationID: "c-1",
+			CausationID:   "cmd-1",
+			Metadata:      `{"user":"jeremy"}`,
+			Data:          `{"total":` + strings.Repeat("9", 300) + `}`,
+		},
+	} {
+		decoded, err := DecodeEvent(EncodeEvent(e))
+		if err != nil || decoded != e {
+			t.Fatalf("expected %+v, got %+v %v", e, decoded, err)
+		}
+	}
+
+	for _, bad := range []string{"", "hello", string([]byte{envelopeV1, 10, 'a'})} {
+		if _, err := DecodeEvent(bad); err == nil {
+			t.Fatalf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestRecord(t *testing.T) {
+	id := GenUlid()
+	v := EncodeEvent(Event{Type: "OrderPlaced", Data: "hello"})
+
+	decodedID, decoded, err := DecodeRecord(EncodeRecord(id, v))
+	if err != nil || decodedID != id || decoded != v {
+		t.Fatalf("expected the record to round trip, got %s %q %v", decodedID, decoded, err)
+	}
+
+	// records written before envelopes hold the data alone
+	legacy := append([]byte{recordV1}, id[:]...)
+	legacy = append(legacy, "hello"...)
+
+	decodedID, decoded, err = DecodeRecord(legacy)
+	if err != nil || decodedID != id {
+		t.Fatalf("expected the legacy record to decode, got %s %v", decodedID, err)
+	}
+	if e, err := DecodeEvent(decoded); err != nil || e != (Event{Data: "hello"}) {
+		t.Fatalf("expected the legacy data in an envelope, got %+v %v", e, err)
+	}
+}
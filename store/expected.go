@@ -0,0 +1,103 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package store
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ExpectAny - append regardless of the current head of the stream
+	ExpectAny int64 = -1
+	// ExpectNoStream - append only if the stream has no events
+	ExpectNoStream int64 = -2
+	// ExpectStreamExists - append only if the stream has at least one event
+	ExpectStreamExists int64 = -3
+)
+
+// WrongExpectedVersionError - returned when the head of a stream does not match
+// the version expected by the writer
+type WrongExpectedVersionError struct {
+	Stream   StreamID
+	Expected int64
+	Actual   uint64
+}
+
+func (e *WrongExpectedVersionError) Error() string {
+	return fmt.Sprintf("WRONGEXPECTEDVERSION expected %s actual %d", FormatExpectedVersion(e.Expected), e.Actual)
+}
+
+// ParseExpectedVersion - parses an expected version or one of the sentinels
+// ANY, NO_STREAM and STREAM_EXISTS
+func ParseExpectedVersion(s string) (int64, error) {
+	switch strings.ToUpper(s) {
+	case "ANY":
+		return ExpectAny, nil
+	case "NO_STREAM":
+		return ExpectNoStream, nil
+	case "STREAM_EXISTS":
+		return ExpectStreamExists, nil
+	}
+
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid expected version %q", s)
+	}
+
+	return v, nil
+}
+
+// FormatExpectedVersion - formats an expected version in the form accepted by ParseExpectedVersion
+func FormatExpectedVersion(expected int64) string {
+	switch expected {
+	case ExpectAny:
+		return "ANY"
+	case ExpectNoStream:
+		return "NO_STREAM"
+	case ExpectStreamExists:
+		return "STREAM_EXISTS"
+	}
+	return strconv.FormatInt(expected, 10)
+}
+
+// CheckExpectedVersion - verifies the head of a stream against the expected version.
+// A head of 0 means the stream has no events.
+func CheckExpectedVersion(stream StreamID, expected int64, head uint64) error {
+	var ok bool
+	switch expected {
+	case ExpectAny:
+		ok = true
+	case ExpectNoStream:
+		ok = head == 0
+	case ExpectStreamExists:
+		ok = head > 0
+	default:
+		ok = expected >= 0 && uint64(expected) == head
+	}
+
+	if !ok {
+		return &WrongExpectedVersionError{
+			Stream:   stream,
+			Expected: expected,
+			Actual:   head,
+		}
+	}
+
+	return nil
+}
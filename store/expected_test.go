@@ -0,0 +1,82 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package store
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseExpectedVersion(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		want int64
+	}{
+		{"ANY", ExpectAny},
+		{"no_stream", ExpectNoStream},
+		{"STREAM_EXISTS", ExpectStreamExists},
+		{"0", 0},
+		{"42", 42},
+	} {
+		got, err := ParseExpectedVersion(tt.s)
+		if err != nil || got != tt.want {
+			t.Fatalf("expected %q to parse as %d, got %d %v", tt.s, tt.want, got, err)
+		}
+		if tt.s == "42" && FormatExpectedVersion(got) != "42" {
+			t.Fatalf("expected %d to format as 42, got %s", got, FormatExpectedVersion(got))
+		}
+	}
+
+	for _, bad := range []string{"", "-1", "-2", "1.5", "NOSTREAM", "x"} {
+		if _, err := ParseExpectedVersion(bad); err == nil {
+			t.Fatalf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestCheckExpectedVersion(t *testing.T) {
+	for _, tt := range []struct {
+		expected int64
+		head     uint64
+		ok       bool
+	}{
+		{ExpectAny, 0, true},
+		{ExpectAny, 3, true},
+		{ExpectNoStream, 0, true},
+		{ExpectNoStream, 1, false},
+		{ExpectStreamExists, 0, false},
+		{ExpectStreamExists, 1, true},
+		{0, 0, true},
+		{2, 2, true},
+		{2, 3, false},
+		{-4, 0, false},
+	} {
+		err := CheckExpectedVersion(StreamID("order-1"), tt.expected, tt.head)
+		if (err == nil) != tt.ok {
+			t.Fatalf("expected %s at head %d to be ok=%v, got %v", FormatExpectedVersion(tt.expected), tt.head, tt.ok, err)
+		}
+	}
+
+	err := CheckExpectedVersion(StreamID("order-1"), ExpectNoStream, 1)
+	var wev *WrongExpectedVersionError
+	if !errors.As(err, &wev) || string(wev.Stream) != "order-1" || wev.Actual != 1 {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	if err.Error() != "WRONGEXPECTEDVERSION expected NO_STREAM actual 1" {
+		t.Fatalf("unexpected error message %q", err.Error())
+	}
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package store
+
+// MatchGlob - reports whether the name matches the pattern in the style of the Redis SCAN
+// command, * matches any bytes, ? a single byte, [abc], [^abc] and [a-z] a byte of a class
+// and \ escapes the byte that follows it
+func MatchGlob(pattern, name string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(name); i++ {
+				if MatchGlob(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(name) == 0 {
+				return false
+			}
+			pattern, name = pattern[1:], name[1:]
+		case '[':
+			if len(name) == 0 {
+				return false
+			}
+			var matched bool
+			if matched, pattern = matchClass(pattern[1:], name[0]); !matched {
+				return false
+			}
+			name = name[1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(name) == 0 || name[0] != pattern[0] {
+				return false
+			}
+			pattern, name = pattern[1:], name[1:]
+		}
+	}
+	return len(name) == 0
+}
+
+// matchClass - matches the byte against the class following a [ and returns the rest of
+// the pattern after the closing ], a class left open runs to the end of the pattern
+func matchClass(class string, b byte) (bool, string) {
+	negate := len(class) > 0 && class[0] == '^'
+	if negate {
+		class = class[1:]
+	}
+
+	matched := false
+	for len(class) > 0 && class[0] != ']' {
+		switch {
+		case class[0] == '\\' && len(class) > 1:
+			matched = matched || class[1] == b
+			class = class[2:]
+		case len(class) > 2 && class[1] == '-' && class[2] != ']':
+			lo, hi := class[0], class[2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			matched = matched || (b >= lo && b <= hi)
+			class = class[3:]
+		default:
+			matched = matched || class[0] == b
+			class = class[1:]
+		}
+	}
+	if len(class) > 0 {
+		class = class[1:]
+	}
+
+	return matched != negate, class
+}
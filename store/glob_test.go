@@ -0,0 +1,49 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package store
+
+import "testing"
+
+func TestMatchGlob(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"*", "", true},
+		{"*", "order-1", true},
+		{"order-*", "order-1", true},
+		{"order-*", "user-1", false},
+		{"*-1", "order-1", true},
+		{"*-1", "order-12", false},
+		{"o*r*1", "order-1", true},
+		{"order-?", "order-1", true},
+		{"order-?", "order-12", false},
+		{"order-[0-9]", "order-7", true},
+		{"order-[^0-9]", "order-7", false},
+		{"order-[ab]", "order-b", true},
+		{"order-[ab]", "order-c", false},
+		{"order-[a", "order-a", true},
+		{`order\*`, "order*", true},
+		{`order\*`, "order-1", false},
+		{"[$]ce-*", "$ce-order", true},
+		{"order", "order-1", false},
+	} {
+		if got := MatchGlob(tc.pattern, tc.name); got != tc.want {
+			t.Errorf("%q against %q: expected %v, got %v", tc.pattern, tc.name, tc.want, got)
+		}
+	}
+}
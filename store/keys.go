@@ -0,0 +1,266 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package store
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// Keys are built as tuples of a namespace, fixed width fields and escaped
+// stream names so that any byte may appear in a stream name:
+//
+//   s:<stream>0x00 0x01<version>
+//   t:<ulid><stream>0x00 0x01<version>
+//   <namespace>:<key>
+//
+// A 0x00 inside a stream name is escaped as 0x00 0xFF. The terminator sorts
+// before any escaped byte so a stream sorts before every stream it prefixes
+// and the keys of a single stream can be scanned without matching others.
+// Values kept besides the events, such as the state of consumer groups, are
+// stored under a namespace of their own and are only read by key.
+
+const (
+	escapeByte = 0x00
+	escapedNil = 0xff
+	terminator = 0x01
+)
+
+var (
+	streamNamespace = []byte{'s', ':'}
+	indexNamespace  = []byte{'t', ':'}
+)
+
+// Namespace - a key space for values stored besides the events
+type Namespace byte
+
+const (
+	// GroupNamespace - the state of consumer groups keyed by group name
+	GroupNamespace Namespace = 'g'
+	// CheckpointNamespace - positions saved by subscribers keyed by checkpoint name
+	CheckpointNamespace Namespace = 'c'
+	// StreamMetaNamespace - the metadata records of streams keyed by stream name
+	StreamMetaNamespace Namespace = 'm'
+	// DeletedNamespace - the head of soft deleted streams keyed by stream name
+	DeletedNamespace Namespace = 'd'
+	// TombstoneNamespace - the hard deleted streams keyed by stream name, written by Del
+	TombstoneNamespace Namespace = 'x'
+	// ProjectionNamespace - the source and checkpoint of projections keyed by projection name
+	ProjectionNamespace Namespace = 'p'
+	// ProjectionStateNamespace - the state of the partitions of projections keyed by projection
+	// name and partition, see the projection package
+	ProjectionStateNamespace Namespace = 'r'
+	// SnapshotNamespace - the latest snapshot of the state of streams keyed by stream name
+	SnapshotNamespace Namespace = 'n'
+	// CatalogNamespace - the catalog record of every stream with events keyed by stream name,
+	// written by the stores along with the events
+	CatalogNamespace Namespace = 'i'
+	// StoreNamespace - values the stores keep about the database itself keyed by name
+	StoreNamespace Namespace = 'v'
+)
+
+// HardDeleteKeys - the meta keys of a stream removed by Del along with its events, nothing is
+// left to list, restore or rebuild the stream from
+func HardDeleteKeys(stream string) [][]byte {
+	return [][]byte{
+		CatalogKey(StreamID(stream)),
+		PackMeta(DeletedNamespace, stream),
+		PackMeta(SnapshotNamespace, stream),
+	}
+}
+
+// appendStream - appends the escaped and terminated stream name
+func appendStream(buf []byte, stream []byte) []byte {
+	buf = appendEscaped(buf, stream)
+	return append(buf, escapeByte, terminator)
+}
+
+// appendEscaped - appends the stream name with every 0x00 escaped
+func appendEscaped(buf []byte, stream []byte) []byte {
+	for _, b := range stream {
+		buf = append(buf, b)
+		if b == escapeByte {
+			buf = append(buf, escapedNil)
+		}
+	}
+	return buf
+}
+
+// readStream - reads an escaped stream name that must fill the whole buffer including its terminator
+func readStream(buf []byte) (StreamID, error) {
+	stream := make([]byte, 0, len(buf))
+	for i := 0; i < len(buf); i++ {
+		if buf[i] != escapeByte {
+			stream = append(stream, buf[i])
+			continue
+		}
+		if i+1 >= len(buf) {
+			break
+		}
+		switch buf[i+1] {
+		case escapedNil:
+			stream = append(stream, escapeByte)
+			i++
+		case terminator:
+			if i+2 != len(buf) || len(stream) == 0 {
+				return nil, fmt.Errorf("unable to unpack stream %v", buf)
+			}
+			return StreamID(stream), nil
+		default:
+			return nil, fmt.Errorf("unable to unpack stream %v", buf)
+		}
+	}
+	return nil, fmt.Errorf("unable to unpack stream %v", buf)
+}
+
+// PackStream - packs the key of an event in a stream, without a version
+// only the stream part of the key is packed
+func PackStream(k Key) ([]byte, error) {
+	if len(k.Stream) == 0 {
+		return make([]byte, 0), fmt.Errorf("unable to pack key %v", k)
+	}
+	buf := make([]byte, 0, len(streamNamespace)+len(k.Stream)+2+VersionSize)
+	buf = append(buf, streamNamespace...)
+	buf = appendStream(buf, k.Stream)
+	if k.Version > 0 {
+		buf = append(buf, EncodeVersion(k.Version)...)
+	}
+	return buf, nil
+}
+
+// UnpackStream - unpacks a key packed by PackStream
+func UnpackStream(key []byte) (Key, error) {
+	k := Key{}
+	split := len(key) - VersionSize
+
+	if split <= len(streamNamespace) || !bytes.HasPrefix(key, streamNamespace) {
+		return k, fmt.Errorf("unable to unpack key %v", key)
+	}
+
+	stream, err := readStream(key[len(streamNamespace):split])
+	if err != nil {
+		return k, err
+	}
+
+	version, err := DecodeVersion(key[split:])
+	if err != nil {
+		return k, err
+	}
+
+	k.ID = ulid.ULID{}
+	k.Stream = stream
+	k.Version = version
+
+	return k, nil
+}
+
+// PackIndex - packs the time series index key of an event
+func PackIndex(k Key) []byte {
+	buf := make([]byte, 0, len(indexNamespace)+len(k.ID)+len(k.Stream)+2+VersionSize)
+	buf = append(buf, indexNamespace...)
+	buf = append(buf, k.ID[:]...)
+	buf = appendStream(buf, k.Stream)
+	buf = append(buf, EncodeVersion(k.Version)...)
+	return buf
+}
+
+// UnpackIndex - unpacks a key packed by PackIndex
+func UnpackIndex(key []byte) (Key, error) {
+	k := Key{}
+	start := len(indexNamespace) + len(k.ID)
+	split := len(key) - VersionSize
+
+	if split <= start || !bytes.HasPrefix(key, indexNamespace) {
+		return k, fmt.Errorf("unable to unpack key %v", key)
+	}
+
+	stream, err := readStream(key[start:split])
+	if err != nil {
+		return k, err
+	}
+
+	version, err := DecodeVersion(key[split:])
+	if err != nil {
+		return k, err
+	}
+
+	copy(k.ID[:], key[len(indexNamespace):start])
+	k.Stream = stream
+	k.Version = version
+
+	return k, nil
+}
+
+// PositionPrefix - the prefix of the time series index entries at the position of an event,
+// which are the event and its links
+func PositionPrefix(id ulid.ULID) []byte {
+	return append(append([]byte{}, indexNamespace...), id[:]...)
+}
+
+// PackMeta - packs the key of a value in a namespace
+func PackMeta(ns Namespace, key string) []byte {
+	buf := make([]byte, 0, 2+len(key))
+	buf = append(buf, byte(ns), ':')
+	return append(buf, key...)
+}
+
+// StreamScanPrefix - the prefix of all events in a stream, or of all streams when empty
+func StreamScanPrefix(stream []byte) []byte {
+	buf := append([]byte{}, streamNamespace...)
+	if len(stream) == 0 {
+		return buf
+	}
+	return appendStream(buf, stream)
+}
+
+// IndexScanPrefix - the prefix of the time series index narrowed to the
+// millisecond timestamp of a ulid when given
+func IndexScanPrefix(ts []byte) []byte {
+	buf := append([]byte{}, indexNamespace...)
+	if len(ts) == 0 {
+		return buf
+	}
+
+	// Nab the first 6 bytes of the time index
+	return append(buf, ts[:6]...)
+}
+
+// UpperBound - the lowest key above every key starting with the prefix, nil when there is none
+func UpperBound(prefix []byte) []byte {
+	bound := append([]byte{}, prefix...)
+	for len(bound) > 0 && bound[len(bound)-1] == 0xff {
+		bound = bound[:len(bound)-1]
+	}
+	if len(bound) == 0 {
+		return nil
+	}
+	bound[len(bound)-1]++
+	return bound
+}
+
+// ReverseBound - the lowest key above every key read by a reverse scan starting at the offset
+// within the prefix, or at the last key of the prefix without an offset. Nil when there is none.
+func ReverseBound(prefix, offset []byte, includeOffset bool) []byte {
+	start := append(append([]byte{}, prefix...), offset...)
+	if len(offset) > 0 && !includeOffset {
+		// every key at the offset starts with it and sorts at or above it
+		return start
+	}
+	return UpperBound(start)
+}
@@ -0,0 +1,206 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A link stream holds link events pointing at events of other streams, written in
+// the same transaction as the events they link to. A link shares the global
+// position of its event so that both are found at the same index position:
+//
+//   <link version>: { type: $>, data: <version>@<stream> }
+
+const (
+	// LinkEventType - the type of link events
+	LinkEventType = "$>"
+	// CategoryPrefix - the prefix of the link streams of the events of a category
+	CategoryPrefix = "$ce-"
+	// EventTypePrefix - the prefix of the link streams of the events of a type
+	EventTypePrefix = "$et-"
+)
+
+// Linker - the link streams an event appended to the stream is linked to, given its encoded value
+type Linker func(stream StreamID, v string) []StreamID
+
+// SystemLinks - links an event to the $ce-<category> stream of its stream, the category being
+// the name of the stream up to its first -, and to the $et-<type> stream of its type. Events
+// of system streams, those starting with $, are not linked.
+func SystemLinks(stream StreamID, v string) []StreamID {
+	if len(stream) == 0 || stream[0] == '$' {
+		return nil
+	}
+
+	var links []StreamID
+	if i := strings.IndexByte(string(stream), '-'); i > 0 {
+		links = append(links, StreamID(CategoryPrefix+string(stream[:i])))
+	}
+	if e, err := DecodeEvent(v); err == nil && e.Type != "" {
+		links = append(links, StreamID(EventTypePrefix+e.Type))
+	}
+
+	return links
+}
+
+// EncodeLink - encodes the value of a link to the event
+func EncodeLink(k Key) string {
+	return EncodeEvent(Event{
+		Type: LinkEventType,
+		Data: strconv.FormatUint(k.Version, 10) + "@" + string(k.Stream),
+	})
+}
+
+// IsLink - determines if the encoded event is a link
+func IsLink(v string) bool {
+	e, err := DecodeEvent(v)
+	return err == nil && e.Type == LinkEventType
+}
+
+// ParseLink - parses the data of a link event into the key of the event it links to
+func ParseLink(data string) (Key, error) {
+	i := strings.IndexByte(data, '@')
+	if i <= 0 || i == len(data)-1 {
+		return Key{}, fmt.Errorf("unable to parse link %q", data)
+	}
+
+	version, err := strconv.ParseUint(data[:i], 10, 64)
+	if err != nil {
+		return Key{}, fmt.Errorf("unable to parse link %q", data)
+	}
+
+	return Key{Stream: StreamID(data[i+1:]), Version: version}, nil
+}
+
+// ResolveLink - the key and event a link event points at, the event as is when it is not a link.
+// ErrNotFound is returned when the event linked to no longer exists.
+func ResolveLink(db DB, k Key, e Event) (Key, Event, error) {
+	if e.Type != LinkEventType {
+		return k, e, nil
+	}
+
+	target, err := ParseLink(e.Data)
+	if err != nil {
+		return k, e, err
+	}
+	target.ID = k.ID
+
+	v, err := db.Get(target)
+	if err != nil {
+		return k, e, err
+	}
+
+	resolved, err := DecodeEvent(v)
+	if err != nil {
+		return k, e, err
+	}
+
+	return target, resolved, nil
+}
+
+// LinkTo - the key of the link stored at the time series index entry, given its key and record,
+// and whether it links to the event. The links of an event are found at its position, a hard
+// delete removes them along with the event.
+func LinkTo(indexKey, record []byte, target Key) (Key, bool, error) {
+	k, err := UnpackIndex(indexKey)
+	if err != nil {
+		return k, false, err
+	}
+	if bytes.Equal(k.Stream, target.Stream) {
+		return k, false, nil
+	}
+
+	_, v, err := DecodeRecord(record)
+	if err != nil {
+		return k, false, err
+	}
+
+	// values that are not links are not parsed any further
+	e, err := DecodeEvent(v)
+	if err != nil || e.Type != LinkEventType {
+		return k, false, nil
+	}
+
+	linked, err := ParseLink(e.Data)
+	if err != nil {
+		return k, false, nil
+	}
+
+	return k, linked.Version == target.Version && bytes.Equal(linked.Stream, target.Stream), nil
+}
+
+// Links - assigns the keys of the links written along with the events of an append,
+// the head of each link stream is looked up once per append
+type Links struct {
+	linker Linker
+	head   func(stream StreamID) (uint64, error)
+	heads  map[string]uint64
+	// link streams that were hard deleted
+	deleted map[string]bool
+
+	// Keys - the keys of the links assigned so far
+	Keys []Key
+}
+
+// NewLinks - creates the links of an append, head finds the head of a link stream within the
+// transaction of the append and returns ErrStreamDeleted for link streams not to be written to
+func NewLinks(linker Linker, head func(stream StreamID) (uint64, error)) *Links {
+	return &Links{
+		linker:  linker,
+		head:    head,
+		heads:   make(map[string]uint64),
+		deleted: make(map[string]bool),
+	}
+}
+
+// Next - the keys of the links of the event, hard deleted link streams are skipped
+func (l *Links) Next(k Key, v string) ([]Key, error) {
+	if l.linker == nil {
+		return nil, nil
+	}
+
+	var keys []Key
+	for _, stream := range l.linker(k.Stream, v) {
+		if l.deleted[string(stream)] {
+			continue
+		}
+
+		head, ok := l.heads[string(stream)]
+		if !ok {
+			var err error
+			head, err = l.head(stream)
+			if errors.Is(err, ErrStreamDeleted) {
+				l.deleted[string(stream)] = true
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		l.heads[string(stream)] = head + 1
+		keys = append(keys, Key{ID: k.ID, Stream: stream, Version: head + 1})
+	}
+
+	l.Keys = append(l.Keys, keys...)
+
+	return keys, nil
+}
@@ -0,0 +1,61 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package store
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSystemLinks(t *testing.T) {
+	typed := EncodeEvent(Event{Type: "OrderPlaced", Data: "{}"})
+	untyped := EncodeEvent(Event{Data: "{}"})
+
+	for _, tt := range []struct {
+		stream string
+		value  string
+		want   string
+	}{
+		{"order-1", typed, "[$ce-order $et-OrderPlaced]"},
+		{"order-1-a", untyped, "[$ce-order]"},
+		{"order", typed, "[$et-OrderPlaced]"},
+		{"-order", untyped, "[]"},
+		{"$ce-order", typed, "[]"},
+	} {
+		if got := fmt.Sprintf("%s", SystemLinks(StreamID(tt.stream), tt.value)); got != tt.want {
+			t.Fatalf("expected %s to link to %s, got %s", tt.stream, tt.want, got)
+		}
+	}
+}
+
+func TestParseLink(t *testing.T) {
+	k, err := ParseLink("12@order-1@eu")
+	if err != nil || string(k.Stream) != "order-1@eu" || k.Version != 12 {
+		t.Fatalf("unexpected link %+v %v", k, err)
+	}
+
+	link, err := DecodeEvent(EncodeLink(Key{Stream: StreamID("order-1"), Version: 3}))
+	if err != nil || link.Type != LinkEventType || link.Data != "3@order-1" {
+		t.Fatalf("unexpected link %+v %v", link, err)
+	}
+
+	for _, bad := range []string{"", "@order-1", "3@", "x@order-1"} {
+		if _, err := ParseLink(bad); err == nil {
+			t.Fatalf("expected %q to be rejected", bad)
+		}
+	}
+}
@@ -0,0 +1,596 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package memory
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/google/btree"
+	"github.com/maarek/aves/store"
+	"github.com/oklog/ulid/v2"
+)
+
+// degree of the btree holding the keys
+const degree = 32
+
+// item - a key and value held in the btree
+type item struct {
+	key   string
+	value string
+}
+
+// Less - orders items bytewise by key like the on-disk stores
+func (i item) Less(than btree.Item) bool {
+	return i.key < than.(item).key
+}
+
+// DB - represents an in-memory db implementation, nothing is persisted
+type DB struct {
+	mu   sync.RWMutex
+	tree *btree.BTree
+	size int64
+
+	// assigns global positions in commit order
+	ids *store.Monotonic
+}
+
+// OpenDB - Opens an empty in-memory database
+func OpenDB() (*DB, error) {
+	db := new(DB)
+	db.tree = btree.New(degree)
+	db.ids = store.NewMonotonic(ulid.ULID{})
+
+	return db, nil
+}
+
+// snapshot - a copy of the tree to scan without holding the lock, the handlers of a scan
+// read from the database and a nested read lock waits behind a pending write. The copy is
+// lazy, nodes are copied when either tree writes to them.
+func (db *DB) snapshot() *btree.BTree {
+	// cloning marks the nodes shared, it can not run along with another clone
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.tree.Clone()
+}
+
+// Close - releases the contents of the database
+func (db *DB) Close() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.tree.Clear(false)
+	db.size = 0
+}
+
+// Size - returns the size of the keys and values held in bytes
+func (db *DB) Size() int64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.size
+}
+
+// GC - runs the garbage collector, deleted keys are released immediately
+func (db *DB) GC() error {
+	return nil
+}
+
+// Set - sets a key with the specified value if the version doesn't exist
+func (db *DB) Set(k store.Key, v string) error {
+	if k.Version == 0 {
+		return fmt.Errorf("unable to pack key %v", k)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	key, err := store.PackStream(k)
+	if err != nil {
+		return err
+	}
+
+	if db.tree.Has(item{key: string(key)}) {
+		return fmt.Errorf("event for key exists %v", k)
+	}
+
+	if db.tombstoned(k.Stream) {
+		return store.ErrStreamDeleted
+	}
+
+	db.ids.Observe(k.ID)
+
+	c := db.catalog()
+	if err := db.setEvent(c, k, v); err != nil {
+		return err
+	}
+
+	return db.writeCatalog(c)
+}
+
+// Append - appends an event to the stream if its head matches the expected version
+func (db *DB) Append(stream store.StreamID, expected int64, v string) (store.Key, error) {
+	keys, err := db.AppendBatch(stream, expected, []string{v})
+	if err != nil {
+		return store.Key{}, err
+	}
+	return keys[0], nil
+}
+
+// AppendBatch - appends all events to the stream at once if its head matches the expected version
+func (db *DB) AppendBatch(stream store.StreamID, expected int64, values []string) ([]store.Key, error) {
+	keys, _, err := db.AppendLinked(stream, expected, values, nil)
+	return keys, err
+}
+
+// AppendLinked - appends all events to the stream at once if its head matches the expected version,
+// along with the links of each event to the streams given by the linker
+func (db *DB) AppendLinked(stream store.StreamID, expected int64, values []string, linker store.Linker) ([]store.Key, []store.Key, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if len(stream) == 0 {
+		return nil, nil, fmt.Errorf("unable to append to an empty stream name")
+	}
+
+	if db.tombstoned(stream) {
+		return nil, nil, store.ErrStreamDeleted
+	}
+
+	head, err := db.streamHead(stream)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := store.CheckExpectedVersion(stream, expected, head); err != nil {
+		return nil, nil, err
+	}
+
+	links := store.NewLinks(linker, func(link store.StreamID) (uint64, error) {
+		if db.tombstoned(link) {
+			return 0, store.ErrStreamDeleted
+		}
+		return db.streamHead(link)
+	})
+
+	c := db.catalog()
+	keys := make([]store.Key, len(values))
+	for i, v := range values {
+		keys[i] = store.Key{ID: db.ids.Next(), Stream: stream, Version: head + uint64(i) + 1}
+		if err := db.setEvent(c, keys[i], v); err != nil {
+			return nil, nil, err
+		}
+		if err := db.setLinks(c, links, keys[i], v); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := db.writeCatalog(c); err != nil {
+		return nil, nil, err
+	}
+
+	return keys, links.Keys, nil
+}
+
+// setEvent - writes the event and its time series index entry and records it in the catalog
+func (db *DB) setEvent(c *store.Catalog, k store.Key, v string) error {
+	key, err := store.PackStream(k)
+	if err != nil {
+		return err
+	}
+
+	record := string(store.EncodeRecord(k.ID, v))
+
+	db.put(string(key), record)
+	db.put(string(store.PackIndex(k)), record)
+
+	return c.Add(k, len(record))
+}
+
+// setLinks - writes the links of the event
+func (db *DB) setLinks(c *store.Catalog, links *store.Links, k store.Key, v string) error {
+	keys, err := links.Next(k, v)
+	if err != nil {
+		return err
+	}
+	for _, link := range keys {
+		if err := db.setEvent(c, link, store.EncodeLink(k)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// catalog - the catalog records changed by a write, read from the tree
+func (db *DB) catalog() *store.Catalog {
+	return store.NewCatalog(func(key []byte) ([]byte, error) {
+		if i := db.tree.Get(item{key: string(key)}); i != nil {
+			return []byte(i.(item).value), nil
+		}
+		return nil, nil
+	})
+}
+
+// writeCatalog - writes the catalog records changed
+func (db *DB) writeCatalog(c *store.Catalog) error {
+	return c.Write(func(key, v []byte) error {
+		db.put(string(key), string(v))
+		return nil
+	})
+}
+
+// tombstoned - determines if the stream was hard deleted
+func (db *DB) tombstoned(stream store.StreamID) bool {
+	return db.tree.Has(item{key: string(store.PackMeta(store.TombstoneNamespace, string(stream)))})
+}
+
+// streamHead - finds the highest version written to a stream, 0 when it has no events
+func (db *DB) streamHead(stream store.StreamID) (uint64, error) {
+	prefix := string(store.StreamScanPrefix(stream))
+	seek := prefix + strings.Repeat("\xff", store.VersionSize)
+
+	var head []byte
+	db.tree.DescendLessOrEqual(item{key: seek}, func(i btree.Item) bool {
+		if k := i.(item).key; strings.HasPrefix(k, prefix) {
+			head = []byte(k[len(prefix):])
+		}
+		return false
+	})
+	if head == nil {
+		return 0, nil
+	}
+
+	return store.DecodeVersion(head)
+}
+
+// put - inserts or replaces a key
+func (db *DB) put(key, value string) {
+	if old := db.tree.ReplaceOrInsert(item{key: key, value: value}); old != nil {
+		db.size -= int64(len(key) + len(old.(item).value))
+	}
+	db.size += int64(len(key) + len(value))
+}
+
+// delete - removes a key
+func (db *DB) delete(key string) {
+	if old := db.tree.Delete(item{key: key}); old != nil {
+		db.size -= int64(len(key) + len(old.(item).value))
+	}
+}
+
+// Get - fetches the value of the specified key
+func (db *DB) Get(k store.Key) (string, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	key, err := store.PackStream(k)
+	if err != nil {
+		return "", err
+	}
+
+	i := db.tree.Get(item{key: string(key)})
+	if i == nil {
+		return "", store.ErrNotFound
+	}
+
+	_, v, err := store.DecodeRecord([]byte(i.(item).value))
+
+	return v, err
+}
+
+// SetMeta - sets a value in the namespace
+func (db *DB) SetMeta(ns store.Namespace, key, v string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.put(string(store.PackMeta(ns, key)), v)
+
+	return nil
+}
+
+// GetMeta - fetches a value of the namespace
+func (db *DB) GetMeta(ns store.Namespace, key string) (string, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	i := db.tree.Get(item{key: string(store.PackMeta(ns, key))})
+	if i == nil {
+		return "", store.ErrNotFound
+	}
+
+	return i.(item).value, nil
+}
+
+// DelMeta - removes a value from the namespace
+func (db *DB) DelMeta(ns store.Namespace, key string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.delete(string(store.PackMeta(ns, key)))
+
+	return nil
+}
+
+// ScanMeta - passes every value of the namespace to the handler in key order
+func (db *DB) ScanMeta(ns store.Namespace, handler store.MetaHandler) error {
+	return db.ScanMetaFrom(ns, "", handler)
+}
+
+// ScanMetaFrom - passes the values of the namespace from the key given onwards to the handler in key order
+func (db *DB) ScanMetaFrom(ns store.Namespace, from string, handler store.MetaHandler) error {
+	prefix := string(store.PackMeta(ns, ""))
+	db.snapshot().AscendGreaterOrEqual(item{key: string(store.PackMeta(ns, from))}, func(i btree.Item) bool {
+		it := i.(item)
+		if !strings.HasPrefix(it.key, prefix) {
+			return false
+		}
+		return handler(it.key[len(prefix):], it.value)
+	})
+
+	return nil
+}
+
+// Head - finds the highest version written to a stream, 0 when it has no events
+func (db *DB) Head(stream store.StreamID) (uint64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.streamHead(stream)
+}
+
+// Truncate - removes the events of the stream before the version and their time series index entries
+func (db *DB) Truncate(stream store.StreamID, before uint64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if len(stream) == 0 {
+		return fmt.Errorf("unable to truncate an empty stream name")
+	}
+
+	prefix := string(store.StreamScanPrefix(stream))
+
+	var matched []string
+	var size int64
+	var err error
+	db.tree.AscendGreaterOrEqual(item{key: prefix}, func(i btree.Item) bool {
+		it := i.(item)
+		if !strings.HasPrefix(it.key, prefix) {
+			return false
+		}
+
+		var k store.Key
+		if k, err = store.UnpackStream([]byte(it.key)); err != nil {
+			return false
+		}
+		if k.Version >= before {
+			return false
+		}
+
+		// the record holds the position of the index entry
+		if k.ID, _, err = store.DecodeRecord([]byte(it.value)); err != nil {
+			return false
+		}
+
+		matched = append(matched, it.key, string(store.PackIndex(k)))
+		size += int64(len(it.value))
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, k := range matched {
+		db.delete(k)
+	}
+
+	// the head is kept, appends carry on after the events removed
+	c := db.catalog()
+	if err := c.Remove(stream, len(matched)/2, size); err != nil {
+		return err
+	}
+
+	return db.writeCatalog(c)
+}
+
+// Del - hard deletes the streams in a single write, removing their events, time series index
+// entries, the links to their events and the records kept besides them and leaving a tombstone
+// that rejects any further appends. Returns the head of every stream deleted, streams already
+// tombstoned are left out.
+func (db *DB) Del(streams []string) (map[string]uint64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	deleted := make(map[string]uint64)
+	var matched []string
+	var events []store.Key
+	var err error
+	for _, stream := range streams {
+		_, seen := deleted[stream]
+		// an empty name would prefix every stream
+		if len(stream) == 0 || seen || db.tombstoned(store.StreamID(stream)) {
+			continue
+		}
+
+		if deleted[stream], err = db.streamHead(store.StreamID(stream)); err != nil {
+			return nil, err
+		}
+
+		prefix := string(store.StreamScanPrefix([]byte(stream)))
+		db.tree.AscendGreaterOrEqual(item{key: prefix}, func(i btree.Item) bool {
+			it := i.(item)
+			if !strings.HasPrefix(it.key, prefix) {
+				return false
+			}
+
+			var k store.Key
+			if k, err = store.UnpackStream([]byte(it.key)); err != nil {
+				return false
+			}
+
+			// the record holds the position of the index entry
+			if k.ID, _, err = store.DecodeRecord([]byte(it.value)); err != nil {
+				return false
+			}
+
+			matched = append(matched, it.key, string(store.PackIndex(k)))
+			events = append(events, k)
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c := db.catalog()
+	links, err := db.linkKeys(c, events, deleted)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, k := range append(matched, links...) {
+		db.delete(k)
+	}
+	if err := db.writeCatalog(c); err != nil {
+		return nil, err
+	}
+
+	for stream := range deleted {
+		for _, k := range store.HardDeleteKeys(stream) {
+			db.delete(string(k))
+		}
+		db.put(string(store.PackMeta(store.TombstoneNamespace, stream)), "")
+	}
+
+	return deleted, nil
+}
+
+// linkKeys - collects the stream and index keys of the links to the events from the streams
+// not deleted along with them, removing the links from the catalog. The head of a link stream
+// is kept so that its versions carry on from it, readers skip it once its event is gone.
+func (db *DB) linkKeys(c *store.Catalog, events []store.Key, deleted map[string]uint64) ([]string, error) {
+	var matched []string
+	heads := make(map[string]uint64)
+	var err error
+	for _, k := range events {
+		prefix := string(store.PositionPrefix(k.ID))
+		db.tree.AscendGreaterOrEqual(item{key: prefix}, func(i btree.Item) bool {
+			it := i.(item)
+			if !strings.HasPrefix(it.key, prefix) {
+				return false
+			}
+
+			link, ok, lerr := store.LinkTo([]byte(it.key), []byte(it.value), k)
+			if _, gone := deleted[string(link.Stream)]; lerr != nil || !ok || gone {
+				err = lerr
+				return err == nil
+			}
+
+			head, seen := heads[string(link.Stream)]
+			if !seen {
+				if head, err = db.streamHead(link.Stream); err != nil {
+					return false
+				}
+				heads[string(link.Stream)] = head
+			}
+			if link.Version == head {
+				return true
+			}
+
+			var key []byte
+			if key, err = store.PackStream(link); err != nil {
+				return false
+			}
+			matched = append(matched, string(key), it.key)
+			err = c.Remove(link.Stream, 1, int64(len(it.value)))
+			return err == nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return matched, nil
+}
+
+// Scan - iterate over the whole store using the handler function
+func (db *DB) Scan(scannerOpt store.ScannerOptions) error {
+	tree := db.snapshot()
+
+	var prefix []byte
+	// Index scan for time
+	if scannerOpt.Index {
+		prefix = store.IndexScanPrefix(scannerOpt.Prefix)
+	} else {
+		prefix = store.StreamScanPrefix(scannerOpt.Prefix)
+	}
+
+	// seek directly to the offset within the prefix
+	start := append(append([]byte{}, prefix...), scannerOpt.Offset...)
+
+	var err error
+	visit := func(i btree.Item) bool {
+		k := []byte(i.(item).key)
+		if !bytes.HasPrefix(k, prefix) {
+			return false
+		}
+
+		// every key at the offset starts with it, there can be several at an index position
+		if len(scannerOpt.Offset) > 0 && !scannerOpt.IncludeOffset && bytes.HasPrefix(k, start) {
+			return true
+		}
+
+		var key store.Key
+
+		if scannerOpt.Index {
+			key, err = store.UnpackIndex(k)
+		} else {
+			key, err = store.UnpackStream(k)
+		}
+		if err != nil {
+			err = fmt.Errorf("invalid key format %s", string(k))
+			return false
+		}
+
+		var v string
+		if scannerOpt.FetchValues {
+			if key.ID, v, err = store.DecodeRecord([]byte(i.(item).value)); err != nil {
+				return false
+			}
+		}
+
+		return scannerOpt.Handler(key, v)
+	}
+
+	if !scannerOpt.Reverse {
+		tree.AscendGreaterOrEqual(item{key: string(start)}, visit)
+		return err
+	}
+
+	// the keys at the bound are above the scan
+	bound := store.ReverseBound(prefix, scannerOpt.Offset, scannerOpt.IncludeOffset)
+	tree.DescendLessOrEqual(item{key: string(bound)}, func(i btree.Item) bool {
+		if i.(item).key == string(bound) {
+			return true
+		}
+		return visit(i)
+	})
+
+	return err
+}
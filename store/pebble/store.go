@@ -19,7 +19,7 @@ package pebble
 import (
 	"bytes"
 	"fmt"
-	"strings"
+	"sync"
 
 	"github.com/cockroachdb/pebble"
 	"github.com/maarek/aves/store"
@@ -30,6 +30,12 @@ import (
 type DB struct {
 	pebble *pebble.DB
 	wo     *pebble.WriteOptions
+
+	// serializes writes so that stream heads are checked and written atomically
+	mu sync.Mutex
+
+	// assigns global positions in commit order
+	ids *store.Monotonic
 }
 
 // OpenDB - Opens the specified path
@@ -55,6 +61,18 @@ func OpenDB(path string) (*DB, error) {
 	db.pebble = pdb
 	db.wo = wo
 
+	last, err := db.lastPosition()
+	if err != nil {
+		pdb.Close()
+		return nil, err
+	}
+	db.ids = store.NewMonotonic(last)
+
+	if err := store.BuildCatalog(db); err != nil {
+		pdb.Close()
+		return nil, err
+	}
+
 	return db, nil
 }
 
@@ -63,276 +81,589 @@ func (db *DB) Close() {
 	db.pebble.Close()
 }
 
-// Size - returns the size of the database in bytes
+// Size - returns the size of the database (tables + WAL) in bytes
 func (db *DB) Size() int64 {
-	return -1
+	m := db.pebble.Metrics()
+
+	size := m.WAL.Size
+	for _, level := range m.Levels {
+		size += level.Size
+	}
+
+	return int64(size)
 }
 
-// GC - runs the garbage collector
+// GC - compacts the whole key space to drop deleted and overwritten keys
 func (db *DB) GC() error {
-	return fmt.Errorf("unimplemented")
+	return db.pebble.Compact([]byte{0x00}, []byte{0xff})
 }
 
 // Set - sets a key with the specified value if the version doesn't exist
 func (db *DB) Set(k store.Key, v string) error {
-	key, err := packStream(k)
+	if k.Version == 0 {
+		return fmt.Errorf("unable to pack key %v", k)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	key, err := store.PackStream(k)
 	if err != nil {
 		return err
 	}
 
 	item, closer, err := db.pebble.Get(key)
-	if err != nil && err.Error() != "pebble: not found" {
+	if err != nil && err != pebble.ErrNotFound {
 		return err
 	}
-	if len(item) > 0 {
+	if err == nil {
 		closer.Close()
+	}
+	if len(item) > 0 {
 		return fmt.Errorf("event for key exists %v", k)
 	}
 
+	if err := db.checkTombstone(k.Stream); err != nil {
+		return err
+	}
+
+	db.ids.Observe(k.ID)
+
 	wb := db.pebble.NewBatch()
+	c := db.catalog()
+	if err := db.setEvent(wb, c, k, v); err != nil {
+		return err
+	}
+	if err := db.writeCatalog(wb, c); err != nil {
+		return err
+	}
+
+	return wb.Commit(db.wo)
+}
 
-	err = wb.Set(key, []byte(v), db.wo)
+// Append - appends an event to the stream if its head matches the expected version
+func (db *DB) Append(stream store.StreamID, expected int64, v string) (store.Key, error) {
+	keys, err := db.AppendBatch(stream, expected, []string{v})
+	if err != nil {
+		return store.Key{}, err
+	}
+	return keys[0], nil
+}
+
+// AppendBatch - appends all events to the stream in a single batch
+// if its head matches the expected version
+func (db *DB) AppendBatch(stream store.StreamID, expected int64, values []string) ([]store.Key, error) {
+	keys, _, err := db.AppendLinked(stream, expected, values, nil)
+	return keys, err
+}
+
+// AppendLinked - appends all events to the stream in a single batch if its head matches the
+// expected version, along with the links of each event to the streams given by the linker
+func (db *DB) AppendLinked(stream store.StreamID, expected int64, values []string, linker store.Linker) ([]store.Key, []store.Key, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.checkTombstone(stream); err != nil {
+		return nil, nil, err
+	}
+
+	head, err := db.streamHead(stream)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := store.CheckExpectedVersion(stream, expected, head); err != nil {
+		return nil, nil, err
+	}
+
+	wb := db.pebble.NewBatch()
+
+	// the batch is not readable so the heads of link streams are read from the db once
+	// and Links counts the links added to the batch since
+	links := store.NewLinks(linker, func(link store.StreamID) (uint64, error) {
+		if err := db.checkTombstone(link); err != nil {
+			return 0, err
+		}
+		return db.streamHead(link)
+	})
+
+	c := db.catalog()
+	keys := make([]store.Key, len(values))
+	for i, v := range values {
+		keys[i] = store.Key{ID: db.ids.Next(), Stream: stream, Version: head + uint64(i) + 1}
+		if err := db.setEvent(wb, c, keys[i], v); err != nil {
+			return nil, nil, err
+		}
+		if err := db.setLinks(wb, c, links, keys[i], v); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := db.writeCatalog(wb, c); err != nil {
+		return nil, nil, err
+	}
+
+	if err := wb.Commit(db.wo); err != nil {
+		return nil, nil, err
+	}
+
+	return keys, links.Keys, nil
+}
+
+// setLinks - adds the links of the event to the batch
+func (db *DB) setLinks(wb *pebble.Batch, c *store.Catalog, links *store.Links, k store.Key, v string) error {
+	keys, err := links.Next(k, v)
 	if err != nil {
 		return err
 	}
+	for _, link := range keys {
+		if err := db.setEvent(wb, c, link, store.EncodeLink(k)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	id := [16]byte(store.GenUlid())
-	key = packIndex(id[:], k.Stream[:], k.Version)
-	err = wb.Set(key, []byte(v), db.wo)
+// setEvent - adds the event and its time series index entry to the batch and records it in the catalog
+func (db *DB) setEvent(wb *pebble.Batch, c *store.Catalog, k store.Key, v string) error {
+	key, err := store.PackStream(k)
 	if err != nil {
 		return err
 	}
 
-	err = wb.Commit(db.wo)
+	record := store.EncodeRecord(k.ID, v)
 
-	return err
+	err = wb.Set(key, record, db.wo)
+	if err != nil {
+		return err
+	}
+
+	key = store.PackIndex(k)
+
+	err = wb.Set(key, record, db.wo)
+	if err != nil {
+		return err
+	}
+
+	return c.Add(k, len(record))
+}
+
+// catalog - the catalog records changed by a write, like the heads of streams the records are
+// read from the db and the catalog keeps them once changed in the batch
+func (db *DB) catalog() *store.Catalog {
+	return store.NewCatalog(func(key []byte) ([]byte, error) {
+		item, closer, err := db.pebble.Get(key)
+		if err == pebble.ErrNotFound {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer closer.Close()
+
+		return append([]byte{}, item...), nil
+	})
+}
+
+// writeCatalog - adds the catalog records changed to the batch
+func (db *DB) writeCatalog(wb *pebble.Batch, c *store.Catalog) error {
+	return c.Write(func(key, v []byte) error {
+		return wb.Set(key, v, db.wo)
+	})
+}
+
+// lastPosition - finds the global position of the last event written, zero when there are none
+func (db *DB) lastPosition() (ulid.ULID, error) {
+	prefix := store.IndexScanPrefix(nil)
+
+	it := db.pebble.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: store.UpperBound(prefix),
+	})
+	defer it.Close()
+
+	if !it.Last() {
+		return ulid.ULID{}, it.Error()
+	}
+
+	k, err := store.UnpackIndex(it.Key())
+	if err != nil {
+		return ulid.ULID{}, err
+	}
+
+	return k.ID, nil
+}
+
+// checkTombstone - rejects writes to a stream that was hard deleted
+func (db *DB) checkTombstone(stream store.StreamID) error {
+	_, closer, err := db.pebble.Get(store.PackMeta(store.TombstoneNamespace, string(stream)))
+	if err == pebble.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	closer.Close()
+	return store.ErrStreamDeleted
+}
+
+// streamHead - finds the highest version written to a stream, 0 when it has no events
+func (db *DB) streamHead(stream store.StreamID) (uint64, error) {
+	prefix := store.StreamScanPrefix(stream)
+
+	it := db.pebble.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: store.UpperBound(prefix),
+	})
+	defer it.Close()
+
+	// walk back from the end of the stream to the last event
+	for it.Last(); it.Valid(); it.Prev() {
+		key := it.Key()
+		if len(key) != len(prefix)+store.VersionSize {
+			continue
+		}
+		return store.DecodeVersion(key[len(prefix):])
+	}
+
+	return 0, nil
 }
 
 // Get - fetches the value of the specified key
 func (db *DB) Get(k store.Key) (string, error) {
-	key, err := packStream(k)
+	key, err := store.PackStream(k)
 	if err != nil {
 		return "", err
 	}
 	item, closer, err := db.pebble.Get(key)
+	if err == pebble.ErrNotFound {
+		return "", store.ErrNotFound
+	}
 	if err != nil {
 		return "", err
 	}
 
 	defer closer.Close()
 
-	var sb strings.Builder
-	sb.Grow(len(item))
-	sb.Write(item)
+	_, v, err := store.DecodeRecord(item)
 
-	return sb.String(), err
+	return v, err
 }
 
-// Del - removes key(s) from the store
-func (db *DB) Del(keys []string) error {
-	wb := db.pebble.NewBatch()
+// SetMeta - sets a value in the namespace
+func (db *DB) SetMeta(ns store.Namespace, key, v string) error {
+	return db.pebble.Set(store.PackMeta(ns, key), []byte(v), db.wo)
+}
 
-	for _, key := range keys {
-		k := store.Key{
-			ID:      ulid.ULID{},
-			Stream:  store.StreamID(key),
-			Version: []byte{},
-		}
+// GetMeta - fetches a value of the namespace
+func (db *DB) GetMeta(ns store.Namespace, key string) (string, error) {
+	item, closer, err := db.pebble.Get(store.PackMeta(ns, key))
+	if err == pebble.ErrNotFound {
+		return "", store.ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
 
-		pattern, err := packStream(k)
-		if err != nil {
-			return err
-		}
+	defer closer.Close()
 
-		io := &pebble.IterOptions{}
-		it := db.pebble.NewIter(io)
-		defer it.Close()
-		it.SeekPrefixGE(pattern)
+	return string(item), nil
+}
 
-		for ; it.Valid(); it.Next() {
-			keyToDel := it.Key()
-			if !bytes.HasPrefix(keyToDel, pattern) {
-				break
-			}
-			err = wb.Delete(keyToDel, db.wo)
-			if err != nil {
-				return err
-			}
+// DelMeta - removes a value from the namespace
+func (db *DB) DelMeta(ns store.Namespace, key string) error {
+	return db.pebble.Delete(store.PackMeta(ns, key), db.wo)
+}
+
+// ScanMeta - passes every value of the namespace to the handler in key order
+func (db *DB) ScanMeta(ns store.Namespace, handler store.MetaHandler) error {
+	return db.ScanMetaFrom(ns, "", handler)
+}
+
+// ScanMetaFrom - passes the values of the namespace from the key given onwards to the handler in key order
+func (db *DB) ScanMetaFrom(ns store.Namespace, from string, handler store.MetaHandler) error {
+	prefix := store.PackMeta(ns, "")
+
+	it := db.pebble.NewIter(&pebble.IterOptions{
+		LowerBound: store.PackMeta(ns, from),
+		UpperBound: store.UpperBound(prefix),
+	})
+	defer it.Close()
+
+	for it.First(); it.Valid(); it.Next() {
+		if !handler(string(it.Key()[len(prefix):]), string(it.Value())) {
+			break
 		}
 	}
 
-	err := wb.Commit(db.wo)
+	return it.Error()
+}
 
-	return err
+// Head - finds the highest version written to a stream, 0 when it has no events
+func (db *DB) Head(stream store.StreamID) (uint64, error) {
+	return db.streamHead(stream)
 }
 
-// Scan - iterate over the whole store using the handler function
-func (db *DB) Scan(scannerOpt store.ScannerOptions) error {
-	var prefix []byte
-	// Index scan for time
-	if scannerOpt.Index {
-		prefix = indexScanPrefix(scannerOpt.Prefix)
-	} else {
-		prefix = streamScanPrefix(scannerOpt.Prefix)
+// Truncate - removes the events of the stream before the version and their time series index entries
+func (db *DB) Truncate(stream store.StreamID, before uint64) error {
+	if len(stream) == 0 {
+		return fmt.Errorf("unable to truncate an empty stream name")
 	}
 
-	// Create an upper bound by increasing the last value of the prefix (eg : to ;)
-	prefixLen := len(prefix)
-	upperBound := make([]byte, prefixLen)
-	copy(upperBound, prefix)
-	upperBound[prefixLen-1]++
+	db.mu.Lock()
+	defer db.mu.Unlock()
 
-	io := &pebble.IterOptions{
-		UpperBound: upperBound,
-	}
-	it := db.pebble.NewIter(io)
+	prefix := store.StreamScanPrefix(stream)
+
+	// the versions before are exactly the keys sorting before the version
+	it := db.pebble.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: append(append([]byte{}, prefix...), store.EncodeVersion(before)...),
+	})
 	defer it.Close()
 
-	start := func(it *pebble.Iterator) {
-		if len(prefix) == 0 {
-			it.First()
-		} else {
-			it.SeekGE(prefix)
+	wb := db.pebble.NewBatch()
+
+	var count int
+	var size int64
+	for it.First(); it.Valid(); it.Next() {
+		key, err := store.UnpackStream(it.Key())
+		if err != nil {
+			return err
 		}
-	}
 
-	valid := func(it *pebble.Iterator) bool {
-		if !it.Valid() {
-			return false
+		// the record holds the position of the index entry
+		if key.ID, _, err = store.DecodeRecord(it.Value()); err != nil {
+			return err
 		}
 
-		key := it.Key()
-		if len(prefix) != 0 && !bytes.HasPrefix(key, prefix) {
-			return false
+		if err := wb.Delete(it.Key(), db.wo); err != nil {
+			return err
+		}
+		if err := wb.Delete(store.PackIndex(key), db.wo); err != nil {
+			return err
 		}
 
-		return true
+		count++
+		size += int64(len(it.Value()))
+	}
+	if err := it.Error(); err != nil {
+		return err
 	}
 
-	seen := false
+	// the head is kept, appends carry on after the events removed
+	c := db.catalog()
+	if err := c.Remove(stream, count, size); err != nil {
+		return err
+	}
+	if err := db.writeCatalog(wb, c); err != nil {
+		return err
+	}
 
-	for start(it); valid(it); it.Next() {
-		hs := bytes.HasSuffix(it.Key(), scannerOpt.Offset)
+	return wb.Commit(db.wo)
+}
 
-		// ignore up to offset
-		if !seen && !hs {
+// Del - hard deletes the streams in a single batch, removing their events, time series index
+// entries, the links to their events and the records kept besides them and leaving a tombstone
+// that rejects any further appends. Returns the head of every stream deleted, streams already
+// tombstoned are left out.
+func (db *DB) Del(streams []string) (map[string]uint64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	wb := db.pebble.NewBatch()
+
+	deleted := make(map[string]uint64)
+	var events []store.Key
+	for _, stream := range streams {
+		_, seen := deleted[stream]
+		// an empty name would prefix every stream
+		if len(stream) == 0 || seen {
 			continue
 		}
 
-		seen = true
-
-		if hs && !scannerOpt.IncludeOffset {
+		err := db.checkTombstone(store.StreamID(stream))
+		if err == store.ErrStreamDeleted {
 			continue
 		}
+		if err != nil {
+			return nil, err
+		}
 
-		// valid kv pair to pass to the handler
-		k := make([]byte, len(it.Key()))
-		copy(k, it.Key())
+		if deleted[stream], err = db.streamHead(store.StreamID(stream)); err != nil {
+			return nil, err
+		}
 
-		v := make([]byte, len(it.Value()))
-		copy(v, it.Value())
+		prefix := store.StreamScanPrefix([]byte(stream))
+		err = db.iterate(prefix, func(k, v []byte) error {
+			key, err := store.UnpackStream(k)
+			if err != nil {
+				return err
+			}
 
-		var key store.Key
-		var err error
+			// the record holds the position of the index entry
+			if key.ID, _, err = store.DecodeRecord(v); err != nil {
+				return err
+			}
 
-		if scannerOpt.Index {
-			key, err = unpackIndex(k)
-		} else {
-			key, err = unpackStream(k)
-		}
+			if err := wb.Delete(k, db.wo); err != nil {
+				return err
+			}
+			events = append(events, key)
+			return wb.Delete(store.PackIndex(key), db.wo)
+		})
 		if err != nil {
-			return fmt.Errorf("invalid key format %s", string(k))
+			return nil, err
 		}
+	}
 
-		if !scannerOpt.Handler(key, string(v)) {
-			break
+	c := db.catalog()
+	if err := db.deleteLinks(wb, c, events, deleted); err != nil {
+		return nil, err
+	}
+	if err := db.writeCatalog(wb, c); err != nil {
+		return nil, err
+	}
+
+	for stream := range deleted {
+		for _, k := range store.HardDeleteKeys(stream) {
+			if err := wb.Delete(k, db.wo); err != nil {
+				return nil, err
+			}
+		}
+		if err := wb.Set(store.PackMeta(store.TombstoneNamespace, stream), nil, db.wo); err != nil {
+			return nil, err
 		}
 	}
 
-	return nil
-}
+	if err := wb.Commit(db.wo); err != nil {
+		return nil, err
+	}
 
-func streamScanIdentifier() []byte {
-	return []byte{'s', ':'}
+	return deleted, nil
 }
 
-func streamScanPrefix(prefix []byte) []byte {
-	if len(prefix) == 0 {
-		return streamScanIdentifier()
-	}
+// deleteLinks - adds the deletion of the links to the events from the streams not deleted
+// along with them to the batch, removing the links from the catalog. The head of a link stream
+// is kept so that its versions carry on from it, readers skip it once its event is gone.
+func (db *DB) deleteLinks(wb *pebble.Batch, c *store.Catalog, events []store.Key, deleted map[string]uint64) error {
+	heads := make(map[string]uint64)
+	for _, k := range events {
+		err := db.iterate(store.PositionPrefix(k.ID), func(key, v []byte) error {
+			link, ok, err := store.LinkTo(key, v, k)
+			if _, gone := deleted[string(link.Stream)]; err != nil || !ok || gone {
+				return err
+			}
 
-	buf := make([]byte, len(prefix)+2)
-	copy(buf, streamScanIdentifier())
-	copy(buf[2:], prefix)
+			head, seen := heads[string(link.Stream)]
+			if !seen {
+				if head, err = db.streamHead(link.Stream); err != nil {
+					return err
+				}
+				heads[string(link.Stream)] = head
+			}
+			if link.Version == head {
+				return nil
+			}
 
-	return buf
+			streamKey, err := store.PackStream(link)
+			if err != nil {
+				return err
+			}
+			if err := wb.Delete(streamKey, db.wo); err != nil {
+				return err
+			}
+			if err := wb.Delete(key, db.wo); err != nil {
+				return err
+			}
+			return c.Remove(link.Stream, 1, int64(len(v)))
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-func indexScanPrefix(ts []byte) []byte {
-	var buf []byte
-	buf = append(buf, 't', ':')
-	if len(ts) == 0 {
-		return buf
+// iterate - passes every key with the prefix and its value to fn
+func (db *DB) iterate(prefix []byte, fn func(k, v []byte) error) error {
+	it := db.pebble.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: store.UpperBound(prefix),
+	})
+	defer it.Close()
+
+	for it.First(); it.Valid(); it.Next() {
+		if err := fn(append([]byte{}, it.Key()...), append([]byte{}, it.Value()...)); err != nil {
+			return err
+		}
 	}
 
-	// Nab the first 6 bytes of the time index
-	return append(buf, ts[:6]...)
+	return it.Error()
 }
 
-func packStream(k store.Key) ([]byte, error) {
-	if len(k.Stream) == 0 {
-		return make([]byte, 0), fmt.Errorf("unable to pack key %v", k)
-	}
-	var buf []byte
-	buf = append(buf, 's', ':')
-	buf = append(buf, k.Stream[:]...)
-	if len(k.Version) > 0 {
-		buf = append(buf, ':')
-		buf = append(buf, k.Version...)
+// Scan - iterate over the whole store using the handler function
+func (db *DB) Scan(scannerOpt store.ScannerOptions) error {
+	var prefix []byte
+	// Index scan for time
+	if scannerOpt.Index {
+		prefix = store.IndexScanPrefix(scannerOpt.Prefix)
+	} else {
+		prefix = store.StreamScanPrefix(scannerOpt.Prefix)
 	}
-	return buf, nil
-}
 
-func unpackStream(key []byte) (store.Key, error) {
-	k := store.Key{}
-	v := bytes.Split(key, []byte{':'})
+	// seek directly to the offset within the prefix
+	start := append(append([]byte{}, prefix...), scannerOpt.Offset...)
 
-	if len(v) < 3 && (len(v[1]) == 0 || len(v[2]) == 0) {
-		return k, fmt.Errorf("unable to unpack key %v", key)
+	io := &pebble.IterOptions{
+		UpperBound: store.UpperBound(prefix),
+	}
+	if scannerOpt.Reverse {
+		io.LowerBound = prefix
+		io.UpperBound = store.ReverseBound(prefix, scannerOpt.Offset, scannerOpt.IncludeOffset)
 	}
+	it := db.pebble.NewIter(io)
+	defer it.Close()
 
-	k.ID = ulid.ULID{}
-	k.Stream = store.StreamID(v[1])
-	k.Version = v[2]
+	first, next := func() bool { return it.SeekGE(start) }, it.Next
+	if scannerOpt.Reverse {
+		first, next = it.Last, it.Prev
+	}
 
-	return k, nil
-}
+	for first(); it.Valid(); next() {
+		// every key at the offset starts with it, there can be several at an index position
+		if len(scannerOpt.Offset) > 0 && !scannerOpt.IncludeOffset && bytes.HasPrefix(it.Key(), start) {
+			continue
+		}
 
-func packIndex(ts, stream, offset []byte) []byte {
-	var buf []byte
-	buf = append(buf, 't', ':')
-	buf = append(buf, ts...)
-	buf = append(buf, ':')
-	buf = append(buf, stream...)
-	buf = append(buf, ':')
-	buf = append(buf, offset...)
-	return buf
-}
+		// valid kv pair to pass to the handler
+		k := make([]byte, len(it.Key()))
+		copy(k, it.Key())
 
-func unpackIndex(key []byte) (store.Key, error) {
-	k := store.Key{}
-	v := bytes.Split(key, []byte{':'})
+		var key store.Key
+		var err error
 
-	if len(v) == 4 && (len(v[1]) != 16 || len(v[2]) == 0 || len(v[3]) == 0) {
-		return k, fmt.Errorf("unable to unpack key %v", key)
-	}
+		if scannerOpt.Index {
+			key, err = store.UnpackIndex(k)
+		} else {
+			key, err = store.UnpackStream(k)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid key format %s", string(k))
+		}
 
-	var id ulid.ULID
-	copy(id[:], v[1])
+		var v string
+		if scannerOpt.FetchValues {
+			if key.ID, v, err = store.DecodeRecord(it.Value()); err != nil {
+				return err
+			}
+		}
 
-	k.ID = id
-	k.Stream = store.StreamID(v[2])
-	k.Version = v[3]
+		if !scannerOpt.Handler(key, v) {
+			break
+		}
+	}
 
-	return k, nil
+	return it.Error()
 }
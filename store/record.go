@@ -0,0 +1,63 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package store
+
+import (
+	"fmt"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// Events are stored as a record so that reads of a stream know the global
+// position of each event:
+//
+//   <record version><ulid><value>
+//
+// Version 1 records hold the data of the event, version 2 records hold the
+// event envelope encoded by EncodeEvent.
+
+const (
+	recordV1 byte = 1
+	recordV2 byte = 2
+)
+
+// EncodeRecord - encodes the stored value of an event
+func EncodeRecord(id ulid.ULID, v string) []byte {
+	buf := make([]byte, 0, 1+len(id)+len(v))
+	buf = append(buf, recordV2)
+	buf = append(buf, id[:]...)
+	buf = append(buf, v...)
+	return buf
+}
+
+// DecodeRecord - decodes a value encoded by EncodeRecord into the event position and value,
+// the data of version 1 records is returned as an envelope
+func DecodeRecord(b []byte) (ulid.ULID, string, error) {
+	var id ulid.ULID
+	if len(b) < 1+len(id) || (b[0] != recordV1 && b[0] != recordV2) {
+		return id, "", fmt.Errorf("unable to decode record %v", b)
+	}
+
+	copy(id[:], b[1:1+len(id)])
+
+	v := string(b[1+len(id):])
+	if b[0] == recordV1 {
+		v = EncodeEvent(Event{Data: v})
+	}
+
+	return id, v, nil
+}
@@ -17,6 +17,8 @@
 package store
 
 import (
+	"errors"
+
 	"github.com/oklog/ulid/v2"
 )
 
@@ -26,6 +28,14 @@ const (
 	BADGER DBType = iota
 	BOLT
 	PEBBLE
+	MEMORY
+)
+
+var (
+	// ErrNotFound - returned when a key does not exist in the store
+	ErrNotFound = errors.New("key not found")
+	// ErrStreamDeleted - returned when appending to a stream that was hard deleted
+	ErrStreamDeleted = errors.New("STREAMDELETED stream has been deleted")
 )
 
 // Stream ID - id type
@@ -39,12 +49,12 @@ type Key struct {
 	// Stream name
 	Stream StreamID
 
-	// Version offset
-	Version []byte
+	// Version offset, starting at 1 for the first event of a stream
+	Version uint64
 }
 
 // NewEventKey - create a new Event with defined Ulid
-func NewEventKey(stream, version []byte) Key {
+func NewEventKey(stream []byte, version uint64) Key {
 	return Key{
 		ID:      GenUlid(),
 		Stream:  StreamID(stream),
@@ -52,12 +62,22 @@ func NewEventKey(stream, version []byte) Key {
 	}
 }
 
-// DB - database interface
+// DB - database interface, the values of events are envelopes encoded by EncodeEvent
 type DB interface {
 	Set(k Key, v string) error
+	Append(stream StreamID, expected int64, v string) (Key, error)
+	AppendBatch(stream StreamID, expected int64, values []string) ([]Key, error)
+	AppendLinked(stream StreamID, expected int64, values []string, linker Linker) ([]Key, []Key, error)
 	Get(k Key) (string, error)
-	Del(keys []string) error
+	Del(streams []string) (map[string]uint64, error)
+	Head(stream StreamID) (uint64, error)
+	Truncate(stream StreamID, before uint64) error
 	Scan(ScannerOpt ScannerOptions) error
+	SetMeta(ns Namespace, key, v string) error
+	GetMeta(ns Namespace, key string) (string, error)
+	DelMeta(ns Namespace, key string) error
+	ScanMeta(ns Namespace, handler MetaHandler) error
+	ScanMetaFrom(ns Namespace, from string, handler MetaHandler) error
 	Size() int64
 	GC() error
 	Close()
@@ -66,18 +86,26 @@ type DB interface {
 // Handler - handler used for the scanner options
 type Handler func(k Key, v string) bool
 
+// MetaHandler - handler used to scan the values of a namespace
+type MetaHandler func(key, v string) bool
+
 // ScannerOptions - represents the options for a scanner
 type ScannerOptions struct {
-	// from where to start
+	// from where to start, for stream scans this is an encoded version
+	// and for index scans the ulid of a global position
 	Offset []byte
 
-	// whether to include the value of the offset in the result or not
+	// whether to include the event(s) at the offset in the result or not
 	IncludeOffset bool
 
+	// iterate from the offset, or from the last key of the prefix, down to the first key
+	Reverse bool
+
 	// the prefix that must be exists in each key in the iteration
 	Prefix []byte
 
-	// fetch the values (true) or this is a key only iteration (false)
+	// fetch the values (true) or this is a key only iteration (false),
+	// the ID of keys in a stream scan is only known when values are fetched
 	FetchValues bool
 
 	// fetch values from the time series index
@@ -0,0 +1,55 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package storetest
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/maarek/aves/store"
+	"github.com/maarek/aves/store/memory"
+)
+
+// OpenMemory - opens an empty in memory database for the tests of the packages built on
+// the store, it is closed when the test ends
+func OpenMemory(t *testing.T) store.DB {
+	t.Helper()
+
+	db, err := memory.OpenDB()
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	t.Cleanup(db.Close)
+	return db
+}
+
+// AppendEvents - appends count events to the stream the way the server writes them, the
+// data of each event is the stream followed by its version
+func AppendEvents(t *testing.T, db store.DB, stream string, count int) []store.Key {
+	t.Helper()
+
+	var keys []store.Key
+	for i := 0; i < count; i++ {
+		v := store.EncodeEvent(store.Event{Data: fmt.Sprintf("%s-%d", stream, i+1)})
+		k, err := db.Append(store.StreamID(stream), store.ExpectAny, v)
+		if err != nil {
+			t.Fatalf("append failed: %v", err)
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -0,0 +1,1093 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package storetest provides a conformance suite that every store.DB
+// implementation runs so that switching the store type does not change
+// the semantics seen by the commands, along with fixtures for the tests of
+// the packages built on the store.
+package storetest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maarek/aves/store"
+	"github.com/oklog/ulid/v2"
+)
+
+// Opener - opens an empty database, the suite closes it when the test ends
+type Opener func(t *testing.T) store.DB
+
+// Run - runs the conformance suite against the databases returned by open
+func Run(t *testing.T, open Opener) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, db store.DB)
+	}{
+		{"Ordering", testOrdering},
+		{"Offsets", testOffsets},
+		{"HandlerStop", testHandlerStop},
+		{"ReadDuringScan", testReadDuringScan},
+		{"LongScan", testLongScan},
+		{"DuplicateVersion", testDuplicateVersion},
+		{"ExpectedVersion", testExpectedVersion},
+		{"AtomicBatch", testAtomicBatch},
+		{"PrefixIsolation", testPrefixIsolation},
+		{"Get", testGet},
+		{"Delete", testDelete},
+		{"DeleteLinks", testDeleteLinks},
+		{"LargeDelete", testLargeDelete},
+		{"Truncate", testTruncate},
+		{"LargeTruncate", testLargeTruncate},
+		{"Links", testLinks},
+		{"IndexScan", testIndexScan},
+		{"IndexPrefixBound", testIndexPrefixBound},
+		{"Reverse", testReverse},
+		{"Positions", testPositions},
+		{"Meta", testMeta},
+		{"Catalog", testCatalog},
+		{"SizeAndGC", testSizeAndGC},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			db := open(t)
+			defer db.Close()
+			tt.fn(t, db)
+		})
+	}
+}
+
+// event - a key and value passed to a scan handler
+type event struct {
+	key   store.Key
+	value string
+}
+
+func scan(t *testing.T, db store.DB, opts store.ScannerOptions) []event {
+	t.Helper()
+
+	var events []event
+	opts.FetchValues = true
+	opts.Handler = func(k store.Key, v string) bool {
+		events = append(events, event{key: k, value: v})
+		return true
+	}
+
+	if err := db.Scan(opts); err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+
+	return events
+}
+
+func scanStream(t *testing.T, db store.DB, stream string) []event {
+	t.Helper()
+	return scan(t, db, store.ScannerOptions{
+		Prefix:        []byte(stream),
+		IncludeOffset: true,
+	})
+}
+
+// value - an event holding the data as AppendEvents writes it
+func value(data string) string {
+	return store.EncodeEvent(store.Event{Data: data})
+}
+
+// data - the data of an event appended by AppendEvents
+func data(t *testing.T, v string) string {
+	t.Helper()
+
+	e, err := store.DecodeEvent(v)
+	if err != nil {
+		t.Fatalf("unable to decode event %q: %v", v, err)
+	}
+	return e.Data
+}
+
+func assertVersions(t *testing.T, events []event, stream string, from, to uint64) {
+	t.Helper()
+
+	if want := int(to - from + 1); len(events) != want {
+		t.Fatalf("expected %d events of %q, got %d", want, stream, len(events))
+	}
+
+	for i, e := range events {
+		version := from + uint64(i)
+		if string(e.key.Stream) != stream || e.key.Version != version {
+			t.Fatalf("expected %q version %d at %d, got %q version %d", stream, version, i, e.key.Stream, e.key.Version)
+		}
+		if want := fmt.Sprintf("%s-%d", stream, version); data(t, e.value) != want {
+			t.Fatalf("expected data %q at version %d, got %q", want, version, e.value)
+		}
+	}
+}
+
+// versions are compared numerically, past 9 and past bytes that look like delimiters
+func testOrdering(t *testing.T, db store.DB) {
+	AppendEvents(t, db, "order", 300)
+
+	assertVersions(t, scanStream(t, db, "order"), "order", 1, 300)
+}
+
+func testOffsets(t *testing.T, db store.DB) {
+	AppendEvents(t, db, "order", 20)
+
+	events := scan(t, db, store.ScannerOptions{
+		Prefix:        []byte("order"),
+		Offset:        store.EncodeVersion(10),
+		IncludeOffset: true,
+	})
+	assertVersions(t, events, "order", 10, 20)
+
+	events = scan(t, db, store.ScannerOptions{
+		Prefix: []byte("order"),
+		Offset: store.EncodeVersion(10),
+	})
+	assertVersions(t, events, "order", 11, 20)
+
+	events = scan(t, db, store.ScannerOptions{
+		Prefix: []byte("order"),
+		Offset: store.EncodeVersion(20),
+	})
+	if len(events) != 0 {
+		t.Fatalf("expected no events after the head, got %d", len(events))
+	}
+}
+
+func testHandlerStop(t *testing.T, db store.DB) {
+	AppendEvents(t, db, "order", 10)
+
+	seen := 0
+	err := db.Scan(store.ScannerOptions{
+		Prefix:        []byte("order"),
+		IncludeOffset: true,
+		Handler: func(k store.Key, v string) bool {
+			seen++
+			return seen < 3
+		},
+	})
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+	if seen != 3 {
+		t.Fatalf("expected the scan to stop after 3 events, saw %d", seen)
+	}
+}
+
+func testReadDuringScan(t *testing.T, db store.DB) {
+	AppendEvents(t, db, "order", 3)
+
+	// handlers read from the database while appends wait to write
+	done := make(chan error, 2)
+	go func() {
+		seen := 0
+		done <- db.Scan(store.ScannerOptions{
+			Prefix:        []byte("order"),
+			IncludeOffset: true,
+			Handler: func(k store.Key, v string) bool {
+				if seen == 0 {
+					go func() {
+						_, err := db.Append([]byte("user"), store.ExpectAny, "appended")
+						done <- err
+					}()
+					time.Sleep(20 * time.Millisecond)
+				}
+				seen++
+
+				if _, err := db.Head(k.Stream); err != nil {
+					t.Errorf("head failed: %v", err)
+				}
+				if _, err := db.Get(k); err != nil {
+					t.Errorf("get failed: %v", err)
+				}
+				if _, err := db.GetMeta(store.CatalogNamespace, string(k.Stream)); err != nil {
+					t.Errorf("get meta failed: %v", err)
+				}
+				return true
+			},
+		})
+	}()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("scan or append failed: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected reads within a scan not to wait on an append")
+		}
+	}
+}
+
+func testLongScan(t *testing.T, db store.DB) {
+	// enough events and links for a scan to read them in several parts
+	for stream, count := range map[string]int{"order-1": 400, "order-2": 300} {
+		values := make([]string, count)
+		for i := range values {
+			values[i] = store.EncodeEvent(store.Event{Type: "Placed", Data: fmt.Sprintf("%s-%d", stream, i+1)})
+		}
+		if _, _, err := db.AppendLinked(store.StreamID(stream), store.ExpectAny, values, store.SystemLinks); err != nil {
+			t.Fatalf("append failed: %v", err)
+		}
+	}
+	const total = 3 * 700
+
+	for _, reverse := range []bool{false, true} {
+		var last store.Key
+		seen := 0
+		err := db.Scan(store.ScannerOptions{
+			IncludeOffset: true,
+			Reverse:       reverse,
+			Handler: func(k store.Key, v string) bool {
+				if seen > 0 && bytes.Equal(k.Stream, last.Stream) && k.Version != last.Version+1 && k.Version+1 != last.Version {
+					t.Fatalf("expected consecutive versions, got %d after %d in %s", k.Version, last.Version, k.Stream)
+				}
+				last = k
+				seen++
+				return true
+			},
+		})
+		if err != nil {
+			t.Fatalf("scan failed: %v", err)
+		}
+		if seen != total {
+			t.Fatalf("expected %d events scanning every stream (reverse %v), got %d", total, reverse, seen)
+		}
+	}
+
+	for _, reverse := range []bool{false, true} {
+		var last ulid.ULID
+		seen := 0
+		err := db.Scan(store.ScannerOptions{
+			Index:   true,
+			Reverse: reverse,
+			Handler: func(k store.Key, v string) bool {
+				if seen > 0 && (k.ID.Compare(last) < 0) != reverse && k.ID != last {
+					t.Fatalf("expected the index in position order, got %s after %s", k.ID, last)
+				}
+				last = k.ID
+				seen++
+				return true
+			},
+		})
+		if err != nil {
+			t.Fatalf("scan failed: %v", err)
+		}
+		if seen != total {
+			t.Fatalf("expected %d index entries (reverse %v), got %d", total, reverse, seen)
+		}
+	}
+
+	if events := scanStream(t, db, "order-1"); len(events) != 400 {
+		t.Fatalf("expected 400 events in order-1, got %d", len(events))
+	}
+}
+
+func testDuplicateVersion(t *testing.T, db store.DB) {
+	k := store.NewEventKey([]byte("order"), 1)
+	if err := db.Set(k, "first"); err != nil {
+		t.Fatalf("set failed: %v", err)
+	}
+	if err := db.Set(store.NewEventKey([]byte("order"), 1), "second"); err == nil {
+		t.Fatalf("expected duplicate version to be rejected")
+	}
+	if err := db.Set(store.NewEventKey([]byte("order"), 0), "zero"); err == nil {
+		t.Fatalf("expected version 0 to be rejected")
+	}
+
+	v, err := db.Get(k)
+	if err != nil || v != "first" {
+		t.Fatalf("expected the first value to be kept, got %q %v", v, err)
+	}
+}
+
+func testExpectedVersion(t *testing.T, db store.DB) {
+	stream := store.StreamID("order")
+
+	assertWrong := func(expected int64, actual uint64) {
+		t.Helper()
+		_, err := db.Append(stream, expected, "rejected")
+		var wev *store.WrongExpectedVersionError
+		if !errors.As(err, &wev) {
+			t.Fatalf("expected a wrong expected version error for %s, got %v", store.FormatExpectedVersion(expected), err)
+		}
+		if wev.Actual != actual {
+			t.Fatalf("expected actual head %d, got %d", actual, wev.Actual)
+		}
+	}
+
+	assertWrong(store.ExpectStreamExists, 0)
+	assertWrong(1, 0)
+
+	k, err := db.Append(stream, store.ExpectNoStream, value("order-1"))
+	if err != nil || k.Version != 1 {
+		t.Fatalf("expected version 1, got %d %v", k.Version, err)
+	}
+
+	assertWrong(store.ExpectNoStream, 1)
+	assertWrong(0, 1)
+	assertWrong(2, 1)
+
+	if k, err = db.Append(stream, 1, value("order-2")); err != nil || k.Version != 2 {
+		t.Fatalf("expected version 2, got %d %v", k.Version, err)
+	}
+	if k, err = db.Append(stream, store.ExpectStreamExists, value("order-3")); err != nil || k.Version != 3 {
+		t.Fatalf("expected version 3, got %d %v", k.Version, err)
+	}
+	if k, err = db.Append(stream, store.ExpectAny, value("order-4")); err != nil || k.Version != 4 {
+		t.Fatalf("expected version 4, got %d %v", k.Version, err)
+	}
+
+	assertVersions(t, scanStream(t, db, "order"), "order", 1, 4)
+}
+
+func testAtomicBatch(t *testing.T, db store.DB) {
+	AppendEvents(t, db, "order", 2)
+
+	_, err := db.AppendBatch(store.StreamID("order"), 1, []string{value("order-3"), value("order-4")})
+	if err == nil {
+		t.Fatalf("expected the batch to be rejected")
+	}
+	assertVersions(t, scanStream(t, db, "order"), "order", 1, 2)
+
+	keys, err := db.AppendBatch(store.StreamID("order"), 2, []string{value("order-3"), value("order-4")})
+	if err != nil {
+		t.Fatalf("append batch failed: %v", err)
+	}
+	if len(keys) != 2 || keys[0].Version != 3 || keys[1].Version != 4 {
+		t.Fatalf("expected versions 3 and 4, got %v", keys)
+	}
+	assertVersions(t, scanStream(t, db, "order"), "order", 1, 4)
+}
+
+func testPrefixIsolation(t *testing.T, db store.DB) {
+	streams := []string{"a", "ab", "a:b", "a\x00b", "b"}
+	for i, stream := range streams {
+		AppendEvents(t, db, stream, i+1)
+	}
+
+	for i, stream := range streams {
+		assertVersions(t, scanStream(t, db, stream), stream, 1, uint64(i+1))
+	}
+
+	// a full scan visits every stream in key order
+	events := scan(t, db, store.ScannerOptions{IncludeOffset: true})
+	if len(events) != 15 {
+		t.Fatalf("expected 15 events in a full scan, got %d", len(events))
+	}
+	for i := 1; i < len(events); i++ {
+		prev, cur := events[i-1].key, events[i].key
+		if string(prev.Stream) == string(cur.Stream) && prev.Version >= cur.Version {
+			t.Fatalf("expected increasing versions within %q", cur.Stream)
+		}
+	}
+}
+
+func testGet(t *testing.T, db store.DB) {
+	AppendEvents(t, db, "order", 3)
+
+	v, err := db.Get(store.Key{Stream: store.StreamID("order"), Version: 2})
+	if err != nil || data(t, v) != "order-2" {
+		t.Fatalf("expected order-2, got %q %v", v, err)
+	}
+
+	_, err = db.Get(store.Key{Stream: store.StreamID("order"), Version: 4})
+	if !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("expected not found for a missing version, got %v", err)
+	}
+
+	_, err = db.Get(store.Key{Stream: store.StreamID("missing"), Version: 1})
+	if !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("expected not found for a missing stream, got %v", err)
+	}
+}
+
+func testDelete(t *testing.T, db store.DB) {
+	AppendEvents(t, db, "a", 3)
+	AppendEvents(t, db, "ab", 2)
+	for _, ns := range []store.Namespace{store.DeletedNamespace, store.SnapshotNamespace} {
+		if err := db.SetMeta(ns, "a", "3"); err != nil {
+			t.Fatalf("set meta failed: %v", err)
+		}
+	}
+
+	deleted, err := db.Del([]string{"a", "missing", "a"})
+	if err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if len(deleted) != 2 || deleted["a"] != 3 || deleted["missing"] != 0 {
+		t.Fatalf("expected the heads of a and missing, got %v", deleted)
+	}
+
+	// the records kept besides the events go along with them
+	for _, ns := range []store.Namespace{store.CatalogNamespace, store.DeletedNamespace, store.SnapshotNamespace} {
+		if _, err := db.GetMeta(ns, "a"); !errors.Is(err, store.ErrNotFound) {
+			t.Fatalf("expected the %c record to be deleted, got %v", ns, err)
+		}
+	}
+
+	// a stream is only deleted once
+	if deleted, err := db.Del([]string{"a"}); err != nil || len(deleted) != 0 {
+		t.Fatalf("expected a tombstoned stream to be left out, got %v %v", deleted, err)
+	}
+
+	if events := scanStream(t, db, "a"); len(events) != 0 {
+		t.Fatalf("expected stream events to be deleted, got %d", len(events))
+	}
+	assertVersions(t, scanStream(t, db, "ab"), "ab", 1, 2)
+
+	for _, e := range scan(t, db, store.ScannerOptions{Index: true, IncludeOffset: true}) {
+		if string(e.key.Stream) == "a" {
+			t.Fatalf("expected index entries to be deleted, found version %d", e.key.Version)
+		}
+	}
+
+	if _, err := db.Get(store.Key{Stream: store.StreamID("a"), Version: 1}); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("expected not found after delete, got %v", err)
+	}
+
+	// deleted streams are tombstoned, including those that never had events
+	for _, stream := range []string{"a", "missing"} {
+		if _, err := db.Append(store.StreamID(stream), store.ExpectAny, "again"); !errors.Is(err, store.ErrStreamDeleted) {
+			t.Fatalf("expected appending to deleted %q to fail, got %v", stream, err)
+		}
+	}
+	if err := db.Set(store.NewEventKey([]byte("a"), 1), "again"); !errors.Is(err, store.ErrStreamDeleted) {
+		t.Fatalf("expected setting an event of a deleted stream to fail, got %v", err)
+	}
+	if _, err := db.Append(store.StreamID("ab"), store.ExpectAny, "ab-3"); err != nil {
+		t.Fatalf("expected other streams to accept appends, got %v", err)
+	}
+}
+
+// a hard delete removes the links to the events deleted from the link streams kept
+func testDeleteLinks(t *testing.T, db store.DB) {
+	placed := func(stream string, version int) string {
+		return store.EncodeEvent(store.Event{Type: "Placed", Data: fmt.Sprintf("%s-%d", stream, version)})
+	}
+
+	for _, stream := range []string{"order-1", "order-2"} {
+		if _, _, err := db.AppendLinked(store.StreamID(stream), store.ExpectAny,
+			[]string{placed(stream, 1), placed(stream, 2)}, store.SystemLinks); err != nil {
+			t.Fatalf("append failed: %v", err)
+		}
+	}
+	kept, err := db.Get(store.Key{Stream: store.StreamID("$ce-order"), Version: 3})
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+
+	if _, err := db.Del([]string{"order-1"}); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+
+	for _, stream := range []string{"$ce-order", "$et-Placed"} {
+		assertLinks(t, db, stream, 3, "1@order-2", "2@order-2")
+
+		info, err := store.LoadStreamInfo(db, store.StreamID(stream))
+		size := int64(2 * len(store.EncodeRecord(store.GenUlid(), kept)))
+		if err != nil || info.Head != 4 || info.Count != 2 || info.Size != size {
+			t.Fatalf("expected the catalog of %s to count the links kept, got %+v %v", stream, info, err)
+		}
+	}
+	for _, e := range scan(t, db, store.ScannerOptions{Index: true, IncludeOffset: true}) {
+		if link, _ := store.DecodeEvent(e.value); strings.HasSuffix(link.Data, "@order-1") {
+			t.Fatalf("expected the index entries of the links to be deleted, found %s", link.Data)
+		}
+	}
+
+	// link streams deleted along with the events keep no catalog record
+	if _, err := db.Del([]string{"order-2", "$ce-order"}); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if _, err := db.GetMeta(store.CatalogNamespace, "$ce-order"); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("expected the catalog record of $ce-order to be deleted, got %v", err)
+	}
+
+	// the head of a link stream is kept so that its versions carry on from it
+	assertLinks(t, db, "$et-Placed", 4, "2@order-2")
+	if info, err := store.LoadStreamInfo(db, store.StreamID("$et-Placed")); err != nil || info.Head != 4 || info.Count != 1 {
+		t.Fatalf("expected the head link to be kept, got %+v %v", info, err)
+	}
+	if _, links, err := db.AppendLinked(store.StreamID("order-3"), store.ExpectAny,
+		[]string{placed("order-3", 1)}, store.SystemLinks); err != nil || len(links) != 1 || links[0].Version != 5 {
+		t.Fatalf("expected the next link at version 5, got %v %v", links, err)
+	}
+}
+
+// assertLinks - asserts the targets of the links of the stream from the version given
+func assertLinks(t *testing.T, db store.DB, stream string, from uint64, targets ...string) {
+	t.Helper()
+
+	events := scanStream(t, db, stream)
+	if len(events) != len(targets) {
+		t.Fatalf("expected %d links in %s, got %d", len(targets), stream, len(events))
+	}
+	for i, e := range events {
+		link, err := store.DecodeEvent(e.value)
+		if err != nil || link.Data != targets[i] || e.key.Version != from+uint64(i) {
+			t.Fatalf("expected link %s at version %d of %s, got %+v %v", targets[i], from+uint64(i), stream, link, err)
+		}
+	}
+}
+
+func testLargeDelete(t *testing.T, db store.DB) {
+	appendLarge(t, db, "order-1", largeStream, store.SystemLinks)
+	AppendEvents(t, db, "order-2", 1)
+	if _, _, err := db.AppendLinked(store.StreamID("order-2"), store.ExpectAny,
+		[]string{value("order-2-2")}, store.SystemLinks); err != nil {
+		t.Fatalf("append failed: %v", err)
+	}
+
+	deleted, err := db.Del([]string{"order-1"})
+	if err != nil || deleted["order-1"] != largeStream {
+		t.Fatalf("expected order-1 to be deleted at %d, got %v %v", largeStream, deleted, err)
+	}
+
+	if events := scanStream(t, db, "order-1"); len(events) != 0 {
+		t.Fatalf("expected stream events to be deleted, got %d", len(events))
+	}
+	assertVersions(t, scanStream(t, db, "order-2"), "order-2", 1, 2)
+	assertLinks(t, db, "$ce-order", largeStream+1, "2@order-2")
+
+	if events := scan(t, db, store.ScannerOptions{Index: true, IncludeOffset: true}); len(events) != 3 {
+		t.Fatalf("expected the index entries of order-2 and its link to remain, got %d", len(events))
+	}
+	if _, err := db.Append(store.StreamID("order-1"), store.ExpectAny, value("again")); !errors.Is(err, store.ErrStreamDeleted) {
+		t.Fatalf("expected appending to the deleted stream to fail, got %v", err)
+	}
+}
+
+// truncating drops the oldest events of a stream and their index entries
+func testTruncate(t *testing.T, db store.DB) {
+	AppendEvents(t, db, "a", 5)
+	AppendEvents(t, db, "ab", 2)
+
+	if head, err := db.Head(store.StreamID("a")); err != nil || head != 5 {
+		t.Fatalf("expected head 5, got %d %v", head, err)
+	}
+	if head, err := db.Head(store.StreamID("missing")); err != nil || head != 0 {
+		t.Fatalf("expected head 0 for a missing stream, got %d %v", head, err)
+	}
+
+	if err := db.Truncate(store.StreamID("a"), 4); err != nil {
+		t.Fatalf("truncate failed: %v", err)
+	}
+	if err := db.Truncate(store.StreamID("missing"), 4); err != nil {
+		t.Fatalf("truncate of a missing stream failed: %v", err)
+	}
+
+	assertVersions(t, scanStream(t, db, "a"), "a", 4, 5)
+	assertVersions(t, scanStream(t, db, "ab"), "ab", 1, 2)
+
+	count := 0
+	for _, e := range scan(t, db, store.ScannerOptions{Index: true, IncludeOffset: true}) {
+		if string(e.key.Stream) == "a" {
+			if e.key.Version < 4 {
+				t.Fatalf("expected index entries to be truncated, found version %d", e.key.Version)
+			}
+			count++
+		}
+	}
+	if count != 2 {
+		t.Fatalf("expected 2 index entries to remain, got %d", count)
+	}
+
+	// truncating past the head empties the stream
+	if err := db.Truncate(store.StreamID("a"), 6); err != nil {
+		t.Fatalf("truncate failed: %v", err)
+	}
+	if head, err := db.Head(store.StreamID("a")); err != nil || head != 0 {
+		t.Fatalf("expected an empty stream, got head %d %v", head, err)
+	}
+	if err := db.Truncate(store.StreamID(""), 1); err == nil {
+		t.Fatalf("expected an error truncating an empty stream name")
+	}
+}
+
+// largeStream - the number of events of a stream too large to be removed in one transaction
+const largeStream = 30000
+
+// appendLarge - appends count events to the stream and links them in batches small enough for every store
+func appendLarge(t *testing.T, db store.DB, stream string, count int, linker store.Linker) {
+	t.Helper()
+
+	values := make([]string, 0, 1000)
+	for i := 1; i <= count; i++ {
+		values = append(values, value(fmt.Sprintf("%s-%d", stream, i)))
+		if len(values) < cap(values) && i < count {
+			continue
+		}
+		if _, _, err := db.AppendLinked(store.StreamID(stream), store.ExpectAny, values, linker); err != nil {
+			t.Fatalf("append to %q failed: %v", stream, err)
+		}
+		values = values[:0]
+	}
+}
+
+func testLargeTruncate(t *testing.T, db store.DB) {
+	appendLarge(t, db, "order", largeStream, nil)
+	AppendEvents(t, db, "other", 2)
+
+	if err := db.Truncate(store.StreamID("order"), largeStream-1); err != nil {
+		t.Fatalf("truncate failed: %v", err)
+	}
+	assertVersions(t, scanStream(t, db, "order"), "order", largeStream-1, largeStream)
+	assertVersions(t, scanStream(t, db, "other"), "other", 1, 2)
+
+	count := 0
+	for _, e := range scan(t, db, store.ScannerOptions{Index: true, IncludeOffset: true}) {
+		if string(e.key.Stream) == "order" {
+			count++
+		}
+	}
+	if count != 2 {
+		t.Fatalf("expected 2 index entries to remain, got %d", count)
+	}
+
+	info, err := store.LoadStreamInfo(db, store.StreamID("order"))
+	if err != nil || info.Head != largeStream || info.Count != 2 {
+		t.Fatalf("expected the catalog to count the events kept, got %+v %v", info, err)
+	}
+}
+
+// links are appended to their link streams along with the events they link to
+func testLinks(t *testing.T, db store.DB) {
+	typed := func(stream string, version int, typ string) string {
+		return store.EncodeEvent(store.Event{Type: typ, Data: fmt.Sprintf("%s-%d", stream, version)})
+	}
+
+	keys, links, err := db.AppendLinked(store.StreamID("order-1"), store.ExpectAny,
+		[]string{typed("order-1", 1, "Placed"), typed("order-1", 2, "")}, store.SystemLinks)
+	if err != nil {
+		t.Fatalf("append failed: %v", err)
+	}
+	if len(keys) != 2 || len(links) != 3 {
+		t.Fatalf("expected 2 events and 3 links, got %d and %d", len(keys), len(links))
+	}
+
+	if _, err := db.Del([]string{"$et-Shipped"}); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if _, links, err = db.AppendLinked(store.StreamID("order-2"), store.ExpectAny,
+		[]string{typed("order-2", 1, "Placed"), typed("order-2", 2, "Shipped")}, store.SystemLinks); err != nil {
+		t.Fatalf("expected links to hard deleted streams to be skipped, got %v", err)
+	}
+	if len(links) != 3 {
+		t.Fatalf("expected 3 links, got %d", len(links))
+	}
+
+	// a failed append writes no links
+	if _, _, err := db.AppendLinked(store.StreamID("order-2"), 0,
+		[]string{typed("order-2", 3, "Placed")}, store.SystemLinks); err == nil {
+		t.Fatalf("expected a wrong expected version")
+	}
+
+	for stream, want := range map[string][]string{
+		"$ce-order":  {"1@order-1", "2@order-1", "1@order-2", "2@order-2"},
+		"$et-Placed": {"1@order-1", "1@order-2"},
+	} {
+		events := scanStream(t, db, stream)
+		if len(events) != len(want) {
+			t.Fatalf("expected %d links in %s, got %d", len(want), stream, len(events))
+		}
+		for i, e := range events {
+			link, err := store.DecodeEvent(e.value)
+			if err != nil || link.Type != store.LinkEventType || link.Data != want[i] || e.key.Version != uint64(i+1) {
+				t.Fatalf("expected link %s at version %d of %s, got %+v %v", want[i], i+1, stream, link, err)
+			}
+		}
+	}
+
+	// a link shares the position of its event
+	positions := map[string]int{}
+	for _, e := range scan(t, db, store.ScannerOptions{Index: true, IncludeOffset: true}) {
+		positions[e.key.ID.String()]++
+	}
+	if positions[keys[0].ID.String()] != 3 || positions[keys[1].ID.String()] != 2 {
+		t.Fatalf("expected the links to be indexed at the position of their event, got %v", positions)
+	}
+
+	target, e, err := store.ResolveLink(db, links[0], store.Event{Type: store.LinkEventType, Data: "1@order-2"})
+	if err != nil || string(target.Stream) != "order-2" || target.Version != 1 || e.Data != "order-2-1" {
+		t.Fatalf("expected the link to resolve to order-2 version 1, got %+v %+v %v", target, e, err)
+	}
+}
+
+// the index holds every event in the order it was committed
+func testIndexScan(t *testing.T, db store.DB) {
+	var keys []store.Key
+	keys = append(keys, AppendEvents(t, db, "b", 2)...)
+	keys = append(keys, AppendEvents(t, db, "a", 2)...)
+	keys = append(keys, AppendEvents(t, db, "c", 1)...)
+
+	events := scan(t, db, store.ScannerOptions{Index: true, IncludeOffset: true})
+	if len(events) != len(keys) {
+		t.Fatalf("expected %d index entries, got %d", len(keys), len(events))
+	}
+
+	for i, e := range events {
+		k := keys[i]
+		if e.key.ID != k.ID || string(e.key.Stream) != string(k.Stream) || e.key.Version != k.Version {
+			t.Fatalf("expected %q version %d at %d, got %q version %d", k.Stream, k.Version, i, e.key.Stream, e.key.Version)
+		}
+		if want := fmt.Sprintf("%s-%d", k.Stream, k.Version); data(t, e.value) != want {
+			t.Fatalf("expected index data %q, got %q", want, e.value)
+		}
+	}
+}
+
+// index scans narrowed to a millisecond ending with 0xff stop at the next millisecond
+func testIndexPrefixBound(t *testing.T, db store.DB) {
+	var ids []ulid.ULID
+	for i, ms := range []uint64{0x0102030405ff, 0x0102030405ff, 0x010203040600} {
+		var id ulid.ULID
+		if err := id.SetTime(ms); err != nil {
+			t.Fatalf("set time failed: %v", err)
+		}
+		id[15] = byte(i)
+		if err := db.Set(store.Key{ID: id, Stream: store.StreamID("order"), Version: uint64(i + 1)}, "v"); err != nil {
+			t.Fatalf("set failed: %v", err)
+		}
+		ids = append(ids, id)
+	}
+
+	for _, reverse := range []bool{false, true} {
+		events := scan(t, db, store.ScannerOptions{Index: true, Prefix: ids[0][:], Reverse: reverse})
+		if len(events) != 2 {
+			t.Fatalf("expected the 2 events of the millisecond (reverse %v), got %d", reverse, len(events))
+		}
+		for _, e := range events {
+			if e.key.ID == ids[2] {
+				t.Fatalf("expected the next millisecond to be left out (reverse %v)", reverse)
+			}
+		}
+	}
+}
+
+// reverse scans read from the offset, or from the head, down to the first event, versions
+// ending with 0xff included
+func testReverse(t *testing.T, db store.DB) {
+	AppendEvents(t, db, "a", 3)
+	keys := AppendEvents(t, db, "order", 300)
+	AppendEvents(t, db, "z", 3)
+
+	reversed := func(events []event) []event {
+		for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+			events[i], events[j] = events[j], events[i]
+		}
+		return events
+	}
+
+	events := scan(t, db, store.ScannerOptions{Prefix: []byte("order"), Reverse: true})
+	assertVersions(t, reversed(events), "order", 1, 300)
+
+	events = scan(t, db, store.ScannerOptions{
+		Prefix:        []byte("order"),
+		Offset:        store.EncodeVersion(255),
+		IncludeOffset: true,
+		Reverse:       true,
+	})
+	assertVersions(t, reversed(events), "order", 1, 255)
+
+	events = scan(t, db, store.ScannerOptions{
+		Prefix:  []byte("order"),
+		Offset:  store.EncodeVersion(255),
+		Reverse: true,
+	})
+	assertVersions(t, reversed(events), "order", 1, 254)
+
+	// the scan stops when the handler does
+	var last store.Key
+	err := db.Scan(store.ScannerOptions{
+		Prefix:  []byte("order"),
+		Reverse: true,
+		Handler: func(k store.Key, v string) bool {
+			last = k
+			return false
+		},
+	})
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+	if last.Version != 300 {
+		t.Fatalf("expected the head to be read first, got version %d", last.Version)
+	}
+
+	events = scan(t, db, store.ScannerOptions{Reverse: true})
+	if len(events) != 306 || string(events[0].key.Stream) != "z" || string(events[305].key.Stream) != "a" {
+		t.Fatalf("expected the streams in reverse order, got %d events", len(events))
+	}
+
+	events = scan(t, db, store.ScannerOptions{
+		Index:   true,
+		Offset:  keys[99].ID[:],
+		Reverse: true,
+	})
+	if len(events) != 102 || events[0].key.ID != keys[98].ID || string(events[101].key.Stream) != "a" {
+		t.Fatalf("expected the index before version 100 in reverse order, got %d entries", len(events))
+	}
+}
+
+// positions increase with every append and a scan resumes strictly after one
+func testPositions(t *testing.T, db store.DB) {
+	var keys []store.Key
+	for i := 0; i < 50; i++ {
+		keys = append(keys, AppendEvents(t, db, fmt.Sprintf("stream-%d", i%3), 2)...)
+	}
+
+	for i := 1; i < len(keys); i++ {
+		if keys[i].ID.Compare(keys[i-1].ID) <= 0 {
+			t.Fatalf("expected position %s to sort after %s", keys[i].ID, keys[i-1].ID)
+		}
+	}
+
+	// stream scans carry the position of each event
+	for _, e := range scanStream(t, db, "stream-0") {
+		found := false
+		for _, k := range keys {
+			found = found || (k.ID == e.key.ID && string(k.Stream) == "stream-0" && k.Version == e.key.Version)
+		}
+		if !found {
+			t.Fatalf("unexpected position %s for version %d", e.key.ID, e.key.Version)
+		}
+	}
+
+	for _, from := range []int{0, 41, len(keys) - 1} {
+		events := scan(t, db, store.ScannerOptions{Index: true, Offset: keys[from].ID[:]})
+		if want := len(keys) - from - 1; len(events) != want {
+			t.Fatalf("expected %d events after position %d, got %d", want, from, len(events))
+		}
+		for i, e := range events {
+			if e.key.ID != keys[from+i+1].ID {
+				t.Fatalf("expected position %s, got %s", keys[from+i+1].ID, e.key.ID)
+			}
+		}
+	}
+
+	events := scan(t, db, store.ScannerOptions{Index: true, Offset: keys[10].ID[:], IncludeOffset: true})
+	if len(events) != len(keys)-10 || events[0].key.ID != keys[10].ID {
+		t.Fatalf("expected the scan to include position %s", keys[10].ID)
+	}
+}
+
+// values besides the events are kept apart from the streams
+func testMeta(t *testing.T, db store.DB) {
+	AppendEvents(t, db, "g", 2)
+
+	if _, err := db.GetMeta(store.GroupNamespace, "g"); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("expected not found for a missing value, got %v", err)
+	}
+
+	if err := db.SetMeta(store.GroupNamespace, "g", "first"); err != nil {
+		t.Fatalf("set meta failed: %v", err)
+	}
+	if err := db.SetMeta(store.GroupNamespace, "g", "second"); err != nil {
+		t.Fatalf("set meta failed: %v", err)
+	}
+
+	v, err := db.GetMeta(store.GroupNamespace, "g")
+	if err != nil || v != "second" {
+		t.Fatalf("expected the value to be replaced, got %q %v", v, err)
+	}
+
+	assertVersions(t, scanStream(t, db, "g"), "g", 1, 2)
+	if events := scan(t, db, store.ScannerOptions{IncludeOffset: true}); len(events) != 2 {
+		t.Fatalf("expected a full scan to only visit events, got %d", len(events))
+	}
+	if _, err := db.Del([]string{"g"}); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+
+	if v, err = db.GetMeta(store.GroupNamespace, "g"); err != nil || v != "second" {
+		t.Fatalf("expected the value to outlive the stream, got %q %v", v, err)
+	}
+
+	if err := db.SetMeta(store.GroupNamespace, "h", "third"); err != nil {
+		t.Fatalf("set meta failed: %v", err)
+	}
+	if err := db.SetMeta(store.CheckpointNamespace, "g", "other"); err != nil {
+		t.Fatalf("set meta failed: %v", err)
+	}
+
+	var scanned []string
+	err = db.ScanMeta(store.GroupNamespace, func(key, v string) bool {
+		scanned = append(scanned, key+"="+v)
+		return true
+	})
+	if err != nil || strings.Join(scanned, ",") != "g=second,h=third" {
+		t.Fatalf("expected the values of the namespace in key order, got %v %v", scanned, err)
+	}
+
+	scanned = nil
+	err = db.ScanMetaFrom(store.GroupNamespace, "gg", func(key, v string) bool {
+		scanned = append(scanned, key+"="+v)
+		return true
+	})
+	if err != nil || strings.Join(scanned, ",") != "h=third" {
+		t.Fatalf("expected the values of the namespace from gg, got %v %v", scanned, err)
+	}
+
+	if err := db.DelMeta(store.GroupNamespace, "g"); err != nil {
+		t.Fatalf("delete meta failed: %v", err)
+	}
+	if _, err := db.GetMeta(store.GroupNamespace, "g"); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("expected not found after delete, got %v", err)
+	}
+}
+
+func testSizeAndGC(t *testing.T, db store.DB) {
+	AppendEvents(t, db, "order", 10)
+
+	if size := db.Size(); size < 0 {
+		t.Fatalf("expected a size, got %d", size)
+	}
+	if err := db.GC(); err != nil {
+		t.Fatalf("gc failed: %v", err)
+	}
+}
+
+// the catalog record of a stream follows its writes, truncation and deletion
+func testCatalog(t *testing.T, db store.DB) {
+	info := func(stream string) store.StreamInfo {
+		t.Helper()
+		info, err := store.LoadStreamInfo(db, store.StreamID(stream))
+		if err != nil {
+			t.Fatalf("load of %q failed: %v", stream, err)
+		}
+		return info
+	}
+	// the size of the records of the stream as scanned
+	size := func(stream string) int64 {
+		t.Helper()
+		var size int64
+		for _, e := range scanStream(t, db, stream) {
+			size += int64(len(store.EncodeRecord(e.key.ID, e.value)))
+		}
+		return size
+	}
+
+	keys := AppendEvents(t, db, "a", 3)
+	keys = append(keys, AppendEvents(t, db, "a", 2)...)
+	AppendEvents(t, db, "ab", 1)
+
+	a := info("a")
+	if a.Head != 5 || a.Count != 5 || a.Size != size("a") {
+		t.Fatalf("expected head 5, 5 events of %d bytes, got %+v", size("a"), a)
+	}
+	if !a.Created.Equal(ulid.Time(keys[0].ID.Time())) || !a.Updated.Equal(ulid.Time(keys[4].ID.Time())) {
+		t.Fatalf("expected the times of the first and last events, got %+v", a)
+	}
+	if _, err := store.LoadStreamInfo(db, store.StreamID("missing")); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("expected no record of a missing stream, got %v", err)
+	}
+
+	// links are recorded in their link streams
+	if _, _, err := db.AppendLinked(store.StreamID("order-1"), store.ExpectAny,
+		[]string{store.EncodeEvent(store.Event{Type: "Placed"})}, store.SystemLinks); err != nil {
+		t.Fatalf("append failed: %v", err)
+	}
+	if ce := info("$ce-order"); ce.Head != 1 || ce.Count != 1 || ce.Size != size("$ce-order") {
+		t.Fatalf("expected a record of the link, got %+v", ce)
+	}
+
+	if err := db.Set(store.NewEventKey([]byte("b"), 7), "b-7"); err != nil {
+		t.Fatalf("set failed: %v", err)
+	}
+	if b := info("b"); b.Head != 7 || b.Count != 1 {
+		t.Fatalf("expected head 7 and 1 event, got %+v", b)
+	}
+
+	// truncation keeps the head
+	if err := db.Truncate(store.StreamID("a"), 4); err != nil {
+		t.Fatalf("truncate failed: %v", err)
+	}
+	if a = info("a"); a.Head != 5 || a.Count != 2 || a.Size != size("a") {
+		t.Fatalf("expected head 5, 2 events of %d bytes, got %+v", size("a"), a)
+	}
+
+	if _, err := db.Del([]string{"ab"}); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+
+	var streams []string
+	err := store.ScanStreams(db, nil, func(stream store.StreamID, _ store.StreamInfo) bool {
+		streams = append(streams, string(stream))
+		return true
+	})
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+	if want := "$ce-order $et-Placed a b order-1"; strings.Join(streams, " ") != want {
+		t.Fatalf("expected streams %s, got %v", want, streams)
+	}
+
+	var from []string
+	err = store.ScanStreams(db, store.StreamID("ab"), func(stream store.StreamID, _ store.StreamInfo) bool {
+		from = append(from, string(stream))
+		return true
+	})
+	if err != nil || strings.Join(from, " ") != "b order-1" {
+		t.Fatalf("expected the streams from ab, got %v %v", from, err)
+	}
+
+	// a catalog missing is built from the events and marked as built
+	for _, stream := range streams {
+		if err := db.DelMeta(store.CatalogNamespace, stream); err != nil {
+			t.Fatalf("delete failed: %v", err)
+		}
+	}
+	if err := db.DelMeta(store.StoreNamespace, store.CatalogBuilt); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if err := store.BuildCatalog(db); err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+	if _, err := db.GetMeta(store.StoreNamespace, store.CatalogBuilt); err != nil {
+		t.Fatalf("expected the catalog to be marked as built, got %v", err)
+	}
+
+	// a build stopped partway wrote some of the records and no marker
+	if err := db.DelMeta(store.CatalogNamespace, "a"); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if err := store.BuildCatalog(db); err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+	if _, err := store.LoadStreamInfo(db, store.StreamID("a")); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("expected a built catalog to be left as is, got %v", err)
+	}
+	if err := db.DelMeta(store.StoreNamespace, store.CatalogBuilt); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if err := store.BuildCatalog(db); err != nil {
+		t.Fatalf("build failed: %v", err)
+	}
+	// the head of a truncated stream is the highest version left
+	if built := info("a"); built.Head != 5 || built.Count != 2 || built.Size != a.Size {
+		t.Fatalf("expected the record to be rebuilt as %+v, got %+v", a, built)
+	}
+	if built := info("order-1"); built.Count != 1 {
+		t.Fatalf("expected the record to be rebuilt, got %+v", built)
+	}
+}
@@ -49,3 +49,41 @@ func GenUlid() ulid.ULID {
 	p.Put(g)
 	return id
 }
+
+// Monotonic - generates strictly increasing ulids used as the global position of events,
+// callers serialize access with their write lock
+type Monotonic struct {
+	last    ulid.ULID
+	entropy io.Reader
+}
+
+// NewMonotonic - creates a generator whose ulids all sort after last
+func NewMonotonic(last ulid.ULID) *Monotonic {
+	return &Monotonic{
+		last:    last,
+		entropy: ulid.Monotonic(rand.New(rand.NewSource(time.Now().UnixNano())), 0),
+	}
+}
+
+// Next - generates the next position, even if the clock moves backwards
+func (m *Monotonic) Next() ulid.ULID {
+	id, err := ulid.New(ulid.Timestamp(time.Now()), m.entropy)
+	if err != nil || id.Compare(m.last) <= 0 {
+		id = m.last
+		for i := len(id) - 1; i >= 0; i-- {
+			id[i]++
+			if id[i] != 0 {
+				break
+			}
+		}
+	}
+	m.last = id
+	return id
+}
+
+// Observe - ensures positions generated afterwards sort after id
+func (m *Monotonic) Observe(id ulid.ULID) {
+	if id.Compare(m.last) > 0 {
+		m.last = id
+	}
+}
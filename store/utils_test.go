@@ -19,8 +19,32 @@ import (
 	"io/ioutil"
 	"sync"
 	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
 )
 
+func TestMonotonic(t *testing.T) {
+	// a position persisted by a clock ahead of the current one
+	last := ulid.MustNew(ulid.Timestamp(time.Now().Add(time.Hour)), nil)
+
+	m := NewMonotonic(last)
+	for i := 0; i < 1000; i++ {
+		id := m.Next()
+		if id.Compare(last) <= 0 {
+			t.Fatalf("expected %s to sort after %s", id, last)
+		}
+		last = id
+	}
+
+	// observed positions are never generated again
+	observed := ulid.MustNew(ulid.Timestamp(time.Now().Add(2*time.Hour)), nil)
+	m.Observe(observed)
+	if id := m.Next(); id.Compare(observed) <= 0 {
+		t.Fatalf("expected %s to sort after observed %s", id, observed)
+	}
+}
+
 func BenchmarkUlid(b *testing.B) {
 	b.ReportAllocs()
 	// Benchmarks
@@ -0,0 +1,41 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package store
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// VersionSize - number of bytes used by an encoded version
+const VersionSize = 8
+
+// EncodeVersion - encodes a version as a fixed width big-endian integer so that
+// versions sort numerically within a stream
+func EncodeVersion(v uint64) []byte {
+	buf := make([]byte, VersionSize)
+	binary.BigEndian.PutUint64(buf, v)
+	return buf
+}
+
+// DecodeVersion - decodes a version encoded by EncodeVersion
+func DecodeVersion(b []byte) (uint64, error) {
+	if len(b) != VersionSize {
+		return 0, fmt.Errorf("unable to decode version %v", b)
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
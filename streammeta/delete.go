@@ -0,0 +1,72 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package streammeta
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/maarek/aves/store"
+)
+
+// SoftDelete - hides the events of the stream up to its head, returning the head. The events
+// are kept so the stream can be restored and appends carry on with the versions after it.
+func SoftDelete(db store.DB, stream string) (uint64, error) {
+	head, err := db.Head(store.StreamID(stream))
+	if err != nil || head == 0 {
+		return head, err
+	}
+
+	if err := db.SetMeta(store.DeletedNamespace, stream, strconv.FormatUint(head, 10)); err != nil {
+		return 0, err
+	}
+
+	return head, nil
+}
+
+// Restore - makes the events hidden by a soft delete visible again, false when the stream was not soft deleted
+func Restore(db store.DB, stream string) (bool, error) {
+	deleted, err := Deleted(db, stream)
+	if err != nil || deleted == 0 {
+		return false, err
+	}
+
+	if err := db.DelMeta(store.DeletedNamespace, stream); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Deleted - the version up to which the stream is soft deleted, 0 when it is not
+func Deleted(db store.DB, stream string) (uint64, error) {
+	v, err := db.GetMeta(store.DeletedNamespace, stream)
+	if errors.Is(err, store.ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	deleted, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unable to load deletion of %s: %v", stream, err)
+	}
+
+	return deleted, nil
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package streammeta
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/maarek/aves/store"
+	"github.com/oklog/ulid/v2"
+)
+
+// Scavenger - periodically deletes the events hidden by the metadata of their stream
+type Scavenger struct {
+	db       store.DB
+	interval time.Duration
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// StartScavenger - starts scavenging the db every interval
+func StartScavenger(db store.DB, interval time.Duration) *Scavenger {
+	s := &Scavenger{
+		db:       db,
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	go s.run()
+
+	return s
+}
+
+// Stop - stops scavenging and waits for a pass in progress to finish
+func (s *Scavenger) Stop() {
+	close(s.stop)
+	<-s.done
+}
+
+func (s *Scavenger) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			if err := Scavenge(s.db, now); err != nil {
+				log.Println("scavenge failed:", err)
+			}
+		}
+	}
+}
+
+// Scavenge - deletes the events hidden by the metadata of every stream as of now. The head
+// of a stream is always kept so that the versions of the stream carry on from it. A stream
+// that fails to be scavenged is logged and the others are scavenged anyway.
+func Scavenge(db store.DB, now time.Time) error {
+	// collect the records first, the store may not be written while they are scanned
+	records := make(map[string]Metadata)
+	var err error
+	scanErr := db.ScanMeta(store.StreamMetaNamespace, func(stream, v string) bool {
+		var m Metadata
+		if m, err = Parse([]byte(v)); err != nil {
+			return false
+		}
+		if m.Bounded() {
+			records[stream] = m
+		}
+		return true
+	})
+	if scanErr != nil {
+		return scanErr
+	}
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+	for stream, m := range records {
+		if err := scavengeStream(db, store.StreamID(stream), m, now); err != nil {
+			log.Printf("scavenge of %s failed: %v", stream, err)
+			failed = append(failed, stream)
+		}
+	}
+
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("unable to scavenge %d streams: %s", len(failed), strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+// scavengeStream - deletes the events of the stream before the first event kept
+func scavengeStream(db store.DB, stream store.StreamID, m Metadata, now time.Time) error {
+	head, err := db.Head(stream)
+	if err != nil || head == 0 {
+		return err
+	}
+
+	first := m.First(head)
+
+	// events are written in position order so the first young enough event ends the scan
+	if m.MaxAge > 0 {
+		cutoff := now.Add(-m.MaxAge)
+		young := head + 1
+		err := db.Scan(store.ScannerOptions{
+			Prefix:        stream,
+			Offset:        store.EncodeVersion(first),
+			IncludeOffset: true,
+			FetchValues:   true,
+			Handler: func(k store.Key, _ string) bool {
+				if k.ID == (ulid.ULID{}) || !ulid.Time(k.ID.Time()).Before(cutoff) {
+					young = k.Version
+					return false
+				}
+				return true
+			},
+		})
+		if err != nil {
+			return err
+		}
+		if young > first {
+			first = young
+		}
+	}
+
+	if first > head {
+		first = head
+	}
+	if first <= 1 {
+		return nil
+	}
+
+	return db.Truncate(stream, first)
+}
@@ -0,0 +1,243 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package streammeta implements the metadata record of a stream. Besides custom
+// values the record bounds the events of a stream by count, age and version.
+// Events outside of the bounds are hidden from reads right away and deleted
+// from the store by the scavenger later on. Events hidden by a soft delete are
+// kept until the stream is restored.
+package streammeta
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/maarek/aves/store"
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	// MaxCount - the number of most recent events kept
+	MaxCount = "$maxCount"
+	// MaxAge - the number of seconds an event is kept after it was written
+	MaxAge = "$maxAge"
+	// TruncateBefore - the version of the first event kept
+	TruncateBefore = "$tb"
+)
+
+// Metadata - the metadata record of a stream, the zero value keeps every event
+type Metadata struct {
+	MaxCount       uint64
+	MaxAge         time.Duration
+	TruncateBefore uint64
+
+	// values of the record not interpreted by the store
+	Custom map[string]json.RawMessage
+}
+
+// Parse - parses a metadata record given as a JSON object, keys starting with $ are reserved
+func Parse(data []byte) (Metadata, error) {
+	var m Metadata
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return m, fmt.Errorf("metadata must be a JSON object: %v", err)
+	}
+	if fields == nil {
+		return m, errors.New("metadata must be a JSON object")
+	}
+
+	for key, raw := range fields {
+		var err error
+		switch key {
+		case MaxCount:
+			m.MaxCount, err = parseCount(key, raw)
+		case MaxAge:
+			var seconds uint64
+			seconds, err = parseCount(key, raw)
+			m.MaxAge = time.Duration(seconds) * time.Second
+		case TruncateBefore:
+			m.TruncateBefore, err = parseCount(key, raw)
+		default:
+			if strings.HasPrefix(key, "$") {
+				return m, fmt.Errorf("unknown metadata key %s", key)
+			}
+			if m.Custom == nil {
+				m.Custom = make(map[string]json.RawMessage)
+			}
+			m.Custom[key] = raw
+		}
+		if err != nil {
+			return m, err
+		}
+	}
+
+	return m, nil
+}
+
+// parseCount - parses a reserved value that must be a positive integer
+func parseCount(key string, raw json.RawMessage) (uint64, error) {
+	var n uint64
+	if err := json.Unmarshal(raw, &n); err != nil || n == 0 {
+		return 0, fmt.Errorf("metadata %s must be a positive integer", key)
+	}
+	return n, nil
+}
+
+// MarshalJSON - encodes the record as a JSON object, leaving out the bounds that are not set
+func (m Metadata) MarshalJSON() ([]byte, error) {
+	fields := make(map[string]interface{}, len(m.Custom)+3)
+	for key, raw := range m.Custom {
+		fields[key] = raw
+	}
+	if m.MaxCount > 0 {
+		fields[MaxCount] = m.MaxCount
+	}
+	if m.MaxAge > 0 {
+		fields[MaxAge] = uint64(m.MaxAge / time.Second)
+	}
+	if m.TruncateBefore > 0 {
+		fields[TruncateBefore] = m.TruncateBefore
+	}
+	return json.Marshal(fields)
+}
+
+// Bounded - determines if the record hides any events
+func (m Metadata) Bounded() bool {
+	return m.MaxCount > 0 || m.MaxAge > 0 || m.TruncateBefore > 0
+}
+
+// First - the version of the first event kept by $tb and $maxCount given the head of the stream
+func (m Metadata) First(head uint64) uint64 {
+	first := m.TruncateBefore
+	if m.MaxCount > 0 && head > m.MaxCount && head-m.MaxCount+1 > first {
+		first = head - m.MaxCount + 1
+	}
+	if first == 0 {
+		first = 1
+	}
+	return first
+}
+
+// Visible - determines if the event is kept given the head of its stream, the age of an
+// event is only known when its position is
+func (m Metadata) Visible(k store.Key, head uint64, now time.Time) bool {
+	if k.Version < m.First(head) {
+		return false
+	}
+	if m.MaxAge > 0 && k.ID != (ulid.ULID{}) && ulid.Time(k.ID.Time()).Before(now.Add(-m.MaxAge)) {
+		return false
+	}
+	return true
+}
+
+// Load - loads the metadata record of the stream, the zero record when it has none
+func Load(db store.DB, stream string) (Metadata, error) {
+	v, err := db.GetMeta(store.StreamMetaNamespace, stream)
+	if errors.Is(err, store.ErrNotFound) {
+		return Metadata{}, nil
+	}
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	m, err := Parse([]byte(v))
+	if err != nil {
+		return Metadata{}, fmt.Errorf("unable to load metadata of %s: %v", stream, err)
+	}
+
+	return m, nil
+}
+
+// Save - replaces the metadata record of the stream
+func Save(db store.DB, stream string, m Metadata) error {
+	v, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	return db.SetMeta(store.StreamMetaNamespace, stream, string(v))
+}
+
+// bounds - the metadata, head and soft deletion of a stream as seen by a filter
+type bounds struct {
+	meta    Metadata
+	head    uint64
+	deleted uint64
+}
+
+// Filter - hides the events outside of the bounds of their stream and those soft deleted, the
+// state of each stream is loaded once so a filter is meant for a single read
+type Filter struct {
+	db      store.DB
+	now     time.Time
+	streams map[string]*bounds
+}
+
+// NewFilter - creates a filter for the events of the db as of now
+func NewFilter(db store.DB) *Filter {
+	return &Filter{
+		db:      db,
+		now:     time.Now(),
+		streams: make(map[string]*bounds),
+	}
+}
+
+// Visible - determines if the event is kept by the metadata of its stream and not soft deleted
+func (f *Filter) Visible(k store.Key) (bool, error) {
+	b, ok := f.streams[string(k.Stream)]
+	if !ok {
+		m, err := Load(f.db, string(k.Stream))
+		if err != nil {
+			return false, err
+		}
+
+		b = &bounds{meta: m}
+		if b.deleted, err = Deleted(f.db, string(k.Stream)); err != nil {
+			return false, err
+		}
+		if m.MaxCount > 0 {
+			if b.head, err = f.db.Head(k.Stream); err != nil {
+				return false, err
+			}
+		}
+		f.streams[string(k.Stream)] = b
+	}
+
+	return k.Version > b.deleted && b.meta.Visible(k, b.head, f.now), nil
+}
+
+// Resolve - resolves a link event to the event it links to, false when that event is hidden
+// or no longer exists, any other event is returned as is
+func (f *Filter) Resolve(k store.Key, e store.Event) (store.Key, store.Event, bool, error) {
+	if e.Type != store.LinkEventType {
+		return k, e, true, nil
+	}
+
+	target, resolved, err := store.ResolveLink(f.db, k, e)
+	if errors.Is(err, store.ErrNotFound) {
+		return k, e, false, nil
+	}
+	if err != nil {
+		return k, e, false, err
+	}
+
+	visible, err := f.Visible(target)
+	return target, resolved, visible, err
+}
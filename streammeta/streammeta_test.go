@@ -0,0 +1,281 @@
+/*
+ * Copyright 2020 Jeremy Lyman
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package streammeta
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/maarek/aves/store"
+	"github.com/maarek/aves/store/storetest"
+)
+
+func versions(t *testing.T, db store.DB, stream string) []uint64 {
+	t.Helper()
+
+	var found []uint64
+	err := db.Scan(store.ScannerOptions{
+		Prefix:        []byte(stream),
+		IncludeOffset: true,
+		Handler: func(k store.Key, _ string) bool {
+			found = append(found, k.Version)
+			return true
+		},
+	})
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+	return found
+}
+
+func TestParse(t *testing.T) {
+	m, err := Parse([]byte(`{"$maxCount":3,"$maxAge":60,"$tb":2,"owner":"billing"}`))
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if m.MaxCount != 3 || m.MaxAge != time.Minute || m.TruncateBefore != 2 || string(m.Custom["owner"]) != `"billing"` {
+		t.Fatalf("unexpected metadata %+v", m)
+	}
+
+	v, err := json.Marshal(m)
+	if err != nil || string(v) != `{"$maxAge":60,"$maxCount":3,"$tb":2,"owner":"billing"}` {
+		t.Fatalf("unexpected encoding %s %v", v, err)
+	}
+
+	for _, bad := range []string{`[]`, `null`, `{"$maxCount":0}`, `{"$maxAge":-1}`, `{"$tb":"2"}`, `{"$unknown":1}`} {
+		if _, err := Parse([]byte(bad)); err == nil {
+			t.Fatalf("expected %s to be rejected", bad)
+		}
+	}
+}
+
+func TestVisible(t *testing.T) {
+	now := time.Now()
+	m := Metadata{MaxCount: 3, TruncateBefore: 4}
+
+	// the later of the two bounds applies
+	for version, want := range map[uint64]bool{4: false, 7: false, 8: true, 10: true} {
+		if got := m.Visible(store.Key{Version: version}, 10, now); got != want {
+			t.Fatalf("expected version %d visible %v, got %v", version, want, got)
+		}
+	}
+	for version, want := range map[uint64]bool{3: false, 4: true, 5: true} {
+		if got := m.Visible(store.Key{Version: version}, 5, now); got != want {
+			t.Fatalf("expected version %d visible %v, got %v", version, want, got)
+		}
+	}
+
+	m = Metadata{MaxAge: time.Minute}
+	old := store.Key{ID: store.GenUlid(), Version: 1}
+	if !m.Visible(old, 1, now) || m.Visible(old, 1, now.Add(2*time.Minute)) {
+		t.Fatalf("expected the event to be hidden once older than the max age")
+	}
+}
+
+func TestFilter(t *testing.T) {
+	db := storetest.OpenMemory(t)
+
+	storetest.AppendEvents(t, db, "telemetry", 5)
+	storetest.AppendEvents(t, db, "order", 2)
+
+	if err := Save(db, "telemetry", Metadata{MaxCount: 2}); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+
+	f := NewFilter(db)
+	var visible []string
+	err := db.Scan(store.ScannerOptions{
+		Index:       true,
+		FetchValues: true,
+		Handler: func(k store.Key, v string) bool {
+			ok, err := f.Visible(k)
+			if err != nil {
+				t.Fatalf("filter failed: %v", err)
+			}
+			if ok {
+				e, err := store.DecodeEvent(v)
+				if err != nil {
+					t.Fatalf("decode failed: %v", err)
+				}
+				visible = append(visible, e.Data)
+			}
+			return true
+		},
+	})
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+
+	if fmt.Sprint(visible) != "[telemetry-4 telemetry-5 order-1 order-2]" {
+		t.Fatalf("unexpected events %v", visible)
+	}
+}
+
+func TestScavenge(t *testing.T) {
+	db := storetest.OpenMemory(t)
+
+	storetest.AppendEvents(t, db, "count", 10)
+	storetest.AppendEvents(t, db, "tb", 10)
+	storetest.AppendEvents(t, db, "age", 3)
+	storetest.AppendEvents(t, db, "custom", 3)
+
+	records := map[string]Metadata{
+		"count":  {MaxCount: 4},
+		"tb":     {TruncateBefore: 20},
+		"age":    {MaxAge: time.Minute},
+		"custom": {Custom: map[string]json.RawMessage{"owner": json.RawMessage(`"billing"`)}},
+	}
+	for stream, m := range records {
+		if err := Save(db, stream, m); err != nil {
+			t.Fatalf("save failed: %v", err)
+		}
+	}
+
+	if err := Scavenge(db, time.Now()); err != nil {
+		t.Fatalf("scavenge failed: %v", err)
+	}
+
+	for stream, want := range map[string]string{
+		"count":  "[7 8 9 10]",
+		"tb":     "[10]",
+		"age":    "[1 2 3]",
+		"custom": "[1 2 3]",
+	} {
+		if got := fmt.Sprint(versions(t, db, stream)); got != want {
+			t.Fatalf("expected %s to keep %s, got %s", stream, want, got)
+		}
+	}
+
+	// once old enough only the head of the stream is kept
+	if err := Scavenge(db, time.Now().Add(2*time.Minute)); err != nil {
+		t.Fatalf("scavenge failed: %v", err)
+	}
+	if got := fmt.Sprint(versions(t, db, "age")); got != "[3]" {
+		t.Fatalf("expected only the head to be kept, got %s", got)
+	}
+
+	if _, err := db.Append(store.StreamID("tb"), 10, "tb-11"); err != nil {
+		t.Fatalf("expected versions to carry on from the head, got %v", err)
+	}
+
+	count := 0
+	err := db.Scan(store.ScannerOptions{
+		Index: true,
+		Handler: func(k store.Key, _ string) bool {
+			count++
+			return true
+		},
+	})
+	if err != nil || count != 4+2+1+3 {
+		t.Fatalf("expected the index to be scavenged, got %d entries %v", count, err)
+	}
+}
+
+// failingDB - a store failing to truncate one stream
+type failingDB struct {
+	store.DB
+	stream string
+}
+
+func (db failingDB) Truncate(stream store.StreamID, before uint64) error {
+	if string(stream) == db.stream {
+		return errors.New("Txn is too big to fit into one request")
+	}
+	return db.DB.Truncate(stream, before)
+}
+
+func TestScavengeFailure(t *testing.T) {
+	db := storetest.OpenMemory(t)
+
+	for _, stream := range []string{"a", "b", "c"} {
+		storetest.AppendEvents(t, db, stream, 5)
+		if err := Save(db, stream, Metadata{MaxCount: 2}); err != nil {
+			t.Fatalf("save failed: %v", err)
+		}
+	}
+
+	// a stream that fails does not stop the others from being scavenged
+	err := Scavenge(failingDB{DB: db, stream: "b"}, time.Now())
+	if err == nil || err.Error() != "unable to scavenge 1 streams: b" {
+		t.Fatalf("expected b to fail, got %v", err)
+	}
+
+	for stream, want := range map[string]string{
+		"a": "[4 5]",
+		"b": "[1 2 3 4 5]",
+		"c": "[4 5]",
+	} {
+		if got := fmt.Sprint(versions(t, db, stream)); got != want {
+			t.Fatalf("expected %s to keep %s, got %s", stream, want, got)
+		}
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	db := storetest.OpenMemory(t)
+
+	storetest.AppendEvents(t, db, "order", 3)
+
+	if head, err := SoftDelete(db, "order"); err != nil || head != 3 {
+		t.Fatalf("expected the stream to be deleted at 3, got %d %v", head, err)
+	}
+	if head, err := SoftDelete(db, "missing"); err != nil || head != 0 {
+		t.Fatalf("expected nothing to delete, got %d %v", head, err)
+	}
+
+	// appends carry on after the deleted events
+	if k, err := db.Append(store.StreamID("order"), store.ExpectAny, "order-4"); err != nil || k.Version != 4 {
+		t.Fatalf("expected version 4 to be appended, got %d %v", k.Version, err)
+	}
+
+	visible := func() []uint64 {
+		f := NewFilter(db)
+		var found []uint64
+		for _, version := range versions(t, db, "order") {
+			ok, err := f.Visible(store.Key{Stream: store.StreamID("order"), Version: version})
+			if err != nil {
+				t.Fatalf("filter failed: %v", err)
+			}
+			if ok {
+				found = append(found, version)
+			}
+		}
+		return found
+	}
+
+	if got := fmt.Sprint(visible()); got != "[4]" {
+		t.Fatalf("expected only the events after the delete, got %s", got)
+	}
+
+	// the scavenger leaves soft deleted events alone
+	if err := Scavenge(db, time.Now()); err != nil {
+		t.Fatalf("scavenge failed: %v", err)
+	}
+
+	if restored, err := Restore(db, "order"); err != nil || !restored {
+		t.Fatalf("expected the stream to be restored, got %v %v", restored, err)
+	}
+	if restored, err := Restore(db, "order"); err != nil || restored {
+		t.Fatalf("expected nothing to restore, got %v %v", restored, err)
+	}
+	if got := fmt.Sprint(visible()); got != "[1 2 3 4]" {
+		t.Fatalf("expected every event after a restore, got %s", got)
+	}
+}